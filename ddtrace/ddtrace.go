@@ -3,6 +3,8 @@
 // This product includes software developed at Datadog (https://www.datadoghq.com/).
 // Copyright 2016-2020 Datadog, Inc.
 
+//go:generate msgp -unexported -marshal=false -o=span_link_msgp.go -tests=false
+
 // Package ddtrace contains the interfaces that specify the implementations of Datadog's
 // tracing library, as well as a set of sub-packages containing various implementations:
 // our native implementation ("tracer"), a wrapper that can be used with Opentracing
@@ -123,6 +125,23 @@ type StartSpanConfig struct {
 	// Force-set the SpanID, rather than use a random number. If no Parent SpanContext is present,
 	// then this will also set the TraceID to the same value.
 	SpanID uint64
+
+	// SpanLinks holds links to spans which are causally related to the new span,
+	// without being its parent.
+	SpanLinks []SpanLink
+}
+
+// SpanLink represents a reference from a span to another span which is related to it,
+// but is not its parent (e.g. the span which produced a message consumed in a batch).
+type SpanLink struct {
+	// TraceID is the trace ID of the linked span.
+	TraceID uint64 `msg:"trace_id"`
+
+	// SpanID is the span ID of the linked span.
+	SpanID uint64 `msg:"span_id"`
+
+	// Attributes holds an optional set of key/value pairs describing the link.
+	Attributes map[string]string `msg:"attributes,omitempty"`
 }
 
 // Logger implementations are able to log given messages that the tracer might output.
@@ -0,0 +1,86 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+package tracer
+
+import (
+	"sort"
+	"sync"
+)
+
+// ackTracker tracks the acknowledgment by the agent of the traces sent, when
+// WithDeliveryTracking is used. Traces are numbered from 1 in the order they are
+// buffered, and the watermark is the highest number n such that the traces 1 to n
+// were all acknowledged. It is safe for concurrent use. A nil *ackTracker tracks
+// nothing.
+type ackTracker struct {
+	mu     sync.Mutex
+	last   uint64      // number of the last trace buffered
+	mark   uint64      // watermark
+	ranges [][2]uint64 // sorted, disjoint and non-adjacent ranges of numbers acknowledged above mark+1
+}
+
+// assign returns the number of a newly buffered trace.
+func (a *ackTracker) assign() uint64 {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last++
+	return a.last
+}
+
+// ack records the traces with the given numbers as acknowledged, advancing the
+// watermark if they fill the gap above it.
+func (a *ackTracker) ack(seqs []uint64) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, n := range seqs {
+		if n > a.mark {
+			a.insert(n)
+		}
+	}
+	for len(a.ranges) > 0 && a.ranges[0][0] == a.mark+1 {
+		a.mark = a.ranges[0][1]
+		a.ranges = a.ranges[1:]
+	}
+}
+
+// insert adds n to the acknowledged ranges, merging the ranges it joins. a.mu must
+// be held.
+func (a *ackTracker) insert(n uint64) {
+	// first range ending at n-1 or later
+	i := sort.Search(len(a.ranges), func(i int) bool { return a.ranges[i][1]+1 >= n })
+	switch {
+	case i == len(a.ranges) || a.ranges[i][0] > n+1:
+		a.ranges = append(a.ranges, [2]uint64{})
+		copy(a.ranges[i+1:], a.ranges[i:])
+		a.ranges[i] = [2]uint64{n, n}
+	case a.ranges[i][0] == n+1:
+		a.ranges[i][0] = n
+	case a.ranges[i][1]+1 == n:
+		a.ranges[i][1] = n
+		if i+1 < len(a.ranges) && a.ranges[i+1][0] == n+1 {
+			a.ranges[i][1] = a.ranges[i+1][1]
+			a.ranges = append(a.ranges[:i+1], a.ranges[i+2:]...)
+		}
+	default:
+		// already acknowledged
+	}
+}
+
+// watermarks returns the number of the last trace buffered and the watermark.
+func (a *ackTracker) watermarks() (buffered, delivered uint64) {
+	if a == nil {
+		return 0, 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last, a.mark
+}
@@ -0,0 +1,118 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+package tracer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAckTracker(t *testing.T) {
+	assert := assert.New(t)
+	var a ackTracker
+	for i := 0; i < 10; i++ {
+		a.assign()
+	}
+	for _, tt := range []struct {
+		ack    []uint64
+		mark   uint64
+		ranges [][2]uint64
+	}{
+		{ack: []uint64{3, 4}, mark: 0, ranges: [][2]uint64{{3, 4}}},
+		{ack: []uint64{8}, mark: 0, ranges: [][2]uint64{{3, 4}, {8, 8}}},
+		{ack: []uint64{6, 2}, mark: 0, ranges: [][2]uint64{{2, 4}, {6, 6}, {8, 8}}},
+		{ack: []uint64{7, 4}, mark: 0, ranges: [][2]uint64{{2, 4}, {6, 8}}},
+		{ack: []uint64{1}, mark: 4, ranges: [][2]uint64{{6, 8}}},
+		{ack: []uint64{5, 1}, mark: 8, ranges: nil},
+		{ack: []uint64{10}, mark: 8, ranges: [][2]uint64{{10, 10}}},
+	} {
+		a.ack(tt.ack)
+		buffered, delivered := a.watermarks()
+		assert.Equal(uint64(10), buffered)
+		assert.Equal(tt.mark, delivered)
+		assert.Equal(tt.ranges, append([][2]uint64(nil), a.ranges...))
+	}
+
+	var nila *ackTracker
+	assert.Equal(uint64(0), nila.assign())
+	nila.ack([]uint64{1})
+	buffered, delivered := nila.watermarks()
+	assert.Equal(uint64(0), buffered)
+	assert.Equal(uint64(0), delivered)
+}
+
+func TestDeliveryTracking(t *testing.T) {
+	defer func(old time.Duration) { sendRetryBaseDelay = old }(sendRetryBaseDelay)
+	sendRetryBaseDelay = time.Millisecond
+	errRefused := errors.New("connection refused")
+	// flush pushes n traces into tracer and flushes them.
+	flush := func(tracer *tracer, n int) {
+		for i := 0; i < n; i++ {
+			tracer.pushPayload([]*span{newBasicSpan("op")})
+		}
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+	}
+	// assertWatermarks asserts the watermarks of tracer.
+	assertWatermarks := func(t *testing.T, tracer *tracer, buffered, delivered uint64) {
+		b, d := tracer.acks.watermarks()
+		assert.Equal(t, buffered, b, "buffered")
+		assert.Equal(t, delivered, d, "delivered")
+	}
+
+	t.Run("delivered", func(t *testing.T) {
+		tracer := newUnstartedTracer(withTransport(newDummyTransport()), WithDeliveryTracking())
+		flush(tracer, 2)
+		assertWatermarks(t, tracer, 2, 2)
+		flush(tracer, 3)
+		assertWatermarks(t, tracer, 5, 5)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		transport := newFailingTransport(sendAttempts, errRefused)
+		tracer := newUnstartedTracer(withTransport(transport), WithDeliveryTracking())
+		flush(tracer, 2)
+		assertWatermarks(t, tracer, 2, 0)
+		// later deliveries don't make up for the lost traces
+		flush(tracer, 1)
+		assertWatermarks(t, tracer, 3, 0)
+		log.Flush()
+	})
+
+	t.Run("retried", func(t *testing.T) {
+		transport := newFailingTransport(sendAttempts, errRefused)
+		tracer := newUnstartedTracer(withTransport(transport), WithDeliveryTracking(), WithRetryBuffer(0))
+		flush(tracer, 2)
+		assertWatermarks(t, tracer, 2, 0)
+		flush(tracer, 1)
+		assertWatermarks(t, tracer, 3, 3)
+		log.Flush()
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tracer := newUnstartedTracer(withTransport(newDummyTransport()))
+		flush(tracer, 2)
+		assert.Nil(t, tracer.acks)
+	})
+}
+
+func TestDeliveryWatermarks(t *testing.T) {
+	assert := assert.New(t)
+	tracer, _, _, stop := startTestTracer(t, WithDeliveryTracking())
+	defer stop()
+
+	tracer.StartSpan("op").Finish()
+	tracer.StartSpan("op").Finish()
+	Flush()
+	buffered, delivered := DeliveryWatermarks()
+	assert.Equal(uint64(2), buffered)
+	assert.Equal(uint64(2), delivered)
+}
@@ -0,0 +1,69 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+package tracer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultDumpMaxSize specifies the default total size in bytes of the payloads
+// kept on disk by WithDebugPayloadDump.
+const defaultDumpMaxSize = 64 * 1024 * 1024
+
+// payloadDumper writes the payloads sent to the agent to files in a directory,
+// removing the oldest files once their total size exceeds a maximum. It is safe
+// for concurrent use.
+type payloadDumper struct {
+	dir string // directory holding the files
+	max int64  // maximum total size of the files
+
+	mu    sync.Mutex
+	seq   uint64   // sequence number of the last file
+	files []string // paths of the files written, oldest first
+	sizes []int64  // sizes of the files written, oldest first
+	size  int64    // total size of the files
+}
+
+// newPayloadDumper returns a payloadDumper writing to dir at most max bytes.
+func newPayloadDumper(dir string, max int64) *payloadDumper {
+	return &payloadDumper{dir: dir, max: max}
+}
+
+// dump writes the contents of p, as they will be read by the transport, to a new
+// file. The read position of p is restored.
+func (d *payloadDumper) dump(p *payload) error {
+	b, err := ioutil.ReadAll(p)
+	p.rewind()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+	d.seq++
+	path := filepath.Join(d.dir, fmt.Sprintf("payload-%06d-%s.bin", d.seq, p.id))
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return err
+	}
+	d.files = append(d.files, path)
+	d.sizes = append(d.sizes, int64(len(b)))
+	d.size += int64(len(b))
+	for d.size > d.max && len(d.files) > 0 {
+		if err := os.Remove(d.files[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.size -= d.sizes[0]
+		d.files = d.files[1:]
+		d.sizes = d.sizes[1:]
+	}
+	return nil
+}
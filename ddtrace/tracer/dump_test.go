@@ -0,0 +1,126 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+package tracer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rawTransport is a dummyTransport which records the bytes of the payloads sent.
+type rawTransport struct {
+	*dummyTransport
+
+	mu   sync.Mutex
+	sent [][]byte
+}
+
+func (t *rawTransport) send(ctx context.Context, p *payload) (io.ReadCloser, error) {
+	b, err := ioutil.ReadAll(p)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.sent = append(t.sent, b)
+	t.mu.Unlock()
+	return ioutil.NopCloser(strings.NewReader("OK")), nil
+}
+
+func (t *rawTransport) Sent() [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([][]byte(nil), t.sent...)
+}
+
+// dumpedFiles returns the contents of the files in dir, in name order.
+func dumpedFiles(t *testing.T, dir string) [][]byte {
+	names, err := filepath.Glob(filepath.Join(dir, "payload-*.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files [][]byte
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, b)
+	}
+	return files
+}
+
+func TestTracerPayloadDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dd-trace-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("enabled", func(t *testing.T) {
+		assert := assert.New(t)
+		dir := filepath.Join(dir, "enabled")
+		transport := &rawTransport{dummyTransport: newDummyTransport()}
+		tracer := newUnstartedTracer(withTransport(transport), WithDebugPayloadDump(dir, 0))
+		for i := 0; i < 2; i++ {
+			tracer.pushPayload([]*span{newBasicSpan("root"), newBasicSpan("child")})
+			tracer.flush(flushReasonScheduled)
+			tracer.wg.Wait()
+		}
+
+		sent := transport.Sent()
+		assert.Len(sent, 2)
+		assert.Equal(sent, dumpedFiles(t, dir))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		transport := &rawTransport{dummyTransport: newDummyTransport()}
+		tracer := newUnstartedTracer(withTransport(transport))
+		tracer.pushPayload([]*span{newBasicSpan("root")})
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+
+		assert.Len(t, transport.Sent(), 1)
+		assert.Nil(t, tracer.dumper)
+	})
+}
+
+func TestPayloadDumperRotation(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "dd-trace-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var payloads []*payload
+	for i := 0; i < 4; i++ {
+		p := newPayload()
+		if err := p.push(spanList{newBasicSpan("op")}); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, p)
+	}
+	// room for the last two payloads only
+	d := newPayloadDumper(dir, int64(payloads[2].size()+payloads[3].size()))
+
+	for _, p := range payloads {
+		assert.NoError(d.dump(p))
+	}
+	files := dumpedFiles(t, dir)
+	assert.Len(files, 2)
+	for i, p := range payloads[2:] {
+		want, err := ioutil.ReadAll(p)
+		assert.NoError(err)
+		assert.Equal(want, files[i])
+	}
+}
@@ -0,0 +1,142 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+package tracer
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+// encoder specifies the on-wire encoding of the traces sent to the agent.
+type encoder interface {
+	// encode returns the encoded form of the given trace. The payload sent to the
+	// agent is made up of a sequence of encoded traces.
+	encode(trace []*span) ([]byte, error)
+
+	// contentType returns the media type of the payloads produced by the encoder.
+	contentType() string
+}
+
+// msgpackEncoder is the default encoder. Payloads using it are msgpack arrays of
+// traces, the array header being maintained by the payload itself.
+type msgpackEncoder struct{}
+
+var _ encoder = msgpackEncoder{}
+
+// encode implements encoder.
+func (msgpackEncoder) encode(trace []*span) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := msgp.Encode(&buf, spanList(trace)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// contentType implements encoder.
+func (msgpackEncoder) contentType() string { return "application/msgpack" }
+
+// Causes of encoding failures, used in the "cause" tag of the traces dropped with
+// the reason "encoding_error".
+const (
+	encodeCauseOverflow         = "overflow"          // a length or the number of traces exceeds what the format allows
+	encodeCauseUnsupportedType  = "unsupported_type"  // a value has a type which the encoder does not support
+	encodeCauseUnsupportedValue = "unsupported_value" // a value is not representable, e.g. NaN in JSON
+	encodeCauseOther            = "other"             // any other failure
+)
+
+// encodeError is returned by payload.push when a trace fails to encode.
+type encodeError struct {
+	cause string // one of the encodeCause constants
+	err   error  // error returned by the encoder
+}
+
+// newEncodeError returns an *encodeError wrapping err, an error returned by an
+// encoder, along with its cause.
+func newEncodeError(err error) *encodeError {
+	cause := encodeCauseOther
+	switch msgp.Cause(err).(type) {
+	case msgp.ArrayError, msgp.IntOverflow, msgp.UintOverflow, msgp.UintBelowZero:
+		cause = encodeCauseOverflow
+	case *msgp.ErrUnsupportedType, *json.UnsupportedTypeError:
+		cause = encodeCauseUnsupportedType
+	case *json.UnsupportedValueError:
+		cause = encodeCauseUnsupportedValue
+	}
+	return &encodeError{cause: cause, err: err}
+}
+
+func (e *encodeError) Error() string { return e.err.Error() }
+
+// encodeErrorCause returns the cause of err, an error returned by payload.push.
+func encodeErrorCause(err error) string {
+	if e, ok := err.(*encodeError); ok {
+		return e.cause
+	}
+	return encodeCauseOther
+}
+
+// encodeV05 encodes traces using the schema of version v0.5 of the agent's trace
+// API: a two-element array holding a table of all the strings in the payload,
+// followed by the array of traces. Each span is an array of 12 fields, in which
+// strings are replaced by their index in the table. Span links and span events
+// are not part of the schema and are left out.
+func encodeV05(traces spanLists) []byte {
+	strs := v05Strings{index: map[string]uint32{"": 0}, table: []string{""}}
+	var body []byte
+	body = msgp.AppendArrayHeader(body, uint32(len(traces)))
+	for _, trace := range traces {
+		body = msgp.AppendArrayHeader(body, uint32(len(trace)))
+		for _, s := range trace {
+			body = msgp.AppendArrayHeader(body, 12)
+			body = msgp.AppendUint32(body, strs.add(s.Service))
+			body = msgp.AppendUint32(body, strs.add(s.Name))
+			body = msgp.AppendUint32(body, strs.add(s.Resource))
+			body = msgp.AppendUint64(body, s.TraceID)
+			body = msgp.AppendUint64(body, s.SpanID)
+			body = msgp.AppendUint64(body, s.ParentID)
+			body = msgp.AppendInt64(body, s.Start)
+			body = msgp.AppendInt64(body, s.Duration)
+			body = msgp.AppendInt32(body, s.Error)
+			body = msgp.AppendMapHeader(body, uint32(len(s.Meta)))
+			for k, v := range s.Meta {
+				body = msgp.AppendUint32(body, strs.add(k))
+				body = msgp.AppendUint32(body, strs.add(v))
+			}
+			body = msgp.AppendMapHeader(body, uint32(len(s.Metrics)))
+			for k, v := range s.Metrics {
+				body = msgp.AppendUint32(body, strs.add(k))
+				body = msgp.AppendFloat64(body, v)
+			}
+			body = msgp.AppendUint32(body, strs.add(s.Type))
+		}
+	}
+	b := msgp.AppendArrayHeader(nil, 2)
+	b = msgp.AppendArrayHeader(b, uint32(len(strs.table)))
+	for _, str := range strs.table {
+		b = msgp.AppendString(b, str)
+	}
+	return append(b, body...)
+}
+
+// v05Strings is the string table of a v0.5 payload. The empty string always has
+// index 0.
+type v05Strings struct {
+	index map[string]uint32 // index of each string in table
+	table []string          // strings in order of insertion
+}
+
+// add returns the index of str in the table, adding it if needed.
+func (s *v05Strings) add(str string) uint32 {
+	if i, ok := s.index[str]; ok {
+		return i
+	}
+	i := uint32(len(s.table))
+	s.index[str] = i
+	s.table = append(s.table, str)
+	return i
+}
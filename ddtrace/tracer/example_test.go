@@ -6,8 +6,10 @@
 package tracer
 
 import (
+	"expvar"
 	"io/ioutil"
 	"log"
+	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
 )
@@ -37,3 +39,45 @@ func Example() {
 		log.Fatal(err)
 	}
 }
+
+// expvarStatsd is a StatsdClient publishing the metrics of the tracer using the
+// expvar package, as an example of an adapter to another metrics backend.
+type expvarStatsd struct {
+	metrics *expvar.Map
+}
+
+func (c expvarStatsd) Incr(name string, tags []string, rate float64) error {
+	c.metrics.Add(name, 1)
+	return nil
+}
+
+func (c expvarStatsd) Count(name string, value int64, tags []string, rate float64) error {
+	c.metrics.Add(name, value)
+	return nil
+}
+
+func (c expvarStatsd) Gauge(name string, value float64, tags []string, rate float64) error {
+	v := new(expvar.Float)
+	v.Set(value)
+	c.metrics.Set(name, v)
+	return nil
+}
+
+func (c expvarStatsd) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	c.metrics.AddFloat(name+".seconds", value.Seconds())
+	return nil
+}
+
+func (c expvarStatsd) Histogram(name string, value float64, tags []string, rate float64) error {
+	c.metrics.AddFloat(name+".sum", value)
+	return nil
+}
+
+func (c expvarStatsd) Close() error { return nil }
+
+// An example demonstrating how to report the metrics of the tracer to a backend
+// other than the Datadog Agent, here the expvar package.
+func ExampleWithStatsdClient() {
+	Start(WithStatsdClient(expvarStatsd{metrics: expvar.NewMap("tracer")}))
+	defer Stop()
+}
@@ -94,9 +94,11 @@ func logStartup(t *tracer) {
 	if _, err := samplingRulesFromEnv(); err != nil {
 		info.SamplingRulesError = fmt.Sprintf("%s", err)
 	}
-	if err := checkEndpoint(t.transport.endpoint()); err != nil {
-		info.AgentError = fmt.Sprintf("%s", err)
-		log.Warn("DIAGNOSTICS Unable to reach agent: %s", err)
+	if !t.config.dryRun && t.config.exportFunc == nil {
+		if err := checkEndpoint(t.transport.endpoint()); err != nil {
+			info.AgentError = fmt.Sprintf("%s", err)
+			log.Warn("DIAGNOSTICS Unable to reach agent: %s", err)
+		}
 	}
 	bs, err := json.Marshal(info)
 	if err != nil {
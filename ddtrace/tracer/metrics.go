@@ -6,8 +6,13 @@
 package tracer
 
 import (
+	"fmt"
 	"runtime"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,11 +23,16 @@ import (
 // be reported.
 const defaultMetricsReportInterval = 10 * time.Second
 
-type statsdClient interface {
+// StatsdClient is implemented by the clients receiving the metrics the tracer reports
+// about itself, such as the datadog.tracer.* health and flush metrics. It is a subset
+// of the interface of the github.com/DataDog/datadog-go/statsd client, which is used
+// by default. The rate is the sample rate of the metric, between 0 and 1.
+type StatsdClient interface {
 	Incr(name string, tags []string, rate float64) error
 	Count(name string, value int64, tags []string, rate float64) error
 	Gauge(name string, value float64, tags []string, rate float64) error
 	Timing(name string, value time.Duration, tags []string, rate float64) error
+	Histogram(name string, value float64, tags []string, rate float64) error
 	Close() error
 }
 
@@ -101,7 +111,281 @@ func (t *tracer) reportHealthMetrics(interval time.Duration) {
 		case <-ticker.C:
 			t.config.statsd.Count("datadog.tracer.spans_started", atomic.SwapInt64(&t.spansStarted, 0), nil, 1)
 			t.config.statsd.Count("datadog.tracer.spans_finished", atomic.SwapInt64(&t.spansFinished, 0), nil, 1)
-			t.config.statsd.Count("datadog.tracer.traces_dropped", atomic.SwapInt64(&t.tracesDropped, 0), []string{"reason:trace_too_large"}, 1)
+			t.config.statsd.Count("datadog.tracer.spans_added", atomic.SwapInt64(&t.spansAdded, 0), nil, 1)
+			t.recordDrop(dropReasonTraceTooLarge, atomic.SwapInt64(&t.tracesDropped, 0))
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// dropReason specifies why traces were dropped. The reasons passed to the hook set
+// using WithDropHook are listed in its documentation, which must be kept in sync.
+type dropReason int
+
+const (
+	dropReasonEncodingError dropReason = iota // the trace could not be encoded
+	dropReasonSendFailed                      // the payload could not be sent to the agent
+	dropReasonTraceTooLarge                   // the trace exceeded traceMaxSize spans or the maximum payload size
+	dropReasonStopTimeout                     // the tracer stopped before the trace was sent
+	dropReasonBackpressure                    // the buffered data exceeded the backpressure high-water mark
+	dropReasonMemoryLimit                     // the buffered and in-flight data exceeded the memory budget
+	dropReasonCircuitOpen                     // sends were paused after consecutive failures
+	dropReasonInvalidUTF8                     // all the spans of the trace had invalid UTF-8
+	dropReasonSendTimeout                     // the payload took too long to send to the agent
+	dropReasonFiltered                        // all the spans of the trace were rejected by the span filter
+	dropReasonInvalidID                       // a span of the trace had a zero trace or span ID
+	dropReasonPaused                          // writing traces was paused using Pause
+	dropReasonEmptyResource                   // all the spans of the trace had an empty resource
+)
+
+// String returns the value used in the "reason" tag of the traces_dropped metric.
+func (r dropReason) String() string {
+	switch r {
+	case dropReasonEncodingError:
+		return "encoding_error"
+	case dropReasonSendFailed:
+		return "send_failed"
+	case dropReasonTraceTooLarge:
+		return "trace_too_large"
+	case dropReasonStopTimeout:
+		return "stop_timeout"
+	case dropReasonBackpressure:
+		return "backpressure"
+	case dropReasonMemoryLimit:
+		return "memory_limit"
+	case dropReasonCircuitOpen:
+		return "circuit_open"
+	case dropReasonInvalidUTF8:
+		return "invalid_utf8"
+	case dropReasonSendTimeout:
+		return "send_timeout"
+	case dropReasonFiltered:
+		return "filtered"
+	case dropReasonInvalidID:
+		return "invalid_id"
+	case dropReasonPaused:
+		return "paused"
+	case dropReasonEmptyResource:
+		return "empty_resource"
+	default:
+		return "unknown"
+	}
+}
+
+// deliberate reports whether traces dropped for reason were dropped as configured,
+// e.g. by a span filter or while paused, rather than due to a failure.
+func (r dropReason) deliberate() bool {
+	switch r {
+	case dropReasonPaused, dropReasonFiltered, dropReasonEmptyResource:
+		return true
+	default:
+		return false
+	}
+}
+
+// notifyDrop calls the hook set using WithDropHook, if any, with a trace of the
+// given number of spans dropped for reason.
+func (t *tracer) notifyDrop(reason dropReason, spans int) {
+	if t.config.dropHook != nil {
+		t.config.dropHook(reason.String(), spans)
+	}
+}
+
+// recordDrop reports count traces as dropped for the given reason. All dropped
+// traces should be reported through it, recordPriorityDrop or recordEncodingDrop,
+// to keep the reason tags consistent.
+func (t *tracer) recordDrop(reason dropReason, count int64) {
+	t.recordDrops(dropKey{reason: reason}, count)
+}
+
+// recordPriorityDrop is like recordDrop, additionally tagging the dropped traces
+// with their sampling priority.
+func (t *tracer) recordPriorityDrop(reason dropReason, priority int, count int64) {
+	t.recordDrops(dropKey{reason: reason, priority: "priority:" + strconv.Itoa(priority)}, count)
+}
+
+// recordEncodingDrop reports a trace as dropped because pushing it into a payload
+// failed with err, tagging it with the cause of the failure.
+func (t *tracer) recordEncodingDrop(err error) {
+	t.recordDrops(dropKey{reason: dropReasonEncodingError, cause: "cause:" + encodeErrorCause(err)}, 1)
+}
+
+func (t *tracer) recordDrops(key dropKey, count int64) {
+	if count > 0 {
+		if !key.reason.deliberate() {
+			t.health.dropped(time.Now(), count)
+		}
+		t.summary.drop(key.reason, count)
+	}
+	if t.config.dropMetricsInterval > 0 {
+		t.drops.add(key, count)
+		return
+	}
+	t.config.statsd.Count("datadog.tracer.traces_dropped", count, key.tags(), 1)
+}
+
+// dropKey identifies the tags of reported dropped traces.
+type dropKey struct {
+	reason   dropReason
+	priority string // "priority:<p>" tag, if any
+	cause    string // "cause:<c>" tag of encoding errors, if any
+}
+
+// tags returns the tags of the traces_dropped metric for k.
+func (k dropKey) tags() []string {
+	tags := []string{"reason:" + k.reason.String()}
+	if k.priority != "" {
+		tags = append(tags, k.priority)
+	}
+	if k.cause != "" {
+		tags = append(tags, k.cause)
+	}
+	return tags
+}
+
+// dropCounter aggregates the traces dropped for each reason between reports, when
+// WithDropMetricsInterval is used. It is safe for concurrent use.
+type dropCounter struct {
+	mu     sync.Mutex
+	counts map[dropKey]int64
+}
+
+// add adds count traces dropped with the tags of key.
+func (c *dropCounter) add(key dropKey, count int64) {
+	if count <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[dropKey]int64)
+	}
+	c.counts[key] += count
+}
+
+// swap returns the counts added since the previous call and resets them.
+func (c *dropCounter) swap() map[dropKey]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.counts
+	c.counts = nil
+	return counts
+}
+
+// reportDrops reports the traces dropped since the previous report, when they are
+// aggregated using WithDropMetricsInterval.
+func (t *tracer) reportDrops() {
+	for key, count := range t.drops.swap() {
+		t.config.statsd.Count("datadog.tracer.traces_dropped", count, key.tags(), 1)
+	}
+}
+
+// reportDropMetrics periodically reports the aggregated dropped traces, until
+// the tracer stops.
+func (t *tracer) reportDropMetrics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.reportDrops()
+		case <-t.stop:
+			t.reportDrops()
+			return
+		}
+	}
+}
+
+// healthSummary accumulates the counts logged periodically when WithHealthSummary
+// is used. It is safe for concurrent use. A nil *healthSummary records nothing.
+type healthSummary struct {
+	mu            sync.Mutex
+	added         int64                // traces received by the worker
+	delivered     int64                // traces delivered to the agent
+	dropped       map[dropReason]int64 // traces dropped, by reason
+	flushes       int64                // flushes which attempted a send
+	flushDuration time.Duration        // total duration of those flushes
+}
+
+// add records the given number of traces as received by the worker.
+func (s *healthSummary) add(traces int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.added += traces
+}
+
+// deliver records the given number of traces as delivered to the agent.
+func (s *healthSummary) deliver(traces int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delivered += traces
+}
+
+// drop records the given number of traces as dropped for reason.
+func (s *healthSummary) drop(reason dropReason, traces int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped == nil {
+		s.dropped = make(map[dropReason]int64)
+	}
+	s.dropped[reason] += traces
+}
+
+// flushed records a flush having taken d.
+func (s *healthSummary) flushed(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushes++
+	s.flushDuration += d
+}
+
+// take returns the summary of the counts recorded since the previous call, given the
+// writer stats of the tracer, and resets them.
+func (s *healthSummary) take(stats WriterStats) string {
+	s.mu.Lock()
+	added, delivered, dropped := s.added, s.delivered, s.dropped
+	flushes, duration := s.flushes, s.flushDuration
+	s.added, s.delivered, s.dropped = 0, 0, nil
+	s.flushes, s.flushDuration = 0, 0
+	s.mu.Unlock()
+
+	var total int64
+	reasons := make([]string, 0, len(dropped))
+	for reason, n := range dropped {
+		total += n
+		reasons = append(reasons, reason.String()+":"+strconv.FormatInt(n, 10))
+	}
+	sort.Strings(reasons)
+	var avg time.Duration
+	if flushes > 0 {
+		avg = duration / time.Duration(flushes)
+	}
+	return fmt.Sprintf("Tracer health: traces added: %d, delivered: %d, dropped: %d [%s], flushes: %d (avg %s), buffered: %d traces (%d bytes)",
+		added, delivered, total, strings.Join(reasons, " "), flushes, avg, stats.BufferedTraces, stats.BufferedBytes)
+}
+
+// reportHealthSummary logs the health summary at every interval, until the tracer
+// stops.
+func (t *tracer) reportHealthSummary(interval time.Duration) {
+	tick, stop := newTicker(interval)
+	defer stop()
+	for {
+		select {
+		case <-tick:
+			log.Info("%s", t.summary.take(t.writerStats()))
 		case <-t.stop:
 			return
 		}
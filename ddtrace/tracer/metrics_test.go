@@ -6,12 +6,19 @@
 package tracer
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,6 +29,7 @@ const (
 	callTypeIncr
 	callTypeCount
 	callTypeTiming
+	callTypeHistogram
 )
 
 type testStatsdClient struct {
@@ -30,11 +38,13 @@ type testStatsdClient struct {
 	incrCalls   []testStatsdCall
 	countCalls  []testStatsdCall
 	timingCalls []testStatsdCall
+	histCalls   []testStatsdCall
 	counts      map[string]int64
 	tags        []string
 	waitCh      chan struct{}
 	n           int
 	closed      bool
+	lateCalls   int // calls made after Close
 }
 
 type testStatsdCall struct {
@@ -46,12 +56,6 @@ type testStatsdCall struct {
 	rate     float64
 }
 
-func withStatsdClient(s statsdClient) StartOption {
-	return func(c *config) {
-		c.statsd = s
-	}
-}
-
 func (tg *testStatsdClient) addCount(name string, value int64) {
 	tg.mu.Lock()
 	defer tg.mu.Unlock()
@@ -98,10 +102,22 @@ func (tg *testStatsdClient) Timing(name string, value time.Duration, tags []stri
 	})
 }
 
+func (tg *testStatsdClient) Histogram(name string, value float64, tags []string, rate float64) error {
+	return tg.addMetric(callTypeHistogram, tags, testStatsdCall{
+		name:     name,
+		floatVal: value,
+		tags:     make([]string, len(tags)),
+		rate:     rate,
+	})
+}
+
 func (tg *testStatsdClient) addMetric(ct callType, tags []string, c testStatsdCall) error {
 	tg.mu.Lock()
 	defer tg.mu.Unlock()
 	copy(c.tags, tags)
+	if tg.closed {
+		tg.lateCalls++
+	}
 	switch ct {
 	case callTypeGauge:
 		tg.gaugeCalls = append(tg.gaugeCalls, c)
@@ -111,6 +127,8 @@ func (tg *testStatsdClient) addMetric(ct callType, tags []string, c testStatsdCa
 		tg.countCalls = append(tg.countCalls, c)
 	case callTypeTiming:
 		tg.timingCalls = append(tg.timingCalls, c)
+	case callTypeHistogram:
+		tg.histCalls = append(tg.histCalls, c)
 	}
 	tg.tags = tags
 	if tg.n > 0 {
@@ -123,6 +141,8 @@ func (tg *testStatsdClient) addMetric(ct callType, tags []string, c testStatsdCa
 }
 
 func (tg *testStatsdClient) Close() error {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
 	tg.closed = true
 	return nil
 }
@@ -151,6 +171,22 @@ func (tg *testStatsdClient) CountCalls() []testStatsdCall {
 	return c
 }
 
+func (tg *testStatsdClient) TimingCalls() []testStatsdCall {
+	tg.mu.RLock()
+	defer tg.mu.RUnlock()
+	c := make([]testStatsdCall, len(tg.timingCalls))
+	copy(c, tg.timingCalls)
+	return c
+}
+
+func (tg *testStatsdClient) HistogramCalls() []testStatsdCall {
+	tg.mu.RLock()
+	defer tg.mu.RUnlock()
+	c := make([]testStatsdCall, len(tg.histCalls))
+	copy(c, tg.histCalls)
+	return c
+}
+
 func (tg *testStatsdClient) CallNames() []string {
 	tg.mu.RLock()
 	defer tg.mu.RUnlock()
@@ -167,6 +203,9 @@ func (tg *testStatsdClient) CallNames() []string {
 	for _, c := range tg.timingCalls {
 		n = append(n, c.name)
 	}
+	for _, c := range tg.histCalls {
+		n = append(n, c.name)
+	}
 	return n
 }
 
@@ -186,6 +225,9 @@ func (tg *testStatsdClient) CallsByName() map[string]int {
 	for _, c := range tg.timingCalls {
 		counts[c.name]++
 	}
+	for _, c := range tg.histCalls {
+		counts[c.name]++
+	}
 	return counts
 }
 
@@ -214,6 +256,7 @@ func (tg *testStatsdClient) Reset() {
 	tg.incrCalls = tg.incrCalls[:0]
 	tg.countCalls = tg.countCalls[:0]
 	tg.timingCalls = tg.timingCalls[:0]
+	tg.histCalls = tg.histCalls[:0]
 	tg.counts = make(map[string]int64)
 	tg.tags = tg.tags[:0]
 	if tg.waitCh != nil {
@@ -245,7 +288,7 @@ func (tg *testStatsdClient) Wait(n int, d time.Duration) error {
 
 func TestReportRuntimeMetrics(t *testing.T) {
 	var tg testStatsdClient
-	trc := newUnstartedTracer(withStatsdClient(&tg))
+	trc := newUnstartedTracer(WithStatsdClient(&tg))
 
 	trc.wg.Add(1)
 	go func() {
@@ -270,7 +313,7 @@ func TestReportHealthMetrics(t *testing.T) {
 	defer func(old time.Duration) { statsInterval = old }(statsInterval)
 	statsInterval = time.Millisecond
 
-	tracer, _, flush, stop := startTestTracer(t, withStatsdClient(&tg))
+	tracer, _, flush, stop := startTestTracer(t, WithStatsdClient(&tg))
 	defer stop()
 
 	tracer.StartSpan("operation").Finish()
@@ -283,10 +326,33 @@ func TestReportHealthMetrics(t *testing.T) {
 	assert.Equal(int64(0), counts["datadog.tracer.traces_dropped"])
 }
 
+func TestReportSpansAdded(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	tracer := newUnstartedTracer(WithStatsdClient(&tg), WithMaxMemory(1))
+
+	var want int64
+	for i := 1; i <= 50; i++ {
+		trace := make([]*span, i%5+1)
+		for j := range trace {
+			trace[j] = newBasicSpan("op")
+		}
+		// traces dropped for exceeding the memory limit are counted as well
+		tracer.pushPayload(trace)
+		want += int64(len(trace))
+	}
+	go tracer.reportHealthMetrics(time.Millisecond)
+	err := tg.Wait(4, time.Second)
+	close(tracer.stop)
+	assert.NoError(err)
+	assert.Equal(want, tg.Counts()["datadog.tracer.spans_added"])
+	assert.Equal(int64(0), atomic.LoadInt64(&tracer.spansAdded))
+}
+
 func TestTracerMetrics(t *testing.T) {
 	assert := assert.New(t)
 	var tg testStatsdClient
-	tracer, _, flush, stop := startTestTracer(t, withStatsdClient(&tg))
+	tracer, _, flush, stop := startTestTracer(t, WithStatsdClient(&tg))
 
 	tracer.StartSpan("operation").Finish()
 	flush(1)
@@ -306,5 +372,487 @@ func TestTracerMetrics(t *testing.T) {
 	stop()
 	calls = tg.CallsByName()
 	assert.Equal(1, calls["datadog.tracer.stopped"])
-	assert.True(tg.closed)
+	// the client belongs to the caller
+	assert.False(tg.closed)
+}
+
+func TestWithStatsdClient(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	tracer, _, flush, stop := startTestTracer(t, WithStatsdClient(&tg))
+	assert.Equal(&tg, tracer.config.statsd)
+
+	tracer.StartSpan("operation").Finish()
+	flush(1)
+	tracer.flushSync(context.Background())
+	assert.NotEmpty(tg.IncrCalls())
+	assert.NotEmpty(tg.CountCalls())
+	assert.NotEmpty(tg.GaugeCalls())
+	assert.NotEmpty(tg.TimingCalls())
+	assert.NotEmpty(tg.HistogramCalls())
+
+	stop()
+	assert.False(tg.closed)
+	assert.False(tracer.config.ownStatsd)
+}
+
+func TestTracerFlushReasonMetrics(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	tracer := newUnstartedTracer(WithStatsdClient(&tg), withTransport(newDummyTransport()))
+	tracer.pushPayload([]*span{newBasicSpan("op")})
+	size := tracer.payload.size()
+	tracer.flush(flushReasonSize)
+	tracer.flush(flushReasonScheduled) // empty payload
+	tracer.wg.Wait()
+
+	var gauges []testStatsdCall
+	for _, c := range tg.GaugeCalls() {
+		if c.name == "datadog.tracer.payload_fill_ratio" {
+			gauges = append(gauges, c)
+		}
+	}
+	assert.Len(gauges, 1)
+	assert.Equal(float64(size)/float64(payloadSizeLimit), gauges[0].floatVal)
+	assert.Equal([]string{"reason:size"}, gauges[0].tags)
+
+	var reasons []string
+	for _, c := range tg.IncrCalls() {
+		if c.name == "datadog.tracer.flush_triggered" {
+			reasons = append(reasons, c.tags...)
+		}
+	}
+	assert.Equal([]string{"reason:size", "reason:scheduled"}, reasons)
+}
+
+func TestTracerClimitWaitMetrics(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	transport := newBlockingTransport()
+	tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg), WithMaxConcurrentFlushes(1))
+
+	tracer.pushPayload([]*span{newBasicSpan("a")})
+	tracer.flush(flushReasonScheduled) // takes the only slot
+	tracer.pushPayload([]*span{newBasicSpan("b")})
+	flushed := make(chan struct{})
+	go func() {
+		tracer.flush(flushReasonScheduled)
+		close(flushed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	transport.Unblock()
+	<-flushed
+	tracer.wg.Wait()
+
+	assert.Equal(int64(1), tg.Counts()["datadog.tracer.flush_climit_blocked"])
+	var waits []time.Duration
+	for _, c := range tg.TimingCalls() {
+		if c.name == "datadog.tracer.flush_climit_wait" {
+			waits = append(waits, c.timeVal)
+		}
+	}
+	assert.Len(waits, 2)
+	assert.True(waits[1] >= 20*time.Millisecond, "wait: %s", waits[1])
+}
+
+func TestTracerMetricsSampleRate(t *testing.T) {
+	t.Run("flush", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(withTransport(newDummyTransport()), WithStatsdClient(&tg), WithTracerMetricsSampleRate(0.25))
+		tracer.pushPayload([]*span{newBasicSpan("a")})
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+
+		rates := make(map[string]float64)
+		for _, calls := range [][]testStatsdCall{tg.IncrCalls(), tg.CountCalls(), tg.TimingCalls()} {
+			for _, c := range calls {
+				rates[c.name] = c.rate
+			}
+		}
+		for _, name := range []string{
+			"datadog.tracer.flush_triggered",
+			"datadog.tracer.flush_climit_wait",
+			"datadog.tracer.flush_bytes",
+			"datadog.tracer.flush_traces",
+			"datadog.tracer.flush_duration",
+		} {
+			assert.Equal(0.25, rates[name], name)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, rate := range []float64{0, -1, 1.5} {
+			c := newConfig(WithTracerMetricsSampleRate(rate))
+			assert.Equal(t, 1.0, c.metricsSampleRate)
+		}
+	})
+}
+
+func TestTracerFlushDurationTags(t *testing.T) {
+	for name, tt := range map[string]struct {
+		transport transport
+		outcome   string
+	}{
+		"success": {transport: newDummyTransport(), outcome: "outcome:success"},
+		"error":   {transport: newFailingTransport(1, &statusError{code: 400}), outcome: "outcome:error"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var tg testStatsdClient
+			tracer := newUnstartedTracer(withTransport(tt.transport), WithStatsdClient(&tg))
+			tracer.pushPayload([]*span{newBasicSpan("a")})
+			tracer.flush(flushReasonSize)
+			tracer.wg.Wait()
+			log.Flush() // don't leak the send error into other tests' loggers
+
+			var tags [][]string
+			for _, c := range tg.TimingCalls() {
+				if c.name == "datadog.tracer.flush_duration" {
+					tags = append(tags, c.tags)
+				}
+			}
+			assert.Equal(t, [][]string{{"reason:size", tt.outcome}}, tags)
+		})
+	}
+}
+
+func TestTracerEncodeMetrics(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	tracer := newUnstartedTracer(WithStatsdClient(&tg), withEncoder(jsonEncoder{}))
+	small := []*span{newBasicSpan("small")}
+	large := make([]*span, 1000)
+	for i := range large {
+		large[i] = newBasicSpan("large")
+		large[i].Meta["key"] = strings.Repeat("X", 1024)
+	}
+	bad := newBasicSpan("bad")
+	bad.Metrics["nan"] = math.NaN()
+	tracer.pushPayload(small)
+	tracer.pushPayload(large)
+	tracer.pushPayload([]*span{bad})
+
+	timings := tg.TimingCalls()
+	assert.Len(timings, 3)
+	for _, c := range timings {
+		assert.Equal("datadog.tracer.encode_duration", c.name)
+	}
+	assert.Equal([]string{"outcome:success"}, timings[0].tags)
+	assert.Equal([]string{"outcome:success"}, timings[1].tags)
+	assert.Equal([]string{"outcome:error"}, timings[2].tags)
+	assert.True(timings[0].timeVal > 0)
+	assert.True(timings[1].timeVal > timings[0].timeVal)
+
+	var spans []float64
+	for _, c := range tg.HistogramCalls() {
+		assert.Equal("datadog.tracer.spans_per_trace", c.name)
+		spans = append(spans, c.floatVal)
+	}
+	assert.Equal([]float64{1, 1000, 1}, spans)
+	log.Flush() // don't leak the encoding error into other tests' loggers
+}
+
+func TestTracerEncodingErrorCause(t *testing.T) {
+	nan := newBasicSpan("nan")
+	nan.Metrics["nan"] = math.NaN()
+	unsupported := newBasicSpan("unsupported")
+	unsupported.SpanEvents = []spanEvent{{Name: "event", Attributes: map[string]interface{}{"struct": struct{}{}}}}
+
+	for _, tt := range []struct {
+		cause string
+		opts  []StartOption
+		span  *span
+		full  bool // whether the payload holds the maximum number of traces
+	}{
+		{cause: "unsupported_type", span: unsupported},
+		{cause: "unsupported_value", opts: []StartOption{withEncoder(jsonEncoder{})}, span: nan},
+		{cause: "overflow", span: newBasicSpan("op"), full: true},
+		{cause: "other", opts: []StartOption{withEncoder(&failingEncoder{n: 1})}, span: newBasicSpan("op")},
+	} {
+		t.Run(tt.cause, func(t *testing.T) {
+			var tg testStatsdClient
+			tracer := newUnstartedTracer(append(tt.opts, WithStatsdClient(&tg))...)
+			if tt.full {
+				atomic.StoreUint64(&tracer.payload.count, 1<<32-1)
+			}
+			tracer.pushPayload([]*span{tt.span})
+			log.Flush()
+
+			var tags [][]string
+			for _, c := range tg.CountCalls() {
+				if c.name == "datadog.tracer.traces_dropped" {
+					tags = append(tags, c.tags)
+				}
+			}
+			assert.Equal(t, [][]string{{"reason:encoding_error", "cause:" + tt.cause}}, tags)
+		})
+	}
+}
+
+func TestHealthSummary(t *testing.T) {
+	assert := assert.New(t)
+	ticks := make(chan time.Time)
+	intervals := make(chan time.Duration, 1)
+	defer func(old func(time.Duration) (<-chan time.Time, func())) { newTicker = old }(newTicker)
+	newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		intervals <- d
+		return ticks, func() {}
+	}
+	tp := new(testLogger)
+	tracer, _, _, stop := startTestTracer(t, WithLogger(tp), WithHealthSummary(30*time.Second))
+	defer stop()
+	assert.Equal(30*time.Second, <-intervals)
+
+	// summary ticks the clock and returns the summary logged as a result.
+	summary := func() string {
+		tp.Reset()
+		ticks <- time.Now()
+		timeout := time.After(time.Second)
+		for {
+			for _, line := range tp.Lines() {
+				if strings.Contains(line, "Tracer health") {
+					return line
+				}
+			}
+			select {
+			case <-timeout:
+				t.Fatal("timed out waiting for the health summary")
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	tracer.StartSpan("delivered").Finish()
+	Flush()
+	Pause()
+	tracer.StartSpan("dropped").Finish()
+	Flush()
+	Resume()
+	tracer.StartSpan("buffered").Finish()
+	for tracer.writerStats().BufferedTraces == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	size := tracer.writerStats().BufferedBytes
+	assert.Regexp(`INFO: Tracer health: traces added: 3, delivered: 1, dropped: 1 \[paused:1\], flushes: 1 \(avg [0-9.]+[µnm]?s\), buffered: 1 traces \(`+strconv.Itoa(size)+` bytes\)$`, summary())
+
+	// the counts are reset at every interval
+	assert.Regexp(`INFO: Tracer health: traces added: 0, delivered: 0, dropped: 0 \[\], flushes: 0 \(avg 0s\), buffered: 1 traces`, summary())
+}
+
+func TestTracerPayloadSpans(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	tracer := newUnstartedTracer(withTransport(newDummyTransport()), WithStatsdClient(&tg))
+	for _, n := range []int{1, 5, 3} {
+		tracer.pushPayload(newSpanList(n))
+	}
+	tracer.flush(flushReasonScheduled)
+	tracer.pushPayload(newSpanList(2))
+	tracer.flush(flushReasonScheduled)
+	// empty payloads are not reported
+	tracer.flush(flushReasonScheduled)
+	tracer.wg.Wait()
+
+	var spans []float64
+	for _, c := range tg.HistogramCalls() {
+		if c.name == "datadog.tracer.payload_spans" {
+			spans = append(spans, c.floatVal)
+		}
+	}
+	assert.Equal([]float64{9, 2}, spans)
+}
+
+func TestTracerDropHook(t *testing.T) {
+	type drop struct {
+		reason string
+		spans  int
+	}
+	var (
+		mu    sync.Mutex
+		drops []drop
+	)
+	hook := WithDropHook(func(reason string, spans int) {
+		mu.Lock()
+		defer mu.Unlock()
+		drops = append(drops, drop{reason, spans})
+	})
+	reset := func() []drop {
+		mu.Lock()
+		defer mu.Unlock()
+		d := drops
+		drops = nil
+		return d
+	}
+
+	t.Run("encoding_error", func(t *testing.T) {
+		defer reset()
+		tracer := newUnstartedTracer(hook, withEncoder(jsonEncoder{}))
+		bad := newBasicSpan("bad")
+		bad.Metrics["nan"] = math.NaN()
+		tracer.pushPayload([]*span{newBasicSpan("ok")})
+		tracer.pushPayload([]*span{bad, newBasicSpan("child")})
+		log.Flush()
+		assert.Equal(t, []drop{{"encoding_error", 2}}, reset())
+	})
+
+	t.Run("trace_too_large", func(t *testing.T) {
+		defer reset()
+		defer func(old int) { traceMaxSize = old }(traceMaxSize)
+		traceMaxSize = 2
+		_, _, _, stop := startTestTracer(t, hook)
+		defer stop()
+		trace := newTrace()
+		for i := 0; i < 4; i++ {
+			trace.push(newBasicSpan("op"))
+		}
+		log.Flush()
+		assert.Equal(t, []drop{{"trace_too_large", 2}}, reset())
+	})
+
+	t.Run("backpressure", func(t *testing.T) {
+		defer reset()
+		tracer := newUnstartedTracer(hook, WithBackpressure(1, BackpressureDropNewest, 0))
+		tracer.pushPayload([]*span{newBasicSpan("op")})
+		tracer.pushTrace([]*span{newBasicSpan("op"), newBasicSpan("op"), newBasicSpan("op")})
+		assert.Equal(t, []drop{{"backpressure", 3}}, reset())
+	})
+}
+
+func TestTracerActiveFlushes(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	transport := newBlockingTransport()
+	tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg), WithMaxConcurrentFlushes(3))
+	for i := 0; i < 3; i++ {
+		tracer.pushPayload([]*span{newBasicSpan("op")})
+		tracer.flush(flushReasonManual)
+	}
+	active := func() []float64 {
+		var v []float64
+		for _, c := range tg.GaugeCalls() {
+			if c.name == "datadog.tracer.active_flushes" {
+				v = append(v, c.floatVal)
+			}
+		}
+		return v
+	}
+	assert.Equal([]float64{1, 2, 3}, active())
+
+	transport.Unblock()
+	tracer.wg.Wait()
+	assert.Equal([]float64{1, 2, 3, 2, 1, 0}, active())
+}
+
+func TestFlushReasonString(t *testing.T) {
+	for r, want := range map[flushReason]string{
+		flushReasonScheduled: "scheduled",
+		flushReasonSize:      "size",
+		flushReasonShutdown:  "shutdown",
+		flushReasonManual:    "manual",
+		flushReasonAge:       "age",
+		flushReasonPriority:  "priority",
+		flushReason(-1):      "unknown",
+	} {
+		assert.Equal(t, want, r.String())
+	}
+}
+
+func TestRecordDrop(t *testing.T) {
+	for r, want := range map[dropReason]string{
+		dropReasonEncodingError: "encoding_error",
+		dropReasonSendFailed:    "send_failed",
+		dropReasonTraceTooLarge: "trace_too_large",
+		dropReasonStopTimeout:   "stop_timeout",
+		dropReasonBackpressure:  "backpressure",
+		dropReasonMemoryLimit:   "memory_limit",
+		dropReasonCircuitOpen:   "circuit_open",
+		dropReasonInvalidUTF8:   "invalid_utf8",
+		dropReasonSendTimeout:   "send_timeout",
+		dropReasonFiltered:      "filtered",
+		dropReasonInvalidID:     "invalid_id",
+		dropReasonPaused:        "paused",
+		dropReasonEmptyResource: "empty_resource",
+		dropReason(-1):          "unknown",
+	} {
+		t.Run(want, func(t *testing.T) {
+			assert := assert.New(t)
+			var tg testStatsdClient
+			tracer := newUnstartedTracer(WithStatsdClient(&tg))
+			tracer.recordDrop(r, 3)
+
+			calls := tg.CountCalls()
+			assert.Len(calls, 1)
+			assert.Equal("datadog.tracer.traces_dropped", calls[0].name)
+			assert.Equal(int64(3), calls[0].intVal)
+			assert.Equal([]string{"reason:" + want}, calls[0].tags)
+		})
+	}
+}
+
+func TestRecordDropAggregated(t *testing.T) {
+	// dropped sums the reported traces_dropped counts by tag.
+	dropped := func(tg *testStatsdClient) map[string]int64 {
+		counts := make(map[string]int64)
+		for _, c := range tg.CountCalls() {
+			if c.name == "datadog.tracer.traces_dropped" {
+				counts[c.tags[0]] += c.intVal
+			}
+		}
+		return counts
+	}
+
+	t.Run("batched", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), WithDropMetricsInterval(time.Hour))
+		for i := 0; i < 100; i++ {
+			tracer.recordDrop(dropReasonSendFailed, 2)
+			tracer.recordDrop(dropReasonBackpressure, 1)
+		}
+		tracer.recordDrop(dropReasonTraceTooLarge, 0)
+		assert.Len(tg.CountCalls(), 0)
+
+		tracer.reportDrops()
+		assert.Len(tg.CountCalls(), 2)
+		assert.Equal(map[string]int64{"reason:send_failed": 200, "reason:backpressure": 100}, dropped(&tg))
+
+		// nothing is reported when there were no drops
+		tracer.reportDrops()
+		assert.Len(tg.CountCalls(), 2)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var tg testStatsdClient
+		tracer := newTracer(withTransport(newDummyTransport()), WithStatsdClient(&tg), WithDropMetricsInterval(time.Millisecond))
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					tracer.recordDrop(dropReasonSendFailed, 1)
+					time.Sleep(10 * time.Microsecond)
+				}
+			}()
+		}
+		wg.Wait()
+		tracer.Stop()
+		assert.Equal(t, int64(1000), dropped(&tg)["reason:send_failed"])
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newTracer(withTransport(newDummyTransport()), WithStatsdClient(&tg), WithDropMetricsInterval(time.Hour))
+		// closed by the tracer, like the client it creates
+		tracer.config.ownStatsd = true
+		tracer.recordDrop(dropReasonSendFailed, 3)
+		tracer.Stop()
+
+		// the final drops are reported before the client is closed
+		assert.Equal(int64(3), dropped(&tg)["reason:send_failed"])
+		assert.True(tg.closed)
+		assert.Equal(0, tg.lateCalls)
+	})
 }
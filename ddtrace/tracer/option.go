@@ -7,6 +7,7 @@ package tracer
 
 import (
 	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -54,15 +55,45 @@ type config struct {
 	// all spans.
 	globalTags map[string]interface{}
 
+	// writeTags holds a set of tags applied to the spans of every trace as it
+	// is buffered for sending, without overriding the tags of the spans.
+	writeTags map[string]string
+
+	// maxTagValueLength specifies the maximum length in bytes of the span tag
+	// values sent to the agent. Zero disables truncation.
+	maxTagValueLength int
+
+	// maxTagsPerSpan specifies the maximum number of string tags of the spans
+	// sent to the agent. Zero disables the limit.
+	maxTagsPerSpan int
+
 	// transport specifies the Transport interface which will be used to send data to the agent.
 	transport transport
 
+	// dryRun, when set, replaces transport with one which discards all payloads.
+	dryRun bool
+
+	// exportFunc, when set, receives the finished traces instead of the agent.
+	exportFunc func(trace []Span)
+
+	// traceAPIVersion specifies the version of the agent's trace API used by the
+	// default transport, e.g. "v0.4". It defaults to the newest supported one.
+	traceAPIVersion string
+
+	// encoder specifies the encoding of the traces sent to the agent. It defaults
+	// to msgpack.
+	encoder encoder
+
 	// propagator propagates span context cross-process
 	propagator Propagator
 
 	// httpClient specifies the HTTP client to be used by the agent's transport.
 	httpClient *http.Client
 
+	// agentPath specifies the path to which traces are sent, overriding the
+	// path of the trace API version.
+	agentPath string
+
 	// hostname is automatically assigned when the DD_TRACE_REPORT_HOSTNAME is set to true,
 	// and is added as a special tag to the root span of traces.
 	hostname string
@@ -80,12 +111,162 @@ type config struct {
 	dogstatsdAddr string
 
 	// statsd is used for tracking metrics associated with the runtime and the tracer.
-	statsd statsdClient
+	statsd StatsdClient
+
+	// ownStatsd reports whether statsd was created by the tracer, rather than set
+	// using WithStatsdClient, in which case it is closed when the tracer stops.
+	ownStatsd bool
 
 	// samplingRules contains user-defined rules determine the sampling rate to apply
 	// to spans.
 	samplingRules []SamplingRule
 
+	// compressionThreshold specifies the minimum size in bytes of a payload for it
+	// to be gzip-compressed before being sent. Zero disables compression.
+	compressionThreshold int
+
+	// payloadSizeLimit specifies the payload size in bytes above which a flush
+	// is triggered.
+	payloadSizeLimit int
+
+	// dumpDir, when set, specifies the directory to which the payloads sent to
+	// the agent are written, up to dumpMaxSize bytes.
+	dumpDir     string
+	dumpMaxSize int64
+
+	// payloadMaxSize specifies the size in bytes which payloads never exceed, as
+	// the agent would reject them. It is payloadMaxLimit, except in tests.
+	payloadMaxSize int
+
+	// maxConcurrentFlushes specifies the maximum number of payloads which may be
+	// sent to the agent concurrently.
+	maxConcurrentFlushes int
+
+	// adaptiveMin and adaptiveMax, when adaptiveMax is positive, bound the number
+	// of concurrent flushes, adjusted to keep their latency near adaptiveTarget.
+	adaptiveMin, adaptiveMax int
+	adaptiveTarget           time.Duration
+
+	// retryBufferSize specifies the maximum total size in bytes of the payloads
+	// held for retrying after failing to send. Zero disables retrying.
+	retryBufferSize int
+
+	// breakerFailures specifies the number of consecutive failed sends after
+	// which sends are paused for breakerCooldown. Zero disables the breaker.
+	breakerFailures int
+
+	// breakerCooldown specifies how long sends are paused by the breaker.
+	breakerCooldown time.Duration
+
+	// flushInterval specifies the interval at which buffered traces are flushed
+	// to the agent.
+	flushInterval time.Duration
+
+	// flushJitter specifies the maximum amount by which each flush interval is
+	// randomly shortened or lengthened. Zero disables jitter.
+	flushJitter time.Duration
+
+	// dropMetricsInterval specifies the interval over which the traces_dropped
+	// metric is aggregated before being reported. Zero reports every drop.
+	dropMetricsInterval time.Duration
+
+	// healthSummaryInterval specifies the interval at which a summary of the
+	// tracer's health is logged. Zero disables the summary.
+	healthSummaryInterval time.Duration
+
+	// metricsSampleRate specifies the sample rate of the metrics reported on
+	// every flush.
+	metricsSampleRate float64
+
+	// flushHook, when set, is called with the outcome of every flush.
+	flushHook func(FlushStats)
+
+	// endpointSelector, when set, chooses the URL each payload is sent to.
+	endpointSelector func(PayloadMeta) string
+
+	// dropHook, when set, is called for every trace dropped before being
+	// buffered for sending.
+	dropHook func(reason string, spans int)
+
+	// samplingRatesHook, when set, is called with the sampling rates returned by
+	// the agent after every successful flush.
+	samplingRatesHook func(map[string]float64)
+
+	// stopTimeout specifies how long Stop waits for buffered traces to be sent.
+	stopTimeout time.Duration
+
+	// sendTimeout specifies how long a single attempt at sending a payload may
+	// take before it is aborted.
+	sendTimeout time.Duration
+
+	// randSource, when set, is the source of the span IDs and of the jitter of
+	// flushes and retries, instead of the package's securely seeded source.
+	randSource rand.Source
+
+	// minFlushSize specifies the payload size in bytes below which scheduled
+	// flushes are skipped, for at most maxFlushHold. Zero disables it.
+	minFlushSize int
+
+	// maxFlushHold specifies the maximum amount of time traces are held back
+	// by minFlushSize.
+	maxFlushHold time.Duration
+
+	// maxTraceAge specifies the amount of time after which buffered traces are
+	// flushed, regardless of the flush interval. Zero disables it.
+	maxTraceAge time.Duration
+
+	// payloadPerService, when true, buffers the traces of each service in a
+	// separate payload.
+	payloadPerService bool
+
+	// connectionWarmup, when true, connects to the agent when the tracer starts.
+	connectionWarmup bool
+
+	// backpressureBytes specifies the amount of buffered and in-flight data in
+	// bytes above which backpressurePolicy applies to finished traces. Zero
+	// disables backpressure.
+	backpressureBytes int
+
+	// backpressurePolicy specifies how finished traces are handled while the
+	// backpressure high-water mark is exceeded.
+	backpressurePolicy BackpressurePolicy
+
+	// backpressureTimeout specifies how long BackpressureBlock blocks for.
+	backpressureTimeout time.Duration
+
+	// maxMemory specifies the amount of buffered and in-flight data in bytes
+	// above which new traces are dropped. Zero disables the limit.
+	maxMemory int
+
+	// validateUTF8, when true, applies invalidUTF8Policy to the spans having
+	// string fields which are not valid UTF-8.
+	validateUTF8 bool
+
+	// invalidUTF8Policy specifies how spans with invalid UTF-8 are handled.
+	invalidUTF8Policy InvalidUTF8Policy
+
+	// emptyResourcePolicy specifies how spans with an empty resource are handled.
+	emptyResourcePolicy EmptyResourcePolicy
+
+	// trackDelivery, when true, numbers the traces buffered to track their
+	// acknowledgment by the agent.
+	trackDelivery bool
+
+	// passInvalidIDs, when true, sends the traces having spans with a zero trace
+	// or span ID instead of dropping them.
+	passInvalidIDs bool
+
+	// dedupSize specifies the maximum number of span IDs remembered between
+	// flushes to skip duplicate spans. Zero disables deduplication.
+	dedupSize int
+
+	// spanRedactor, when set, is called with every finished span before it is written.
+	spanRedactor func(*SpanData)
+
+	// spanFilter, when set, is called with every finished span before it is written,
+	// after spanRedactor. Spans for which it returns false are dropped.
+	spanFilter func(*SpanData) bool
+
 	// tickChan specifies a channel which will receive the time every time the tracer must flush.
 	// It defaults to time.Ticker; replaced in tests.
 	tickChan <-chan time.Time
@@ -100,6 +281,15 @@ func newConfig(opts ...StartOption) *config {
 	c := new(config)
 	c.sampler = NewAllSampler()
 	c.agentAddr = defaultAddress
+	c.encoder = msgpackEncoder{}
+	c.payloadSizeLimit = payloadSizeLimit
+	c.payloadMaxSize = payloadMaxLimit
+	c.maxConcurrentFlushes = concurrentConnectionLimit
+	c.flushInterval = flushInterval
+	c.stopTimeout = defaultStopTimeout
+	c.sendTimeout = defaultSendTimeout
+	c.maxTagValueLength = defaultMaxTagValueLength
+	c.metricsSampleRate = 1
 	statsdHost, statsdPort := "localhost", "8125"
 	if v := os.Getenv("DD_AGENT_HOST"); v != "" {
 		statsdHost = v
@@ -176,8 +366,10 @@ func newConfig(opts ...StartOption) *config {
 			c.serviceName = filepath.Base(os.Args[0])
 		}
 	}
-	if c.transport == nil {
-		c.transport = newTransport(c.agentAddr, c.httpClient)
+	if c.dryRun || c.exportFunc != nil {
+		c.transport = discardTransport{}
+	} else if c.transport == nil {
+		c.transport = newTransport(c.agentAddr, c.httpClient, c.traceAPIVersion, c.agentPath)
 	}
 	if c.propagator == nil {
 		c.propagator = NewPropagator(nil)
@@ -196,6 +388,7 @@ func newConfig(opts ...StartOption) *config {
 		} else {
 			c.statsd = client
 		}
+		c.ownStatsd = true
 	}
 	return c
 }
@@ -305,6 +498,112 @@ func WithGlobalTag(k string, v interface{}) StartOption {
 	}
 }
 
+// WithGlobalTags sets the given tags on all spans as their trace is buffered for
+// sending. Unlike WithGlobalTag, the tags do not override any tag with the same
+// key set on the span. This option may be used multiple times.
+func WithGlobalTags(tags map[string]string) StartOption {
+	return func(c *config) {
+		if c.writeTags == nil {
+			c.writeTags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			c.writeTags[k] = v
+		}
+	}
+}
+
+// WithTraceAPIVersion sets the version of the agent's trace API to send traces to,
+// one of "v0.5", "v0.4" (the default) or "v0.3". v0.5 payloads replace repeated
+// strings with indexes into a string table, making them smaller at the cost of
+// re-encoding each payload when it is sent; span links and span events are left
+// out. Whatever the version, the tracer falls back to an older one if the agent
+// does not support it.
+func WithTraceAPIVersion(v string) StartOption {
+	return func(c *config) {
+		for _, supported := range traceAPIVersions {
+			if v == supported {
+				c.traceAPIVersion = v
+				return
+			}
+		}
+		log.Warn("ignoring unsupported trace API version %q, must be one of %v", v, traceAPIVersions)
+	}
+}
+
+// WithDryRun makes the tracer encode and flush traces as usual, reporting the same
+// metrics, but discard the payloads instead of sending them to the agent. It can be
+// used to validate instrumentation, e.g. to catch traces which can not be encoded,
+// without any agent running.
+func WithDryRun() StartOption {
+	return func(c *config) {
+		c.dryRun = true
+	}
+}
+
+// WithExportFunc makes the tracer pass every finished trace to fn instead of sending
+// it to the agent, e.g. to bridge traces into another tracing pipeline. The contents
+// of the spans can be read using SpanDataOf. The function is called from a single
+// goroutine, once per trace, after the functions set using WithSpanRedactor and
+// WithSpanFilter, with the spans they kept. The tag limits and UTF-8 validation only
+// apply to traces sent to the agent. Flush has no effect, and Stop returns
+// once the traces finished before it was called have been passed to fn. Traces
+// marked using FlushTrace are reported as delivered once passed to fn.
+func WithExportFunc(fn func(trace []Span)) StartOption {
+	return func(c *config) {
+		c.exportFunc = fn
+	}
+}
+
+// defaultMaxTagValueLength specifies the default maximum length of span tag values,
+// matching the limit above which the agent truncates them.
+const defaultMaxTagValueLength = 25000
+
+// WithMaxTagValueLength sets the maximum length in bytes of the span tag values sent
+// to the agent. Longer values are truncated to that length, ending with "..." when it
+// exceeds 3 bytes, and the keys of the truncated tags are listed in the
+// "_dd.truncated_tags" tag. A length of zero or less disables truncation. The default
+// is 25000, the agent's own limit.
+func WithMaxTagValueLength(n int) StartOption {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxTagValueLength = n
+	}
+}
+
+// WithMaxTagsPerSpan sets the maximum number of string tags of the spans sent to the
+// agent, protecting against instrumentation which sets an unbounded number of them.
+// The tags of spans exceeding it are sorted by key and only the first ones are kept,
+// the number of removed tags being set in the "_dd.tags_truncated" tag and reported in
+// the datadog.tracer.tags_truncated metric. That tag, along with the "_dd.truncated_tags"
+// tag set by WithMaxTagValueLength, counts towards the limit. A limit of zero or less
+// disables it, which is the default.
+func WithMaxTagsPerSpan(n int) StartOption {
+	return func(c *config) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxTagsPerSpan = n
+	}
+}
+
+// WithDebugPayloadDump makes the tracer write every payload sent to the agent to a
+// file in dir, exactly as it is sent, to help diagnose payloads rejected by the agent.
+// Each attempt at sending a payload writes a new file. Once the files written exceed
+// maxSize bytes in total, the oldest ones are removed; a maxSize of zero or less
+// defaults to 64MB. It is meant for debugging only and disabled by default, as it
+// writes every payload to disk.
+func WithDebugPayloadDump(dir string, maxSize int) StartOption {
+	return func(c *config) {
+		if maxSize <= 0 {
+			maxSize = defaultDumpMaxSize
+		}
+		c.dumpDir = dir
+		c.dumpMaxSize = int64(maxSize)
+	}
+}
+
 // WithSampler sets the given sampler to be used with the tracer. By default
 // an all-permissive sampler is used.
 func WithSampler(s Sampler) StartOption {
@@ -329,6 +628,29 @@ func WithHTTPClient(client *http.Client) StartOption {
 	}
 }
 
+// WithUDS configures the tracer to send traces to an agent listening on the Unix
+// domain socket at the given path, e.g. when the agent runs as a Kubernetes DaemonSet
+// sharing its socket through a volume. It replaces any HTTP client set using
+// WithHTTPClient or WithHTTPRoundTripper.
+func WithUDS(socketPath string) StartOption {
+	return func(c *config) {
+		c.httpClient = newUDSClient(socketPath)
+	}
+}
+
+// WithAgentPath overrides the path to which traces are sent, e.g. when the agent
+// is behind a proxy routing requests by path. By default, the path of the trace
+// API version in use is used, e.g. "/v0.4/traces". Setting it disables falling
+// back to older versions of the trace API.
+func WithAgentPath(path string) StartOption {
+	return func(c *config) {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		c.agentPath = path
+	}
+}
+
 // WithAnalytics allows specifying whether Trace Search & Analytics should be enabled
 // for integrations.
 func WithAnalytics(on bool) StartOption {
@@ -369,6 +691,17 @@ func WithDogstatsdAddress(addr string) StartOption {
 	}
 }
 
+// WithStatsdClient makes the tracer report the metrics about itself to client rather
+// than to the Datadog Agent's DogStatsD endpoint, e.g. to route them to another metrics
+// backend through an adapter. This includes the runtime metrics enabled using
+// WithRuntimeMetrics. The client remains owned by the caller: the tracer does not close
+// it when stopping.
+func WithStatsdClient(client StatsdClient) StartOption {
+	return func(c *config) {
+		c.statsd = client
+	}
+}
+
 // WithSamplingRules specifies the sampling rates to apply to spans based on the
 // provided rules.
 func WithSamplingRules(rules []SamplingRule) StartOption {
@@ -385,6 +718,563 @@ func WithServiceVersion(version string) StartOption {
 	}
 }
 
+// defaultCompressionThreshold is the default minimum payload size in bytes for
+// payload compression to apply.
+const defaultCompressionThreshold = 1024
+
+// WithPayloadCompression enables gzip compression of the payloads sent to the agent.
+// Only payloads of at least minSize bytes are compressed, as small payloads gain
+// little and cost CPU. A minSize of zero or less uses the default of 1KB. Payloads
+// are only compressed once the agent's /info endpoint reports a version accepting
+// them, 7.0.0 or later. If the agent rejects a compressed payload anyway, it is sent
+// again uncompressed and compression is disabled for the remaining lifetime of the
+// tracer.
+func WithPayloadCompression(minSize int) StartOption {
+	return func(c *config) {
+		if minSize <= 0 {
+			minSize = defaultCompressionThreshold
+		}
+		c.compressionThreshold = minSize
+	}
+}
+
+// WithPayloadSizeLimit sets the payload size in bytes above which the buffered traces
+// are flushed to the agent. The default is 4.75MB. Since the check happens after a
+// trace is added, payloads may exceed the limit by the size of one trace. The agent
+// rejects requests larger than 9.5MB, so larger values are reduced to that, and the
+// buffered traces are flushed before adding a trace which would make the payload
+// exceed it. Traces larger than 9.5MB on their own are dropped.
+func WithPayloadSizeLimit(size int) StartOption {
+	return func(c *config) {
+		if size <= 0 {
+			log.Warn("ignoring invalid payload size limit %d, must be positive", size)
+			return
+		}
+		if size > payloadMaxLimit {
+			size = payloadMaxLimit
+		}
+		c.payloadSizeLimit = size
+	}
+}
+
+// maxConcurrentFlushesLimit is the upper bound of WithMaxConcurrentFlushes.
+const maxConcurrentFlushesLimit = 1000
+
+// WithMaxConcurrentFlushes sets the maximum number of payloads which may be sent to
+// the agent concurrently, each using its own connection. When reached, flushing blocks
+// until a send completes. The default is 100 and values are capped at 1000.
+func WithMaxConcurrentFlushes(n int) StartOption {
+	return func(c *config) {
+		if n <= 0 {
+			log.Warn("ignoring invalid number of concurrent flushes %d, must be positive", n)
+			return
+		}
+		if n > maxConcurrentFlushesLimit {
+			n = maxConcurrentFlushesLimit
+		}
+		c.maxConcurrentFlushes = n
+	}
+}
+
+// WithAdaptiveConcurrency makes the tracer adjust the maximum number of payloads sent
+// to the agent concurrently to the time flushes take, replacing the fixed limit set
+// using WithMaxConcurrentFlushes. Starting at max, the limit shrinks while flushes
+// take longer than target on average, so that a slow agent is not overwhelmed, and
+// grows while they are faster, staying between min and max. The current limit is
+// reported in the datadog.tracer.flush_concurrency_limit metric whenever it changes.
+// By default, the limit is fixed.
+func WithAdaptiveConcurrency(min, max int, target time.Duration) StartOption {
+	return func(c *config) {
+		if min <= 0 || max < min || target <= 0 {
+			log.Warn("ignoring invalid adaptive concurrency bounds [%d, %d] with target %s", min, max, target)
+			return
+		}
+		if max > maxConcurrentFlushesLimit {
+			max = maxConcurrentFlushesLimit
+		}
+		if min > max {
+			min = max
+		}
+		c.adaptiveMin = min
+		c.adaptiveMax = max
+		c.adaptiveTarget = target
+	}
+}
+
+// WithFlushInterval sets the interval at which buffered traces are flushed to the
+// agent. The default is 2 seconds. Shorter intervals make traces visible sooner, while
+// longer ones reduce the number of requests made by low-volume services and batch jobs.
+// A scheduled flush is skipped when all of the allowed concurrent flushes are in progress.
+func WithFlushInterval(d time.Duration) StartOption {
+	return func(c *config) {
+		if d <= 0 {
+			log.Warn("ignoring invalid flush interval %s, must be positive", d)
+			return
+		}
+		c.flushInterval = d
+	}
+}
+
+// WithRandomSource makes the tracer use src to generate span and trace IDs, and the
+// jitter of flushes and retries, instead of a securely seeded source. As sampling
+// decisions are derived from trace IDs, a source with a fixed seed makes both the IDs
+// and the sampling decisions reproducible, which is useful in tests. Access to src is
+// serialized by the tracer, so it must not be used elsewhere. It should not be used in
+// production, where IDs must be unique across services.
+func WithRandomSource(src rand.Source) StartOption {
+	return func(c *config) {
+		c.randSource = src
+	}
+}
+
+// WithFlushJitter randomizes the interval between scheduled flushes by up to d in
+// either direction, so that instances started at the same time, e.g. during a
+// deployment, do not flush to the agent in lockstep. The jitter is capped at half
+// of the flush interval, meaning that traces are never held for longer than one and
+// a half flush intervals. By default, flushes happen at a fixed interval.
+func WithFlushJitter(d time.Duration) StartOption {
+	return func(c *config) {
+		if d < 0 {
+			log.Warn("ignoring invalid flush jitter %s, must not be negative", d)
+			return
+		}
+		c.flushJitter = d
+	}
+}
+
+// WithTracerMetricsSampleRate sets the statsd sample rate of the health metrics reported
+// on every flush (e.g. datadog.tracer.flush_bytes or datadog.tracer.flush_duration), to
+// reduce the load on the statsd agent in high-throughput services. The rate must be in
+// (0, 1] and defaults to 1. Counts are scaled by the inverse of the rate by the statsd
+// client, so totals remain accurate. Metrics reporting errors and dropped traces are
+// always sent.
+func WithTracerMetricsSampleRate(rate float64) StartOption {
+	return func(c *config) {
+		if !(rate > 0 && rate <= 1) {
+			log.Warn("ignoring invalid tracer metrics sample rate %f, must be in (0, 1]", rate)
+			return
+		}
+		c.metricsSampleRate = rate
+	}
+}
+
+// WithDropMetricsInterval aggregates the datadog.tracer.traces_dropped metric over
+// the given interval, reporting the number of traces dropped for each reason once
+// per interval rather than on every drop. This limits the statsd traffic when the
+// agent is unreachable and flushes fail at a high rate, without affecting totals.
+// By default, every drop is reported as it happens.
+func WithDropMetricsInterval(d time.Duration) StartOption {
+	return func(c *config) {
+		if d <= 0 {
+			log.Warn("ignoring invalid drop metrics interval %s, must be positive", d)
+			return
+		}
+		c.dropMetricsInterval = d
+	}
+}
+
+// WithHealthSummary makes the tracer log a summary of its health at every interval,
+// as a compact heartbeat for operators: the number of traces added, delivered to the
+// agent and dropped, by reason, since the previous summary, along with the average
+// duration of the flushes and the traces currently buffered. By default, no summary
+// is logged.
+func WithHealthSummary(interval time.Duration) StartOption {
+	return func(c *config) {
+		if interval <= 0 {
+			log.Warn("ignoring invalid health summary interval %s, must be positive", interval)
+			return
+		}
+		c.healthSummaryInterval = interval
+	}
+}
+
+// WithFlushHook sets a function which is called at the end of every flush of buffered
+// traces to the agent, whether or not it succeeded, e.g. to report flushes to another
+// metrics system. The hook is called from the goroutine sending the payload: a slow
+// hook delays the completion of the flush and holds up one of the concurrent flushes
+// allowed, so it should return quickly.
+func WithFlushHook(fn func(FlushStats)) StartOption {
+	return func(c *config) {
+		c.flushHook = fn
+	}
+}
+
+// WithDropHook sets a function which is called whenever a finished trace is dropped
+// before being sent, with the reason of the drop and the number of spans dropped, e.g.
+// to fall back to another way of reporting it. It is called for traces dropped before
+// being buffered, and for buffered traces evicted to stay within the memory budget set
+// using WithMaxMemory. The reason is that of the "reason" tag of the
+// datadog.tracer.traces_dropped metric: "encoding_error", "trace_too_large",
+// "backpressure", "memory_limit", "invalid_utf8", "filtered", "invalid_id", "paused" or
+// "empty_resource". Traces lost along with a payload which could not be sent, reported
+// with the reasons "send_failed", "send_timeout", "circuit_open" or "stop_timeout", are
+// not passed to the hook. The hook is called synchronously from the goroutine dropping
+// the trace, which is either the one finishing a span or the tracer's worker, so it
+// should return quickly. By default, dropped traces are only reported through logs and
+// the datadog.tracer.traces_dropped metric.
+func WithDropHook(fn func(reason string, spans int)) StartOption {
+	return func(c *config) {
+		c.dropHook = fn
+	}
+}
+
+// WithSamplingRatesHook sets a function which is called with the sampling rates
+// returned by the agent whenever they are received, e.g. to find out why traces
+// from a service are not sampled. The rates are keyed by "service:<service>,env:<env>",
+// the default rate having the key "service:,env:". The hook is called from the
+// goroutine sending the payload, so it should return quickly.
+func WithSamplingRatesHook(fn func(rates map[string]float64)) StartOption {
+	return func(c *config) {
+		c.samplingRatesHook = fn
+	}
+}
+
+// defaultSendTimeout specifies the default maximum duration of an attempt at sending
+// a payload.
+const defaultSendTimeout = 5 * time.Second
+
+// WithSendTimeout sets the maximum duration of an attempt at sending a payload to the
+// agent, after which the attempt is aborted. This ensures that an agent which stops
+// responding can not hold up flushes indefinitely, even with an HTTP client having no
+// timeout. Payloads whose send timed out are not retried, and their traces are
+// reported as dropped with the reason "send_timeout". It defaults to 5 seconds.
+func WithSendTimeout(d time.Duration) StartOption {
+	return func(c *config) {
+		if d <= 0 {
+			log.Warn("ignoring invalid send timeout %s, must be positive", d)
+			return
+		}
+		c.sendTimeout = d
+	}
+}
+
+// defaultStopTimeout specifies the default time Stop waits for buffered traces to be sent.
+const defaultStopTimeout = 5 * time.Second
+
+// WithStopTimeout sets the maximum time Stop waits for buffered traces to be sent to
+// the agent. Sends still in progress after that are abandoned and their traces are
+// reported as dropped, so that an unresponsive agent can not keep the process from
+// exiting. The default is 5 seconds.
+func WithStopTimeout(d time.Duration) StartOption {
+	return func(c *config) {
+		if d <= 0 {
+			log.Warn("ignoring invalid stop timeout %s, must be positive", d)
+			return
+		}
+		c.stopTimeout = d
+	}
+}
+
+// WithMaxMemory sets a budget in bytes for the traces held by the tracer, whether
+// buffered or being sent to the agent. Once it is used up, new traces are dropped
+// until enough data has been sent, and reported in datadog.tracer.traces_dropped
+// with the reason "memory_limit" and a tag holding their sampling priority. When
+// buffered traces have a lower sampling priority than a new trace, or the same one
+// without errors while the new trace has some, they are dropped instead to make
+// room for it, lowest priority first. Since a trace is only dropped once the budget
+// is used up, the budget may be exceeded by the size of one trace. Unlike with
+// WithBackpressure, the goroutine finishing the trace is never blocked. By default,
+// there is no budget.
+func WithMaxMemory(bytes int) StartOption {
+	return func(c *config) {
+		if bytes <= 0 {
+			log.Warn("ignoring invalid memory budget %d, must be positive", bytes)
+			return
+		}
+		c.maxMemory = bytes
+	}
+}
+
+// WithMinFlushSize makes scheduled flushes skip sending while the buffered traces
+// amount to less than size bytes, so that services producing many small traces
+// send fewer, larger payloads. Traces are held back for at most maxHold: the first
+// scheduled flush after that sends them regardless of their size. Flushes caused
+// by the payload size limit, Flush or Stop are not affected. By default, scheduled
+// flushes send any buffered traces.
+func WithMinFlushSize(size int, maxHold time.Duration) StartOption {
+	return func(c *config) {
+		if size <= 0 || maxHold <= 0 {
+			log.Warn("ignoring invalid minimum flush size %d with maximum hold %s, both must be positive", size, maxHold)
+			return
+		}
+		c.minFlushSize = size
+		c.maxFlushHold = maxHold
+	}
+}
+
+// minMaxTraceAge is the lower bound of WithMaxTraceAge.
+const minMaxTraceAge = 10 * time.Millisecond
+
+// WithMaxTraceAge makes the tracer flush the buffered traces once the oldest of them
+// has been buffered for d, even if the flush interval has not elapsed, bounding the
+// latency with which traces reach the agent when flushes are infrequent. The age is
+// checked when traces are added and every quarter of d, so that traces may be held
+// for up to a quarter of d longer. Such flushes are reported with the reason "age".
+// Durations below 10ms are ignored. By default, traces are only flushed at the flush
+// interval or once the payload size limit is reached.
+func WithMaxTraceAge(d time.Duration) StartOption {
+	return func(c *config) {
+		if d < minMaxTraceAge {
+			log.Warn("ignoring invalid maximum trace age %s, must be at least %s", d, minMaxTraceAge)
+			return
+		}
+		c.maxTraceAge = d
+	}
+}
+
+// WithPayloadPerService makes the tracer buffer the traces of each service in a
+// separate payload, so that every payload sent to the agent holds traces of a
+// single service. A trace belongs to the service of its first span. Each payload
+// is flushed on its own once it reaches the size limit, and flush metrics are
+// tagged with its service. Scheduled flushes, Flush and Stop send all payloads.
+func WithPayloadPerService() StartOption {
+	return func(c *config) {
+		c.payloadPerService = true
+	}
+}
+
+// WithEndpointSelector sets a function which chooses the URL each payload is sent to,
+// e.g. to shard trace ingestion across several collectors by service. It is called once
+// per payload when it is flushed, and the URL chosen is kept when the payload is retried.
+// An empty URL sends the payload to the configured agent.
+func WithEndpointSelector(fn func(PayloadMeta) string) StartOption {
+	return func(c *config) {
+		c.endpointSelector = fn
+	}
+}
+
+// WithConnectionWarmup makes the tracer connect to the agent as soon as it starts,
+// by requesting the agent's /info endpoint in the background, so that the first
+// flush does not pay for establishing the connection. A failure to connect is
+// logged and does not prevent the tracer from starting.
+func WithConnectionWarmup() StartOption {
+	return func(c *config) {
+		c.connectionWarmup = true
+	}
+}
+
+// defaultRetryBufferSize specifies the default maximum size of the retry buffer.
+const defaultRetryBufferSize = 10 * 1024 * 1024 // 10 MB
+
+// WithRetryBuffer enables holding payloads which failed to be sent to the agent in
+// memory, to be sent again after the next successful flush. The buffer holds at most
+// size bytes of payloads, evicting the oldest ones when full. A size of zero or less
+// uses the default of 10MB. Buffered payloads are given a final attempt when the
+// tracer stops.
+func WithRetryBuffer(size int) StartOption {
+	return func(c *config) {
+		if size <= 0 {
+			size = defaultRetryBufferSize
+		}
+		c.retryBufferSize = size
+	}
+}
+
+// WithCircuitBreaker stops the tracer from sending payloads to the agent after the
+// given number of consecutive failed sends, so that no time is spent sending to an
+// agent which is known to be down. Payloads flushed in the following cooldown are
+// dropped and reported with the reason "circuit_open". Once the cooldown elapses,
+// a single payload is sent to probe the agent: sends resume if it succeeds, or are
+// paused for another cooldown otherwise. By default, every flush is sent.
+func WithCircuitBreaker(failures int, cooldown time.Duration) StartOption {
+	return func(c *config) {
+		if failures <= 0 || cooldown <= 0 {
+			log.Warn("ignoring invalid circuit breaker of %d failures with cooldown %s, both must be positive", failures, cooldown)
+			return
+		}
+		c.breakerFailures = failures
+		c.breakerCooldown = cooldown
+	}
+}
+
+// BackpressurePolicy specifies how finished traces are handled while the amount of
+// data waiting to be sent to the agent exceeds the high-water mark set using
+// WithBackpressure.
+type BackpressurePolicy int
+
+const (
+	// BackpressureBlock blocks the goroutine finishing the trace until enough data
+	// has been sent to the agent. The trace is dropped if this takes longer than
+	// the timeout given to WithBackpressure.
+	BackpressureBlock BackpressurePolicy = iota
+
+	// BackpressureDropNewest drops the trace.
+	BackpressureDropNewest
+)
+
+// String returns the value used in the "policy" tag of the backpressure metric.
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case BackpressureBlock:
+		return "block"
+	case BackpressureDropNewest:
+		return "drop_newest"
+	default:
+		return "unknown"
+	}
+}
+
+// defaultBackpressureTimeout specifies the default timeout of BackpressureBlock.
+const defaultBackpressureTimeout = time.Second
+
+// WithBackpressure bounds the amount of data held by the tracer while it waits to
+// be sent to the agent. Once the traces buffered and in flight exceed highWater
+// bytes, finished traces are handled according to policy until enough data has
+// been sent. The timeout applies to BackpressureBlock; a timeout of zero or less
+// uses the default of 1 second. By default, backpressure is disabled.
+func WithBackpressure(highWater int, policy BackpressurePolicy, timeout time.Duration) StartOption {
+	return func(c *config) {
+		if highWater <= 0 {
+			log.Warn("ignoring invalid backpressure high-water mark %d, must be positive", highWater)
+			return
+		}
+		if timeout <= 0 {
+			timeout = defaultBackpressureTimeout
+		}
+		c.backpressureBytes = highWater
+		c.backpressurePolicy = policy
+		c.backpressureTimeout = timeout
+	}
+}
+
+// InvalidUTF8Policy specifies how spans having string fields which are not valid
+// UTF-8 are handled when validation is enabled using WithValidateUTF8.
+type InvalidUTF8Policy int
+
+const (
+	// InvalidUTF8Sanitize replaces each invalid byte with the Unicode replacement
+	// character U+FFFD.
+	InvalidUTF8Sanitize InvalidUTF8Policy = iota
+
+	// InvalidUTF8Drop drops the span.
+	InvalidUTF8Drop
+)
+
+// String returns the value used in the "policy" tag of the invalid_utf8 metric.
+func (p InvalidUTF8Policy) String() string {
+	switch p {
+	case InvalidUTF8Sanitize:
+		return "sanitize"
+	case InvalidUTF8Drop:
+		return "drop"
+	default:
+		return "unknown"
+	}
+}
+
+// WithValidateUTF8 makes the tracer check that the names, services, resources, types
+// and tags of spans are valid UTF-8 before sending them, as strings which are not
+// may cause the agent to reject the payload. Spans failing the check are handled
+// according to policy and counted in the datadog.tracer.invalid_utf8 metric. Traces
+// left without spans are dropped with the reason "invalid_utf8". Validation is
+// disabled by default, as it has a cost for every span.
+func WithValidateUTF8(policy InvalidUTF8Policy) StartOption {
+	return func(c *config) {
+		c.validateUTF8 = true
+		c.invalidUTF8Policy = policy
+	}
+}
+
+// EmptyResourcePolicy specifies how spans with an empty resource name are handled,
+// as set using WithEmptyResourcePolicy.
+type EmptyResourcePolicy int
+
+const (
+	// EmptyResourceKeep sends the span unchanged. It is the default.
+	EmptyResourceKeep EmptyResourcePolicy = iota
+
+	// EmptyResourceDrop drops the span.
+	EmptyResourceDrop
+
+	// EmptyResourceBackfill sets the resource name of the span to its operation name.
+	EmptyResourceBackfill
+)
+
+// String returns the value used in the "policy" tag of the empty_resource metric.
+func (p EmptyResourcePolicy) String() string {
+	switch p {
+	case EmptyResourceKeep:
+		return "keep"
+	case EmptyResourceDrop:
+		return "drop"
+	case EmptyResourceBackfill:
+		return "backfill"
+	default:
+		return "unknown"
+	}
+}
+
+// WithEmptyResourcePolicy sets how the tracer handles spans with an empty resource
+// name, which group poorly in the UI and often reveal instrumentation bugs, e.g. as
+// a guardrail while rolling out instrumentation. Such spans are counted in the
+// datadog.tracer.empty_resource metric. Traces left without spans are dropped with
+// the reason "empty_resource". By default, such spans are sent unchanged.
+func WithEmptyResourcePolicy(policy EmptyResourcePolicy) StartOption {
+	return func(c *config) {
+		c.emptyResourcePolicy = policy
+	}
+}
+
+// WithDeliveryTracking makes the tracer number the traces it buffers and track their
+// acknowledgment by the agent, e.g. to confirm the delivery of audit-critical traces
+// with at-least-once semantics. The progress is reported by DeliveryWatermarks. By
+// default, deliveries are not tracked.
+func WithDeliveryTracking() StartOption {
+	return func(c *config) {
+		c.trackDelivery = true
+	}
+}
+
+// WithInvalidIDPassthrough makes the tracer send the traces having spans with a zero
+// trace or span ID, e.g. to debug the instrumentation creating them. By default, such
+// traces are dropped with the reason "invalid_id", as the agent cannot associate them.
+func WithInvalidIDPassthrough() StartOption {
+	return func(c *config) {
+		c.passInvalidIDs = true
+	}
+}
+
+// WithSpanRedactor sets a function which is called with every finished span before it
+// is written, e.g. to remove personal data or secrets from its tags. Changes made by fn
+// to the name, service, resource, type and tags of the span are applied to it. The
+// redactor runs before the span filter, if any. It is called from a single goroutine
+// for every span, so it should be fast; it also has the cost of copying the tags of
+// every span.
+func WithSpanRedactor(fn func(span *SpanData)) StartOption {
+	return func(c *config) {
+		c.spanRedactor = fn
+	}
+}
+
+// WithSpanFilter sets a function which is called with every finished span before it is
+// written, after the span redactor, if any, and before the tag limits and UTF-8
+// validation apply. Spans for which fn returns false are not sent. Traces left without
+// spans are dropped with the reason "filtered". The filter is called from a single
+// goroutine for every span, so it should be fast. Each span is also copied into the
+// SpanData passed to fn, allocating two maps holding its tags, even when fn keeps it;
+// the copy is shared with the span redactor when both are set.
+func WithSpanFilter(fn func(span *SpanData) bool) StartOption {
+	return func(c *config) {
+		c.spanFilter = fn
+	}
+}
+
+// WithSpanDedup makes the tracer skip the spans whose ID was already added since the
+// last flush, such as the duplicates emitted by some instrumentations which retry
+// operations, so that they are not sent twice. To bound memory usage, only the IDs of
+// the first size spans added since the last flush are remembered. Skipped spans are
+// counted in the datadog.tracer.dedup_skipped metric. By default, spans are not
+// deduplicated.
+func WithSpanDedup(size int) StartOption {
+	return func(c *config) {
+		if size <= 0 {
+			log.Warn("ignoring invalid span deduplication size %d, must be positive", size)
+			return
+		}
+		c.dedupSize = size
+	}
+}
+
 // StartSpanOption is a configuration option for StartSpan. It is aliased in order
 // to help godoc group all the functions returning it together. It is considered
 // more correct to refer to it as the type as the origin, ddtrace.StartSpanOption.
@@ -439,6 +1329,14 @@ func ChildOf(ctx ddtrace.SpanContext) StartSpanOption {
 	}
 }
 
+// WithSpanLinks sets the given links on the created span. Links reference spans
+// which are related to the created span, without being its parent.
+func WithSpanLinks(links []ddtrace.SpanLink) StartSpanOption {
+	return func(cfg *ddtrace.StartSpanConfig) {
+		cfg.SpanLinks = append(cfg.SpanLinks, links...)
+	}
+}
+
 // StartTime sets a custom time as the start time for the created span. By
 // default a span is started using the creation time.
 func StartTime(t time.Time) StartSpanOption {
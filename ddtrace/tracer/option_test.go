@@ -9,6 +9,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -23,6 +24,12 @@ func withTransport(t transport) StartOption {
 	}
 }
 
+func withEncoder(enc encoder) StartOption {
+	return func(c *config) {
+		c.encoder = enc
+	}
+}
+
 func withTickChan(ch <-chan time.Time) StartOption {
 	return func(c *config) {
 		c.tickChan = ch
@@ -37,6 +44,7 @@ func TestTracerOptionsDefaults(t *testing.T) {
 		assert.Equal("tracer.test", c.serviceName)
 		assert.Equal("localhost:8126", c.agentAddr)
 		assert.Equal("localhost:8125", c.dogstatsdAddr)
+		assert.True(c.ownStatsd)
 		assert.Nil(nil, c.httpClient)
 	})
 
@@ -164,6 +172,68 @@ func TestTracerOptionsDefaults(t *testing.T) {
 	})
 }
 
+func TestWithTraceAPIVersion(t *testing.T) {
+	c := newConfig(WithTraceAPIVersion("v0.3"))
+	assert.True(t, strings.HasSuffix(c.transport.endpoint(), "/v0.3/traces"))
+
+	c = newConfig(WithTraceAPIVersion("v0.6")) // unsupported
+	assert.Equal(t, "", c.traceAPIVersion)
+	assert.True(t, strings.HasSuffix(c.transport.endpoint(), "/v0.4/traces"))
+}
+
+func TestFlushLimitsConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		c := newConfig()
+		assert.Equal(t, int(payloadSizeLimit), c.payloadSizeLimit)
+		assert.Equal(t, concurrentConnectionLimit, c.maxConcurrentFlushes)
+		assert.Equal(t, flushInterval, c.flushInterval)
+		assert.Equal(t, defaultStopTimeout, c.stopTimeout)
+	})
+
+	t.Run("options", func(t *testing.T) {
+		c := newConfig(
+			WithPayloadSizeLimit(1024),
+			WithMaxConcurrentFlushes(5),
+			WithFlushInterval(time.Minute),
+			WithStopTimeout(time.Second),
+			WithMinFlushSize(512, time.Second),
+			WithFlushJitter(time.Second),
+		)
+		assert.Equal(t, 1024, c.payloadSizeLimit)
+		assert.Equal(t, 5, c.maxConcurrentFlushes)
+		assert.Equal(t, time.Minute, c.flushInterval)
+		assert.Equal(t, time.Second, c.stopTimeout)
+		assert.Equal(t, 512, c.minFlushSize)
+		assert.Equal(t, time.Second, c.maxFlushHold)
+		assert.Equal(t, time.Second, c.flushJitter)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		c := newConfig(
+			WithPayloadSizeLimit(0),
+			WithMaxConcurrentFlushes(-1),
+			WithFlushInterval(-time.Second),
+			WithStopTimeout(0),
+			WithMinFlushSize(512, 0),
+			WithFlushJitter(-time.Second),
+			WithMaxTraceAge(3*time.Nanosecond),
+		)
+		assert.Equal(t, int(payloadSizeLimit), c.payloadSizeLimit)
+		assert.Equal(t, concurrentConnectionLimit, c.maxConcurrentFlushes)
+		assert.Equal(t, flushInterval, c.flushInterval)
+		assert.Equal(t, defaultStopTimeout, c.stopTimeout)
+		assert.Equal(t, 0, c.minFlushSize)
+		assert.Equal(t, time.Duration(0), c.flushJitter)
+		assert.Equal(t, time.Duration(0), c.maxTraceAge)
+	})
+
+	t.Run("clamped", func(t *testing.T) {
+		c := newConfig(WithPayloadSizeLimit(1<<30), WithMaxConcurrentFlushes(1<<20))
+		assert.Equal(t, int(payloadMaxLimit), c.payloadSizeLimit)
+		assert.Equal(t, maxConcurrentFlushesLimit, c.maxConcurrentFlushes)
+	})
+}
+
 func TestServiceName(t *testing.T) {
 	t.Run("WithServiceName", func(t *testing.T) {
 		defer globalconfig.SetServiceName("")
@@ -7,8 +7,12 @@ package tracer
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
 	"sync/atomic"
 
 	"github.com/tinylib/msgp/msgp"
@@ -22,7 +26,9 @@ import (
 // https://github.com/msgpack/msgpack/blob/master/spec.md#array-format-family
 //
 // payload implements io.Reader and can be used with the decoder directly. To create
-// a new payload use the newPayload method.
+// a new payload use the newPayload method. Payloads using an encoder other than
+// msgpack, created with newEncoderPayload, hold the plain sequence of encoded traces
+// without an array header.
 //
 // payload is not safe for concurrent use.
 //
@@ -30,9 +36,25 @@ import (
 // in order to always have knowledge of the payload size, but also making it possible
 // for the agent to decode it as an array.
 type payload struct {
+	// id identifies the payload in the requests sending it to the agent, so that
+	// failed sends can be correlated with the agent's logs.
+	id string
+
+	// service holds the service of the traces in the payload when payloads are
+	// segregated by service (see WithPayloadPerService). It is empty otherwise.
+	service string
+
+	// target holds the URL to send the payload to, as chosen by the selector set
+	// using WithEndpointSelector. It is empty when the payload goes to the agent.
+	target string
+
+	// enc encodes the items pushed into the stream.
+	enc encoder
+
 	// header specifies the first few bytes in the msgpack stream
 	// indicating the type of array (fixarray, array16 or array32)
-	// and the number of items contained in the stream.
+	// and the number of items contained in the stream. It is empty
+	// when the encoder is not msgpack.
 	header []byte
 
 	// off specifies the current read position on the header.
@@ -41,51 +63,222 @@ type payload struct {
 	// count specifies the number of items in the stream.
 	count uint64
 
+	// spans specifies the total number of spans in the items of the stream.
+	spans int
+
 	// buf holds the sequence of msgpack-encoded items.
 	buf bytes.Buffer
 
+	// grows counts the times buf had to grow its capacity to fit a pushed item.
+	grows int
+
+	// traces holds the items pushed into the stream, so that they can be
+	// drained without decoding buf. It is cleared once the payload is sent.
+	traces []spanList
+
+	// sizes holds the encoded size of each item in traces.
+	sizes []int
+
+	// seqs holds the numbers of the items in traces when delivery tracking is
+	// enabled using WithDeliveryTracking. Unlike traces, it is kept until the
+	// payload is sent, so that the items can be acknowledged.
+	seqs []uint64
+
+	// deliveries holds the channels reporting the delivery of the traces in the
+	// stream which were marked using FlushTrace.
+	deliveries []chan<- bool
+
+	// roff specifies the current read position in buf.
+	roff int
+
 	// closed specifies the notification channel for each Close call.
 	closed chan struct{}
+
+	// gz holds the gzip-compressed contents of the stream once compress has
+	// been called. While set, reads and size operate on it instead.
+	gz *bytes.Reader
 }
 
 var _ io.Reader = (*payload)(nil)
 
-// newPayload returns a ready to use payload.
+// newPayload returns a ready to use msgpack payload.
 func newPayload() *payload {
+	return newEncoderPayload(msgpackEncoder{})
+}
+
+// newEncoderPayload returns a ready to use payload which encodes its items using enc.
+func newEncoderPayload(enc encoder) *payload {
 	p := &payload{
-		header: make([]byte, 8),
-		off:    8,
+		id:     fmt.Sprintf("%016x", random.Uint64()),
+		enc:    enc,
 		closed: make(chan struct{}, 1),
 	}
+	if _, ok := enc.(msgpackEncoder); ok {
+		p.header = make([]byte, 8)
+		p.off = 8
+	}
 	return p
 }
 
-// push pushes a new item into the stream.
+// errPayloadItems is the cause of the *encodeError returned when pushing an item
+// into a payload holding the maximum number of items.
+var errPayloadItems = errors.New("payload holds the maximum number of traces")
+
+// push pushes a new item into the stream. If the item fails to encode, the stream
+// is left as it was, so that the items pushed previously can still be sent.
 func (p *payload) push(t spanList) error {
-	if err := msgp.Encode(&p.buf, t); err != nil {
+	b, err := p.encode(t)
+	if err != nil {
 		return err
 	}
+	p.pushEncoded(t, b)
+	return nil
+}
+
+// encode returns the item t encoded by the payload's encoder, ready to be passed to
+// pushEncoded. Failures are returned as an *encodeError.
+func (p *payload) encode(t spanList) ([]byte, error) {
+	if atomic.LoadUint64(&p.count) >= 1<<32-1 {
+		// the array header can't hold more items
+		return nil, &encodeError{cause: encodeCauseOverflow, err: errPayloadItems}
+	}
+	b, err := p.enc.encode(t)
+	if err != nil {
+		return nil, newEncodeError(err)
+	}
+	return b, nil
+}
+
+// pushEncoded pushes the item t, encoded as b by the payload's encoder, into the stream.
+func (p *payload) pushEncoded(t spanList, b []byte) {
+	if p.buf.Len()+len(b) > p.buf.Cap() {
+		p.grows++
+	}
+	p.buf.Write(b)
+	p.traces = append(p.traces, t)
+	p.sizes = append(p.sizes, len(b))
+	p.spans += len(t)
 	atomic.AddUint64(&p.count, 1)
 	p.updateHeader()
-	return nil
 }
 
+// remove removes the i-th item pushed into the stream. It must not be called once
+// the payload has been read or compressed.
+func (p *payload) remove(i int) {
+	var off int
+	for _, n := range p.sizes[:i] {
+		off += n
+	}
+	b := p.buf.Bytes()
+	n := copy(b[off:], b[off+p.sizes[i]:])
+	p.buf.Truncate(off + n)
+	p.spans -= len(p.traces[i])
+	p.traces = append(p.traces[:i], p.traces[i+1:]...)
+	p.sizes = append(p.sizes[:i], p.sizes[i+1:]...)
+	if len(p.seqs) > i {
+		p.seqs = append(p.seqs[:i], p.seqs[i+1:]...)
+	}
+	atomic.AddUint64(&p.count, ^uint64(0))
+	if p.itemCount() > 0 {
+		p.updateHeader()
+	} else {
+		p.off = len(p.header)
+	}
+}
+
+// contentType returns the media type of the stream, prior to any compression.
+func (p *payload) contentType() string { return p.enc.contentType() }
+
 // itemCount returns the number of items available in the srteam.
 func (p *payload) itemCount() int {
 	return int(atomic.LoadUint64(&p.count))
 }
 
 // size returns the payload size in bytes. After the first read the value becomes
-// inaccurate by up to 8 bytes.
+// inaccurate by up to 8 bytes. If the payload is compressed, the size of the
+// compressed stream is returned.
 func (p *payload) size() int {
-	return p.buf.Len() + len(p.header) - p.off
+	if p.gz != nil {
+		return int(p.gz.Size())
+	}
+	return p.buf.Len() - p.roff + len(p.header) - p.off
+}
+
+// sizeWith returns an upper bound of the size the payload would have in bytes,
+// after pushing an item of n encoded bytes into it.
+func (p *payload) sizeWith(n int) int {
+	return p.buf.Len() - p.roff + n + len(p.header)
+}
+
+// compress gzip-compresses the stream. Subsequent reads return the compressed
+// contents. The original contents are retained so that the payload may still
+// be sent uncompressed after calling decompress.
+func (p *payload) compress() error {
+	b, err := gzipBytes(p.header[p.off:], p.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	p.gz = bytes.NewReader(b)
+	return nil
 }
 
+// gzipBytes returns the gzip-compressed concatenation of parts.
+func gzipBytes(parts ...[]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	for _, b := range parts {
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpack reports whether the payload uses the default msgpack encoder.
+func (p *payload) msgpack() bool { return len(p.header) > 0 }
+
+// encodeV05 returns the items of a msgpack payload encoded using the v0.5 schema
+// of the agent's trace API (see encodeV05), compressed if the payload is. The items
+// are decoded from the stream, which is left untouched.
+func (p *payload) encodeV05() ([]byte, error) {
+	traces := make(spanLists, p.itemCount())
+	r := msgp.NewReader(bytes.NewReader(p.buf.Bytes()))
+	for i := range traces {
+		if err := traces[i].DecodeMsg(r); err != nil {
+			return nil, err
+		}
+	}
+	b := encodeV05(traces)
+	if p.compressed() {
+		return gzipBytes(b)
+	}
+	return b, nil
+}
+
+// decompress reverts the effects of compress, making subsequent reads
+// return the original stream.
+func (p *payload) decompress() { p.gz = nil }
+
+// compressed reports whether the payload is currently compressed.
+func (p *payload) compressed() bool { return p.gz != nil }
+
 // reset resets the internal buffer, counter and read offset.
 func (p *payload) reset() {
-	p.off = 8
+	p.off = len(p.header)
+	p.roff = 0
 	atomic.StoreUint64(&p.count, 0)
+	p.spans = 0
 	p.buf.Reset()
+	p.grows = 0
+	p.traces = nil
+	p.sizes = nil
+	p.deliveries = nil
+	p.seqs = nil
+	p.target = ""
+	p.gz = nil
 	select {
 	case <-p.closed:
 		// ensure there is room
@@ -100,9 +293,26 @@ const (
 	msgpackArray32       = 0xdd // up to 2^32-1 items, followed by size in 4 bytes
 )
 
+// rewind moves the read position back to the start of the stream, allowing
+// the payload to be read again, e.g. when retrying a failed send.
+func (p *payload) rewind() {
+	p.roff = 0
+	if p.gz != nil {
+		p.gz.Seek(0, io.SeekStart)
+	}
+	if p.itemCount() > 0 {
+		p.updateHeader()
+	} else {
+		p.off = len(p.header)
+	}
+}
+
 // updateHeader updates the payload header based on the number of items currently
-// present in the stream.
+// present in the stream. It has no effect on payloads without a header.
 func (p *payload) updateHeader() {
+	if len(p.header) == 0 {
+		return
+	}
 	n := atomic.LoadUint64(&p.count)
 	switch {
 	case n <= 15:
@@ -135,11 +345,108 @@ func (p *payload) waitClose() { <-p.closed }
 
 // Read implements io.Reader. It reads from the msgpack-encoded stream.
 func (p *payload) Read(b []byte) (n int, err error) {
+	if p.gz != nil {
+		return p.gz.Read(b)
+	}
 	if p.off < len(p.header) {
 		// reading header
 		n = copy(b, p.header[p.off:])
 		p.off += n
 		return n, nil
 	}
-	return p.buf.Read(b)
+	if p.roff >= p.buf.Len() {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n = copy(b, p.buf.Bytes()[p.roff:])
+	p.roff += n
+	return n, nil
+}
+
+// payloadSizer estimates the capacity to allocate up front for new payloads from
+// an exponentially weighted moving average of the size of the payloads flushed
+// recently, so that most payloads never need to grow their buffer. It is not safe
+// for concurrent use.
+type payloadSizer struct {
+	avg float64 // moving average of the payload sizes, in bytes
+	max int     // maximum capacity to allocate
+}
+
+// observe records the flush of a payload holding size bytes.
+func (s *payloadSizer) observe(size int) {
+	if s.avg == 0 {
+		s.avg = float64(size)
+	} else {
+		s.avg = (4*s.avg + float64(size)) / 5
+	}
+}
+
+// capacity returns the capacity in bytes to allocate for a new payload: the average
+// size observed with a quarter of headroom, up to the maximum.
+func (s *payloadSizer) capacity() int {
+	n := int(s.avg * 5 / 4)
+	if n > s.max {
+		n = s.max
+	}
+	return n
+}
+
+// payloadQueue is a FIFO queue of payloads bounded by their total size in bytes.
+// When adding a payload would exceed the bound, the oldest payloads are evicted.
+// It is safe for concurrent use. A nil *payloadQueue is empty.
+type payloadQueue struct {
+	mu       sync.Mutex
+	payloads []*payload
+	size     int // total size of the queued payloads
+	max      int // maximum total size
+}
+
+// newPayloadQueue returns a queue holding at most max bytes of payloads.
+func newPayloadQueue(max int) *payloadQueue {
+	return &payloadQueue{max: max}
+}
+
+// push adds p to the queue and returns any payloads which were evicted as a
+// result. If p alone exceeds the maximum size, p itself is returned.
+func (q *payloadQueue) push(p *payload) (evicted []*payload) {
+	size := p.size()
+	if size > q.max {
+		return []*payload{p}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.size+size > q.max {
+		evicted = append(evicted, q.payloads[0])
+		q.size -= q.payloads[0].size()
+		q.payloads[0] = nil
+		q.payloads = q.payloads[1:]
+	}
+	q.payloads = append(q.payloads, p)
+	q.size += size
+	return evicted
+}
+
+// popAll removes all payloads from the queue and returns them, oldest first.
+func (q *payloadQueue) popAll() []*payload {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	all := q.payloads
+	q.payloads = nil
+	q.size = 0
+	return all
+}
+
+// len returns the number of payloads in the queue.
+func (q *payloadQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.payloads)
 }
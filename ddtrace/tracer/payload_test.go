@@ -7,6 +7,9 @@ package tracer
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
 	"io/ioutil"
 	"strconv"
 	"strings"
@@ -75,6 +78,197 @@ func TestPayloadDecode(t *testing.T) {
 	}
 }
 
+// failingEncoder is a msgpack encoder which fails on the nth call to encode,
+// returning the first half of the encoded trace along with the error.
+type failingEncoder struct {
+	msgpackEncoder
+	n int
+}
+
+func (e *failingEncoder) encode(trace []*span) ([]byte, error) {
+	b, err := e.msgpackEncoder.encode(trace)
+	if e.n--; e.n == 0 {
+		return b[:len(b)/2], errors.New("encoding failed")
+	}
+	return b, err
+}
+
+// TestPayloadPushError ensures that a trace which fails to encode leaves the
+// traces pushed previously intact.
+func TestPayloadPushError(t *testing.T) {
+	assert := assert.New(t)
+	p := newEncoderPayload(&failingEncoder{n: 3})
+	for i := 0; i < 2; i++ {
+		assert.NoError(p.push(newSpanList(i + 1)))
+	}
+	size := p.size()
+	assert.Error(p.push(newSpanList(3)))
+	assert.Equal(size, p.size())
+	assert.Equal(2, p.itemCount())
+	assert.NoError(p.push(newSpanList(4)))
+
+	r := msgp.NewReader(p)
+	for _, n := range []int{1, 2, 4} {
+		var got spanList
+		assert.NoError(got.DecodeMsg(r))
+		assert.Len(got, n)
+	}
+	_, err := r.NextType()
+	assert.Equal(io.EOF, err)
+}
+
+// TestPayloadCompress ensures that a compressed payload decompresses to the
+// original stream and that it can be reverted to the uncompressed stream.
+func TestPayloadCompress(t *testing.T) {
+	assert := assert.New(t)
+	p := newPayload()
+	for i := 0; i < 100; i++ {
+		p.push(newSpanList(i%5 + 1))
+	}
+	want := append(append([]byte{}, p.header[p.off:]...), p.buf.Bytes()...)
+	size := p.size()
+
+	assert.NoError(p.compress())
+	assert.True(p.compressed())
+	assert.True(p.size() < size)
+	r, err := gzip.NewReader(p)
+	assert.NoError(err)
+	got, err := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(want, got)
+
+	p.decompress()
+	assert.False(p.compressed())
+	assert.Equal(size, p.size())
+	got, err = ioutil.ReadAll(p)
+	assert.NoError(err)
+	assert.Equal(want, got)
+}
+
+// TestPayloadRewind ensures that a payload can be read again after rewinding.
+func TestPayloadRewind(t *testing.T) {
+	assert := assert.New(t)
+	p := newPayload()
+	for i := 0; i < 20; i++ {
+		p.push(newSpanList(i%5 + 1))
+	}
+	size := p.size()
+	want, err := ioutil.ReadAll(p)
+	assert.NoError(err)
+	assert.Len(want, size)
+
+	p.rewind()
+	assert.Equal(size, p.size())
+	got, err := ioutil.ReadAll(p)
+	assert.NoError(err)
+	assert.Equal(want, got)
+
+	assert.NoError(p.compress())
+	zipped, err := ioutil.ReadAll(p)
+	assert.NoError(err)
+	p.rewind()
+	got, err = ioutil.ReadAll(p)
+	assert.NoError(err)
+	assert.Equal(zipped, got)
+}
+
+func TestPayloadRemove(t *testing.T) {
+	assert := assert.New(t)
+	var lists spanLists
+	p := newPayload()
+	for i := 0; i < 20; i++ {
+		lists = append(lists, newSpanList(i%5+1))
+		p.push(lists[i])
+	}
+	for _, i := range []int{19, 0, 7, 7} {
+		p.remove(i)
+		lists = append(lists[:i], lists[i+1:]...)
+	}
+	assert.Equal(16, p.itemCount())
+	want := newPayload()
+	for _, l := range lists {
+		want.push(l)
+	}
+	assert.Equal(want.size(), p.size())
+	assert.Equal(want.spans, p.spans)
+	wantb, err := ioutil.ReadAll(want)
+	assert.NoError(err)
+	got, err := ioutil.ReadAll(p)
+	assert.NoError(err)
+	assert.Equal(wantb, got)
+
+	p = newPayload()
+	p.push(newSpanList(1))
+	p.remove(0)
+	assert.Equal(0, p.size())
+}
+
+func TestPayloadQueue(t *testing.T) {
+	assert := assert.New(t)
+	newSized := func(n int) *payload {
+		p := newPayload()
+		p.push(newSpanList(n))
+		return p
+	}
+	p1, p2, p3 := newSized(1), newSized(2), newSized(3)
+	q := newPayloadQueue(p1.size() + p2.size())
+
+	assert.Empty(q.push(p1))
+	assert.Empty(q.push(p2))
+	assert.Equal(2, q.len())
+	// evicts the oldest first
+	assert.Equal([]*payload{p1, p2}, q.push(p3))
+	assert.Equal(1, q.len())
+	// too large on its own
+	big := newSized(10)
+	assert.Equal([]*payload{big}, q.push(big))
+	assert.Equal([]*payload{p3}, q.popAll())
+	assert.Equal(0, q.len())
+	assert.Empty(q.popAll())
+
+	var nilq *payloadQueue
+	assert.Equal(0, nilq.len())
+	assert.Nil(nilq.popAll())
+}
+
+func TestPayloadGrows(t *testing.T) {
+	assert := assert.New(t)
+	p := newPayload()
+	p.push(newSpanList(1))
+	assert.Equal(1, p.grows)
+	size := p.buf.Len()
+
+	p = newPayload()
+	p.buf.Grow(10 * size)
+	for i := 0; i < 10; i++ {
+		p.push(newSpanList(1))
+	}
+	assert.Equal(0, p.grows)
+	p.push(newSpanList(1))
+	assert.Equal(1, p.grows)
+	p.reset()
+	assert.Equal(0, p.grows)
+}
+
+func TestPayloadSizer(t *testing.T) {
+	assert := assert.New(t)
+	s := payloadSizer{max: 1000}
+	assert.Equal(0, s.capacity())
+
+	s.observe(400)
+	assert.Equal(500, s.capacity())
+	s.observe(200)
+	assert.Equal(450, s.capacity())
+	for i := 0; i < 50; i++ {
+		s.observe(200)
+	}
+	assert.Equal(250, s.capacity())
+	for i := 0; i < 50; i++ {
+		s.observe(2000)
+	}
+	assert.Equal(1000, s.capacity())
+}
+
 func BenchmarkPayloadThroughput(b *testing.B) {
 	b.Run("10K", benchmarkPayloadThroughput(1))
 	b.Run("100K", benchmarkPayloadThroughput(10))
@@ -102,3 +296,33 @@ func benchmarkPayloadThroughput(count int) func(*testing.B) {
 		}
 	}
 }
+
+// BenchmarkPayloadPresized benchmarks filling payloads of approximately 1MB, with and
+// without sizing their buffer beforehand as the tracer does.
+func BenchmarkPayloadPresized(b *testing.B) {
+	trace := newSpanList(5)
+	fill := func(p *payload) {
+		for p.size() < 1024*1024 {
+			p.push(trace)
+		}
+	}
+	b.Run("unsized", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			fill(newPayload())
+		}
+	})
+	b.Run("presized", func(b *testing.B) {
+		s := payloadSizer{max: payloadMaxLimit}
+		p := newPayload()
+		fill(p)
+		s.observe(p.buf.Len())
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			p := newPayload()
+			p.buf.Grow(s.capacity())
+			fill(p)
+		}
+	})
+}
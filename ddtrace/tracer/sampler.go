@@ -104,6 +104,7 @@ type prioritySampler struct {
 	mu          sync.RWMutex
 	rates       map[string]float64
 	defaultRate float64
+	received    map[string]float64 // rates as last received from the agent
 }
 
 func newPrioritySampler() *prioritySampler {
@@ -115,24 +116,43 @@ func newPrioritySampler() *prioritySampler {
 
 // readRatesJSON will try to read the rates as JSON from the given io.ReadCloser.
 func (ps *prioritySampler) readRatesJSON(rc io.ReadCloser) error {
+	defer rc.Close()
 	var payload struct {
 		Rates map[string]float64 `json:"rate_by_service"`
 	}
 	if err := json.NewDecoder(rc).Decode(&payload); err != nil {
 		return err
 	}
-	rc.Close()
 	const defaultRateKey = "service:,env:"
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
-	ps.rates = payload.Rates
-	if v, ok := ps.rates[defaultRateKey]; ok {
-		ps.defaultRate = v
-		delete(ps.rates, defaultRateKey)
+	ps.received = payload.Rates
+	ps.rates = make(map[string]float64, len(payload.Rates))
+	for k, v := range payload.Rates {
+		if k == defaultRateKey {
+			ps.defaultRate = v
+			continue
+		}
+		ps.rates[k] = v
 	}
 	return nil
 }
 
+// receivedRates returns a copy of the rates last read by readRatesJSON, keyed by
+// "service:<service>,env:<env>", or nil if none were read yet.
+func (ps *prioritySampler) receivedRates() map[string]float64 {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	if ps.received == nil {
+		return nil
+	}
+	rates := make(map[string]float64, len(ps.received))
+	for k, v := range ps.received {
+		rates[k] = v
+	}
+	return rates
+}
+
 // getRate returns the sampling rate to be used for the given span. Callers must
 // guard the span.
 func (ps *prioritySampler) getRate(spn *span) float64 {
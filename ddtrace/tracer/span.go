@@ -67,11 +67,132 @@ type span struct {
 	ParentID uint64             `msg:"parent_id"`         // identifier of the span's direct parent
 	Error    int32              `msg:"error"`             // error status of the span; 0 means no errors
 
+	SpanLinks  []ddtrace.SpanLink `msg:"span_links,omitempty"`  // links to causally related spans
+	SpanEvents []spanEvent        `msg:"span_events,omitempty"` // timestamped events which occurred during the span
+
+	// TraceIDUpper holds the upper 64 bits of a 128-bit trace ID; it is zero for
+	// 64-bit trace IDs. It is sent to the agent as the keyTraceIDUpper tag.
+	TraceIDUpper uint64 `msg:"-"`
+
+	// Tracestate holds the W3C tracestate of the trace, as propagated by other
+	// vendors; it is empty when none was received. It is sent to the agent as the
+	// keyTracestate tag.
+	Tracestate string `msg:"-"`
+
 	finished bool         `msg:"-"` // true if the span has been submitted to a tracer.
 	context  *spanContext `msg:"-"` // span propagation context
 	taskEnd  func()       // ends execution tracer (runtime/trace) task, if started
 }
 
+// SpanData holds a snapshot of the contents of a finished span. It is passed to
+// the functions set using WithSpanRedactor and WithSpanFilter, and returned by
+// SpanDataOf.
+type SpanData struct {
+	Name     string             // operation name
+	Service  string             // service name
+	Resource string             // resource name
+	Type     string             // protocol associated with the span
+	Start    time.Time          // start time
+	Duration time.Duration      // duration
+	Meta     map[string]string  // string tags
+	Metrics  map[string]float64 // numeric tags
+	SpanID   uint64             // identifier of the span
+	TraceID  uint64             // identifier of the trace
+	ParentID uint64             // identifier of the parent span, or zero for root spans
+	Error    bool               // true if the span has an error
+}
+
+// SpanDataOf returns a snapshot of the contents of s, e.g. a span passed to the
+// function set using WithExportFunc. It returns false if s was not created by this
+// tracer.
+func SpanDataOf(s ddtrace.Span) (SpanData, bool) {
+	sp, ok := s.(*span)
+	if !ok {
+		return SpanData{}, false
+	}
+	return sp.data(), true
+}
+
+// data returns a snapshot of the contents of s.
+func (s *span) data() SpanData {
+	s.RLock()
+	defer s.RUnlock()
+	d := SpanData{
+		Name:     s.Name,
+		Service:  s.Service,
+		Resource: s.Resource,
+		Type:     s.Type,
+		Start:    time.Unix(0, s.Start),
+		Duration: time.Duration(s.Duration),
+		Meta:     make(map[string]string, len(s.Meta)),
+		Metrics:  make(map[string]float64, len(s.Metrics)),
+		SpanID:   s.SpanID,
+		TraceID:  s.TraceID,
+		ParentID: s.ParentID,
+		Error:    s.Error != 0,
+	}
+	for k, v := range s.Meta {
+		d.Meta[k] = v
+	}
+	for k, v := range s.Metrics {
+		d.Metrics[k] = v
+	}
+	return d
+}
+
+// setData sets the name, service, resource, type and tags of s to those in d.
+func (s *span) setData(d *SpanData) {
+	s.Lock()
+	defer s.Unlock()
+	s.Name = d.Name
+	s.Service = d.Service
+	s.Resource = d.Resource
+	s.Type = d.Type
+	s.Meta = d.Meta
+	s.Metrics = d.Metrics
+}
+
+// spanEvent is a named, timestamped event which occurred during the lifetime
+// of a span, such as a log line or an exception.
+type spanEvent struct {
+	Name       string                 `msg:"name"`                 // name of the event
+	Time       int64                  `msg:"time_unix_nano"`       // time of the event expressed in nanoseconds since epoch
+	Attributes map[string]interface{} `msg:"attributes,omitempty"` // attributes describing the event
+}
+
+// AddSpanEvent adds an event with the given name and attributes to s, timestamped
+// with the current time. Attribute values which are not strings, booleans or
+// numbers are converted to strings. It has no effect if s was not created by this
+// tracer or has already finished.
+func AddSpanEvent(s ddtrace.Span, name string, attributes map[string]interface{}) {
+	sp, ok := s.(*span)
+	if !ok {
+		return
+	}
+	e := spanEvent{Name: name, Time: now()}
+	if len(attributes) > 0 {
+		e.Attributes = make(map[string]interface{}, len(attributes))
+		for k, v := range attributes {
+			switch v := v.(type) {
+			case string, bool:
+				e.Attributes[k] = v
+			default:
+				if f, ok := toFloat64(v); ok {
+					e.Attributes[k] = f
+				} else {
+					e.Attributes[k] = fmt.Sprint(v)
+				}
+			}
+		}
+	}
+	sp.Lock()
+	defer sp.Unlock()
+	if sp.finished {
+		return
+	}
+	sp.SpanEvents = append(sp.SpanEvents, e)
+}
+
 // Context yields the SpanContext for this Span. Note that the return
 // value of Context() is still valid after a call to Finish(). This is
 // called the span context and it is different from Go's context.
@@ -378,4 +499,8 @@ const (
 	keyRulesSamplerAppliedRate = "_dd.rule_psr"
 	keyRulesSamplerLimiterRate = "_dd.limit_psr"
 	keyMeasured                = "_dd.measured"
+	keyTraceIDUpper            = "_dd.p.tid"          // upper 64 bits of 128-bit trace IDs, hex-encoded
+	keyTruncatedTags           = "_dd.truncated_tags" // comma-separated keys of the tags truncated to maxTagValueLength
+	keyTagsTruncated           = "_dd.tags_truncated" // number of tags removed to keep at most maxTagsPerSpan
+	keyTracestate              = "_dd.tracestate"     // W3C tracestate of the trace
 )
@@ -6,16 +6,21 @@
 package tracer
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/internal"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
 )
 
 // newSpan creates a new span. This is a low-level function, required for testing and advanced usage.
@@ -36,9 +41,11 @@ func newSpan(name, service, resource string, spanID, traceID, parentID uint64) *
 	return span
 }
 
-// newBasicSpan is the OpenTracing Span constructor
+// newBasicSpan is the OpenTracing Span constructor. It returns a root span with a
+// random ID, as the tracer drops spans with zero IDs.
 func newBasicSpan(operationName string) *span {
-	return newSpan(operationName, "", "", 0, 0, 0)
+	id := random.Uint64()
+	return newSpan(operationName, "", "", id, id, 0)
 }
 
 func TestSpanBaggage(t *testing.T) {
@@ -226,6 +233,132 @@ func TestSpanStart(t *testing.T) {
 	assert.NotEqual(int64(0), span.Start)
 }
 
+func TestSpanLinks(t *testing.T) {
+	links := []ddtrace.SpanLink{
+		{TraceID: 1, SpanID: 2, Attributes: map[string]string{"link.kind": "batch"}},
+		{TraceID: 3, SpanID: 4},
+	}
+	tracer := newTracer(withTransport(newDefaultTransport()))
+	defer tracer.Stop()
+
+	t.Run("round-trip", func(t *testing.T) {
+		assert := assert.New(t)
+		span := tracer.StartSpan("op", WithSpanLinks(links)).(*span)
+		assert.Equal(links, span.SpanLinks)
+
+		p := newPayload()
+		p.push(spanList{span})
+		var got spanLists
+		assert.NoError(msgp.Decode(p, &got))
+		assert.Equal(links, got[0][0].SpanLinks)
+	})
+
+	t.Run("omitted", func(t *testing.T) {
+		assert := assert.New(t)
+		p := newPayload()
+		p.push(spanList{tracer.StartSpan("op").(*span)})
+		raw, err := ioutil.ReadAll(p)
+		assert.NoError(err)
+		assert.False(bytes.Contains(raw, []byte("span_links")))
+
+		p.rewind()
+		var got spanLists
+		assert.NoError(msgp.Decode(p, &got))
+		assert.Nil(got[0][0].SpanLinks)
+	})
+}
+
+func TestSpanDataOf(t *testing.T) {
+	assert := assert.New(t)
+	span := newBasicSpan("op")
+	span.SetTag("key", "value")
+	span.SetTag("num", 1)
+	d, ok := SpanDataOf(span)
+	assert.True(ok)
+	assert.Equal("op", d.Name)
+	assert.Equal(span.SpanID, d.SpanID)
+	assert.Equal("value", d.Meta["key"])
+	assert.Equal(1., d.Metrics["num"])
+
+	_, ok = SpanDataOf(internal.NoopSpan{})
+	assert.False(ok)
+}
+
+func TestSpanEvents(t *testing.T) {
+	tracer := newTracer(withTransport(newDefaultTransport()))
+	defer tracer.Stop()
+
+	t.Run("round-trip", func(t *testing.T) {
+		assert := assert.New(t)
+		span := tracer.StartSpan("op").(*span)
+		AddSpanEvent(span, "retry", map[string]interface{}{
+			"reason":  "timeout",
+			"attempt": 2,
+			"backoff": 1.5,
+			"final":   false,
+			"peer":    struct{ Host string }{"db"},
+		})
+		AddSpanEvent(span, "done", nil)
+		span.Finish()
+		AddSpanEvent(span, "late", nil)
+
+		p := newPayload()
+		p.push(spanList{span})
+		var got spanLists
+		assert.NoError(msgp.Decode(p, &got))
+		events := got[0][0].SpanEvents
+		assert.Len(events, 2)
+		assert.Equal("retry", events[0].Name)
+		assert.Equal(span.SpanEvents[0].Time, events[0].Time)
+		assert.Equal(map[string]interface{}{
+			"reason":  "timeout",
+			"attempt": 2.,
+			"backoff": 1.5,
+			"final":   false,
+			"peer":    "{db}",
+		}, events[0].Attributes)
+		assert.Equal("done", events[1].Name)
+		assert.Nil(events[1].Attributes)
+	})
+
+	t.Run("omitted", func(t *testing.T) {
+		assert := assert.New(t)
+		p := newPayload()
+		p.push(spanList{tracer.StartSpan("op").(*span)})
+		raw, err := ioutil.ReadAll(p)
+		assert.NoError(err)
+		assert.False(bytes.Contains(raw, []byte("span_events")))
+	})
+}
+
+func TestSpanTraceIDUpper(t *testing.T) {
+	tracer := newTracer(withTransport(newDefaultTransport()))
+	defer tracer.Stop()
+	decode := func(s *span) *span {
+		p := newPayload()
+		p.push(spanList{s})
+		var got spanLists
+		assert.NoError(t, msgp.Decode(p, &got))
+		return got[0][0]
+	}
+
+	t.Run("128-bit", func(t *testing.T) {
+		parent := &spanContext{traceID: 2, traceIDUpper: 0x5f8a1b2c00000000, spanID: 3}
+		s := tracer.StartSpan("op", ChildOf(parent)).(*span)
+		got := decode(s)
+		assert.Equal(t, uint64(2), got.TraceID)
+		assert.Equal(t, "5f8a1b2c00000000", got.Meta[keyTraceIDUpper])
+	})
+
+	t.Run("64-bit", func(t *testing.T) {
+		s := tracer.StartSpan("op").(*span)
+		got := decode(s)
+		assert.Equal(t, s.TraceID, got.TraceID)
+		_, ok := got.Meta[keyTraceIDUpper]
+		assert.False(t, ok)
+	})
+}
+
 func TestSpanString(t *testing.T) {
 	assert := assert.New(t)
 	tracer := newTracer(withTransport(newDefaultTransport()))
@@ -367,7 +500,7 @@ func TestSpanModifyWhileFlushing(t *testing.T) {
 		case <-done:
 			return
 		default:
-			tracer.flush()
+			tracer.flush(flushReasonScheduled)
 			time.Sleep(10 * time.Millisecond)
 		}
 	}
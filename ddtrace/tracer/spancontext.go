@@ -29,13 +29,15 @@ type spanContext struct {
 
 	// the below group should propagate cross-process
 
-	traceID uint64
-	spanID  uint64
+	traceID      uint64
+	traceIDUpper uint64 // upper 64 bits of 128-bit trace IDs; zero otherwise
+	spanID       uint64
 
 	mu         sync.RWMutex // guards below fields
 	baggage    map[string]string
 	hasBaggage int32  // atomic int for quick checking presence of baggage. 0 indicates no baggage, otherwise baggage exists.
 	origin     string // e.g. "synthetics"
+	tracestate string // W3C tracestate, e.g. "rojo=00f067aa0ba902b7"
 }
 
 // newSpanContext creates a new SpanContext to serve as context for the given
@@ -45,14 +47,16 @@ type spanContext struct {
 // for the same span.
 func newSpanContext(span *span, parent *spanContext) *spanContext {
 	context := &spanContext{
-		traceID: span.TraceID,
-		spanID:  span.SpanID,
-		span:    span,
+		traceID:      span.TraceID,
+		traceIDUpper: span.TraceIDUpper,
+		spanID:       span.SpanID,
+		span:         span,
 	}
 	if parent != nil {
 		context.trace = parent.trace
 		context.drop = parent.drop
 		context.origin = parent.origin
+		context.tracestate = parent.tracestate
 		parent.ForeachBaggageItem(func(k, v string) bool {
 			context.setBaggageItem(k, v)
 			return true
@@ -196,18 +200,20 @@ func (t *trace) setSamplingPriorityLocked(p float64) {
 // a errBufferFull error.
 func (t *trace) push(sp *span) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
 	if t.full {
+		t.mu.Unlock()
 		return
 	}
 	tr, haveTracer := internal.GetGlobalTracer().(*tracer)
-	if len(t.spans) >= traceMaxSize {
+	if n := len(t.spans); n >= traceMaxSize {
 		// capacity is reached, we will not be able to complete this trace.
 		t.full = true
 		t.spans = nil // GC
+		t.mu.Unlock()
 		log.Error("trace buffer full (%d), dropping trace", traceMaxSize)
 		if haveTracer {
 			atomic.AddInt64(&tr.tracesDropped, 1)
+			tr.notifyDrop(dropReasonTraceTooLarge, n)
 		}
 		return
 	}
@@ -215,6 +221,7 @@ func (t *trace) push(sp *span) {
 		t.setSamplingPriorityLocked(v)
 	}
 	t.spans = append(t.spans, sp)
+	t.mu.Unlock()
 	if haveTracer {
 		atomic.AddInt64(&tr.spansStarted, 1)
 	}
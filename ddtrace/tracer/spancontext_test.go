@@ -321,6 +321,10 @@ func TestSpanContextParent(t *testing.T) {
 			trace:  &trace{spans: []*span{newBasicSpan("abc")}},
 			origin: "synthetics",
 		},
+		"tracestate": &spanContext{
+			trace:      &trace{spans: []*span{newBasicSpan("abc")}},
+			tracestate: "rojo=00f067aa0ba902b7",
+		},
 	} {
 		t.Run(name, func(t *testing.T) {
 			ctx := newSpanContext(s, parentCtx)
@@ -338,6 +342,7 @@ func TestSpanContextParent(t *testing.T) {
 			assert.Equal(parentCtx.drop, ctx.drop)
 			assert.Equal(parentCtx.baggage, ctx.baggage)
 			assert.Equal(parentCtx.origin, ctx.origin)
+			assert.Equal(parentCtx.tracestate, ctx.tracestate)
 		})
 	}
 }
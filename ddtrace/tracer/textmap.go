@@ -6,6 +6,7 @@
 package tracer
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
@@ -89,6 +90,10 @@ const (
 // It is used with the Synthetics product and usually has the value "synthetics".
 const originHeader = "x-datadog-origin"
 
+// tracestateHeader specifies the name of the W3C header carrying vendor-specific
+// trace state, which is preserved so that traces crossing other vendors keep it.
+const tracestateHeader = "tracestate"
+
 // PropagatorConfig defines the configuration for initializing a propagator.
 type PropagatorConfig struct {
 	// BaggagePrefix specifies the prefix that will be used to store baggage
@@ -226,6 +231,9 @@ func (p *propagator) injectTextMap(spanCtx ddtrace.SpanContext, writer TextMapWr
 	if ctx.origin != "" {
 		writer.Set(originHeader, ctx.origin)
 	}
+	if ctx.tracestate != "" {
+		writer.Set(tracestateHeader, ctx.tracestate)
+	}
 	// propagate OpenTracing baggage
 	for k, v := range ctx.baggage {
 		writer.Set(p.cfg.BaggagePrefix+k, v)
@@ -266,6 +274,8 @@ func (p *propagator) extractTextMap(reader TextMapReader) (ddtrace.SpanContext,
 			ctx.setSamplingPriority(priority)
 		case originHeader:
 			ctx.origin = v
+		case tracestateHeader:
+			ctx.tracestate = v
 		default:
 			if strings.HasPrefix(key, p.cfg.BaggagePrefix) {
 				ctx.setBaggageItem(strings.TrimPrefix(key, p.cfg.BaggagePrefix), v)
@@ -306,7 +316,11 @@ func (*propagatorB3) injectTextMap(spanCtx ddtrace.SpanContext, writer TextMapWr
 	if !ok || ctx.traceID == 0 || ctx.spanID == 0 {
 		return ErrInvalidSpanContext
 	}
-	writer.Set(b3TraceIDHeader, strconv.FormatUint(ctx.traceID, 16))
+	if ctx.traceIDUpper != 0 {
+		writer.Set(b3TraceIDHeader, fmt.Sprintf("%016x%016x", ctx.traceIDUpper, ctx.traceID))
+	} else {
+		writer.Set(b3TraceIDHeader, strconv.FormatUint(ctx.traceID, 16))
+	}
 	writer.Set(b3SpanIDHeader, strconv.FormatUint(ctx.spanID, 16))
 	if p, ok := ctx.samplingPriority(); ok {
 		if p >= ext.PriorityAutoKeep {
@@ -334,6 +348,14 @@ func (*propagatorB3) extractTextMap(reader TextMapReader) (ddtrace.SpanContext,
 		key := strings.ToLower(k)
 		switch key {
 		case b3TraceIDHeader:
+			if len(v) > 16 {
+				// 128-bit trace ID
+				ctx.traceIDUpper, err = strconv.ParseUint(v[:len(v)-16], 16, 64)
+				if err != nil {
+					return ErrSpanContextCorrupted
+				}
+				v = v[len(v)-16:]
+			}
 			ctx.traceID, err = strconv.ParseUint(v, 16, 64)
 			if err != nil {
 				return ErrSpanContextCorrupted
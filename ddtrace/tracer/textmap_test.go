@@ -173,6 +173,27 @@ func TestTextMapPropagatorOrigin(t *testing.T) {
 	}
 }
 
+func TestTextMapPropagatorTracestate(t *testing.T) {
+	assert := assert.New(t)
+	tracer := newTracer()
+	ctx, err := tracer.Extract(TextMapCarrier(map[string]string{
+		tracestateHeader:      "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE",
+		DefaultTraceIDHeader:  "1",
+		DefaultParentIDHeader: "1",
+	}))
+	assert.NoError(err)
+	assert.Equal("rojo=00f067aa0ba902b7,congo=t61rcWkgMzE", ctx.(*spanContext).tracestate)
+
+	dst := map[string]string{}
+	assert.NoError(tracer.Inject(ctx, TextMapCarrier(dst)))
+	assert.Equal("rojo=00f067aa0ba902b7,congo=t61rcWkgMzE", dst[tracestateHeader])
+
+	// omitted when empty
+	dst = map[string]string{}
+	assert.NoError(tracer.Inject(tracer.StartSpan("op").Context(), TextMapCarrier(dst)))
+	assert.NotContains(dst, tracestateHeader)
+}
+
 func TestTextMapPropagatorInjectExtract(t *testing.T) {
 	propagator := NewPropagator(&PropagatorConfig{
 		BaggagePrefix: "bg-",
@@ -242,6 +263,32 @@ func TestB3(t *testing.T) {
 		assert.Equal(sctx.spanID, uint64(1))
 	})
 
+	t.Run("128-bit", func(t *testing.T) {
+		os.Setenv("DD_PROPAGATION_STYLE_INJECT", "B3")
+		defer os.Unsetenv("DD_PROPAGATION_STYLE_INJECT")
+		os.Setenv("DD_PROPAGATION_STYLE_EXTRACT", "B3")
+		defer os.Unsetenv("DD_PROPAGATION_STYLE_EXTRACT")
+
+		const traceID = "463ac35c9f6413ad48485a3953bb6124"
+		tracer := newTracer()
+		assert := assert.New(t)
+		ctx, err := tracer.Extract(TextMapCarrier(map[string]string{
+			b3TraceIDHeader: traceID,
+			b3SpanIDHeader:  "1",
+		}))
+		assert.Nil(err)
+		sctx := ctx.(*spanContext)
+		assert.Equal(uint64(0x463ac35c9f6413ad), sctx.traceIDUpper)
+		assert.Equal(uint64(0x48485a3953bb6124), sctx.traceID)
+
+		child := tracer.StartSpan("op", ChildOf(ctx)).(*span)
+		assert.Equal(uint64(0x463ac35c9f6413ad), child.TraceIDUpper)
+		assert.Equal("463ac35c9f6413ad", child.Meta[keyTraceIDUpper])
+		headers := TextMapCarrier(map[string]string{})
+		assert.Nil(tracer.Inject(child.Context(), headers))
+		assert.Equal(traceID, headers[b3TraceIDHeader])
+	})
+
 	t.Run("multiple", func(t *testing.T) {
 		os.Setenv("DD_PROPAGATION_STYLE_EXTRACT", "Datadog,B3")
 		defer os.Unsetenv("DD_PROPAGATION_STYLE_EXTRACT")
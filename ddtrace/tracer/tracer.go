@@ -6,10 +6,19 @@
 package tracer
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/ext"
@@ -34,8 +43,25 @@ type tracer struct {
 	// payloadChan receives traces to be added to the payload.
 	payloadChan chan []*span
 
+	// flushChan receives requests to flush the payload. The worker responds
+	// with the completion channels of the flushes in progress.
+	flushChan chan chan []<-chan struct{}
+
+	// drainChan receives requests to drain the payloads. The worker responds
+	// with the buffered traces, replacing the payloads with empty ones.
+	drainChan chan chan []spanList
+
+	// inflight maps the completion channels of the flushes in progress to the
+	// number of traces they are sending.
+	inflight   map[<-chan struct{}]int
+	inflightMu sync.Mutex
+
 	// climit limits the number of concurrent outgoing connections
-	climit chan struct{}
+	climit *connLimiter
+
+	// concurrency adjusts the capacity of climit to the latency of flushes. It
+	// is nil unless enabled using WithAdaptiveConcurrency.
+	concurrency *concurrencyController
 
 	// stop causes the tracer to shut down when closed.
 	stop chan struct{}
@@ -43,6 +69,27 @@ type tracer struct {
 	// stopOnce ensures the tracer is stopped exactly once.
 	stopOnce sync.Once
 
+	// stopped is closed once all the goroutines of the tracer have exited and the
+	// final metrics were reported after stop was closed.
+	stopped chan struct{}
+
+	// abandon is closed when Stop gives up waiting for the flushes in progress
+	// after the stop timeout. Flushes make no further sends once it is closed.
+	abandon     chan struct{}
+	abandonOnce sync.Once
+
+	// sendCtx is the parent context of the sends to the agent. cancelSends cancels
+	// it when Stop abandons the flushes in progress, interrupting their sends.
+	sendCtx     context.Context
+	cancelSends context.CancelFunc
+
+	// priorityMu guards priorityFlushes.
+	priorityMu sync.Mutex
+
+	// priorityFlushes maps the IDs of the root spans marked using FlushTrace to
+	// the channels reporting the delivery of their trace.
+	priorityFlushes map[uint64]*priorityFlush
+
 	// wg waits for all goroutines to exit when stopping.
 	wg sync.WaitGroup
 
@@ -56,27 +103,155 @@ type tracer struct {
 	// finished, and dropped
 	spansStarted, spansFinished, tracesDropped int64
 
+	// spansAdded counts the spans of the traces received by the worker, before
+	// any of them may be dropped. Unlike the flush_traces metric, which only counts
+	// the traces delivered to the agent, it reflects the throughput of the
+	// application. Accessed atomically.
+	spansAdded int64
+
+	// paused is 1 while writing traces is paused using Pause, and 0 otherwise.
+	// Accessed atomically.
+	paused int32
+
+	// bufferedTraces and bufferedBytes mirror the contents of payload for readers
+	// other than the worker. lastFlush holds the time of the most recent flush, in
+	// nanoseconds since epoch. All three are accessed atomically.
+	bufferedTraces, bufferedBytes, lastFlush int64
+
+	// inflightBytes holds the total size of the payloads being sent. Accessed
+	// atomically.
+	inflightBytes int64
+
+	// servicePayloads maps service names to the payloads buffering their traces
+	// when WithPayloadPerService is used, in which case payload only serves to
+	// drain the retry queue when stopping. It is nil otherwise, and only accessed
+	// by the worker.
+	servicePayloads map[string]*payload
+
+	// heldSince holds the time at which the oldest buffered trace was buffered.
+	// It is only accessed by the worker.
+	heldSince time.Time
+
+	// sizer estimates the capacity of new payloads. It is only accessed by the
+	// worker.
+	sizer payloadSizer
+
+	// seenSpans holds the IDs of the spans added since the last flush, up to
+	// dedupSize, when WithSpanDedup is used. It is nil otherwise, and only
+	// accessed by the worker.
+	seenSpans map[uint64]struct{}
+
+	// retryQueue holds payloads which failed to send, to be retried on the
+	// next successful flush. It is nil when disabled.
+	retryQueue *payloadQueue
+
+	// breaker pauses sends after consecutive failures. It is nil when disabled.
+	breaker *circuitBreaker
+
+	// dumper writes the payloads sent to disk. It is nil unless enabled using
+	// WithDebugPayloadDump.
+	dumper *payloadDumper
+
+	// random generates the span IDs and the jitter of flushes and retries. It is
+	// the package's random source, unless one was set using WithRandomSource.
+	random *rand.Rand
+
+	// compressionRejected is set to 1 once the agent has rejected a compressed
+	// payload, disabling further compression. Accessed atomically.
+	compressionRejected uint32
+
+	// agentInfoMu guards agentInfo and agentInfoFetched.
+	agentInfoMu sync.Mutex
+
+	// agentInfo holds the response of the agent's /info endpoint once fetched. It
+	// is nil if the agent does not serve it.
+	agentInfo *agentInfo
+
+	// agentInfoFetched is true once agentInfo has been fetched.
+	agentInfoFetched bool
+
+	// sendErrors coalesces the logs reporting failed sends.
+	sendErrors sendErrorLog
+
+	// health tracks the outcome of sends and the traces dropped, for Health.
+	health healthTracker
+
+	// drops aggregates the dropped traces when WithDropMetricsInterval is used.
+	drops dropCounter
+
+	// summary accumulates the counts logged by WithHealthSummary. It is nil
+	// when disabled.
+	summary *healthSummary
+
+	// acks tracks the acknowledgment of the traces sent when WithDeliveryTracking
+	// is used. It is nil otherwise.
+	acks *ackTracker
+
 	// rulesSampling holds an instance of the rules sampler. These are user-defined
 	// rules for applying a sampling rate to spans that match the designated service
 	// or operation name.
 	rulesSampling *rulesSampler
 }
 
+// newTicker returns a channel which receives the time at every interval d, along with
+// a function which stops it. It is replaced in tests.
+var newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// newJitterTicker is like newTicker, except that each interval is picked at random
+// by jitterInterval using rng. Like with time.Ticker, ticks are dropped when the
+// receiver falls behind.
+func newJitterTicker(d, jitter time.Duration, rng *rand.Rand) (<-chan time.Time, func()) {
+	c := make(chan time.Time, 1)
+	stop := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(jitterInterval(d, jitter, rng))
+		defer timer.Stop()
+		for {
+			select {
+			case now := <-timer.C:
+				select {
+				case c <- now:
+				default:
+				}
+				timer.Reset(jitterInterval(d, jitter, rng))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return c, func() { close(stop) }
+}
+
+// jitterInterval returns a random interval within jitter of d. The jitter is capped
+// at d/2, so that the interval is always between d/2 and 3*d/2.
+func jitterInterval(d, jitter time.Duration, rng *rand.Rand) time.Duration {
+	if jitter > d/2 {
+		jitter = d / 2
+	}
+	if jitter <= 0 {
+		return d
+	}
+	return d - jitter + time.Duration(rng.Int63n(int64(2*jitter)+1))
+}
+
 const (
-	// flushInterval is the interval at which the payload contents will be flushed
-	// to the transport.
+	// flushInterval is the default interval at which the payload contents will be
+	// flushed to the transport.
 	flushInterval = 2 * time.Second
 
 	// payloadMaxLimit is the maximum payload size allowed and should indicate the
 	// maximum size of the package that the agent can receive.
 	payloadMaxLimit = 9.5 * 1024 * 1024 // 9.5 MB
 
-	// payloadSizeLimit specifies the maximum allowed size of the payload before
-	// it will trigger a flush to the transport.
+	// payloadSizeLimit specifies the default maximum allowed size of the payload
+	// before it will trigger a flush to the transport.
 	payloadSizeLimit = payloadMaxLimit / 2
 
-	// concurrentConnectionLimit specifies the maximum number of concurrent outgoing
-	// connections allowed.
+	// concurrentConnectionLimit specifies the default maximum number of concurrent
+	// outgoing connections allowed.
 	concurrentConnectionLimit = 100
 )
 
@@ -84,6 +259,40 @@ const (
 // statsd client; replaced in tests.
 var statsInterval = 10 * time.Second
 
+const (
+	// sendAttempts specifies the maximum number of attempts made to send a
+	// payload when encountering transient errors.
+	sendAttempts = 3
+
+	// sendRetryTimeout specifies the maximum amount of time which may be spent
+	// retrying to send a payload.
+	sendRetryTimeout = 5 * time.Second
+
+	// retryQueueDrainTimeout specifies the maximum amount of time spent sending
+	// the payloads in the retry queue when the tracer stops.
+	retryQueueDrainTimeout = 5 * time.Second
+
+	// maxPriorityFlushes specifies the maximum number of traces marked using
+	// FlushTrace which may await being buffered.
+	maxPriorityFlushes = 1000
+)
+
+// sendRetryBaseDelay specifies the delay before retrying a failed send. It
+// doubles with each subsequent attempt; replaced in tests.
+var sendRetryBaseDelay = 100 * time.Millisecond
+
+// sendErrorLogInterval specifies the minimum amount of time between two logs
+// reporting traces lost to failed sends; replaced in tests.
+var sendErrorLogInterval = time.Minute
+
+// priorityFlushTimeout specifies the time after which a trace marked using FlushTrace
+// which was not buffered is reported as not delivered; replaced in tests.
+var priorityFlushTimeout = 10 * time.Minute
+
+// backpressurePollInterval specifies how often BackpressureBlock checks whether
+// enough data has been sent; replaced in tests.
+var backpressurePollInterval = 10 * time.Millisecond
+
 // Start starts the tracer with the given set of options. It will stop and replace
 // any running tracer, meaning that calling it several times will result in a restart
 // of the tracer by replacing the current instance with a new one.
@@ -98,12 +307,198 @@ func Start(opts ...StartOption) {
 	}
 }
 
+// Flush flushes any traces buffered by the started tracer and blocks until all
+// payloads being sent to the agent at the time of the call have been sent or
+// have failed. If the tracer is not started, calling this function is a no-op.
+func Flush() {
+	FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but stops waiting and returns the context's error
+// when ctx is done before all payloads have been sent. Failures to send payloads
+// are not returned; they are reported through the tracer's logs and metrics.
+func FlushContext(ctx context.Context) error {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		return t.flushSync(ctx)
+	}
+	return nil
+}
+
+// DrainTraces removes the traces buffered by the started tracer and returns them
+// instead of sending them to the agent, e.g. for test harnesses or custom export
+// pipelines. Traces finishing afterwards are buffered and sent as usual. If the
+// tracer is not started, it returns nil.
+func DrainTraces() [][]ddtrace.Span {
+	t, ok := internal.GetGlobalTracer().(*tracer)
+	if !ok {
+		return nil
+	}
+	var traces [][]ddtrace.Span
+	for _, trace := range t.drain() {
+		spans := make([]ddtrace.Span, len(trace))
+		for i, s := range trace {
+			spans[i] = s
+		}
+		traces = append(traces, spans)
+	}
+	return traces
+}
+
+// FlushTrace marks the trace whose local root span has the given ID to be sent to the
+// agent as soon as it finishes, along with any traces buffered at that time, rather than
+// with the next scheduled flush, e.g. for debugging tools. The returned channel receives
+// true once the trace was delivered to the agent, or passed to the function set using
+// WithExportFunc, or false if the tracer dropped it or failed to send it, or if it
+// stopped first. It also receives false if the trace is not buffered within 10 minutes,
+// e.g. because no trace has a local root span with that ID.
+// If the tracer is not started or too many traces are already marked, the channel
+// receives false right away.
+func FlushTrace(rootSpanID uint64) <-chan bool {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		return t.flushTrace(rootSpanID)
+	}
+	ch := make(chan bool, 1)
+	ch <- false
+	return ch
+}
+
+// Pause pauses writing traces in the started tracer, e.g. to relieve the agent during
+// an incident, until Resume is called. While paused, finished traces are dropped with
+// the reason "paused" and buffered traces are not flushed, except when the tracer
+// stops. If the tracer is not started, calling this function is a no-op.
+func Pause() {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		atomic.StoreInt32(&t.paused, 1)
+	}
+}
+
+// Resume resumes writing traces in the started tracer after a call to Pause. If the
+// tracer is not started, calling this function is a no-op.
+func Resume() {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		atomic.StoreInt32(&t.paused, 0)
+	}
+}
+
+// DeliveryWatermarks returns, when delivery tracking is enabled using WithDeliveryTracking,
+// the number of traces buffered by the started tracer since it started, along with the
+// highest number n such that the first n traces buffered were all acknowledged by the
+// agent. The watermark does not advance past traces which were not delivered, e.g.
+// because sending them failed and was not retried successfully (see WithRetryBuffer)
+// or because they were dropped once buffered. For example, the traces finished
+// before a call to Flush are all delivered once delivered reaches the buffered count
+// returned after Flush returns. If the tracer is not started or delivery tracking is
+// disabled, it returns zeros.
+func DeliveryWatermarks() (buffered, delivered uint64) {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		return t.acks.watermarks()
+	}
+	return 0, 0
+}
+
+// WriterStats holds a snapshot of the traces buffered by the tracer to be sent to
+// the agent.
+type WriterStats struct {
+	// BufferedTraces is the number of traces waiting to be flushed. Traces which
+	// finished very recently may not be accounted for yet.
+	BufferedTraces int
+
+	// BufferedBytes is the encoded size of the traces waiting to be flushed.
+	BufferedBytes int
+
+	// LastFlush is the time at which buffered traces were last flushed. It is
+	// the zero time if no traces were flushed yet.
+	LastFlush time.Time
+
+	// InFlightFlushes is the number of flushes in progress.
+	InFlightFlushes int
+}
+
+// CurrentWriterStats returns a snapshot of the traces buffered by the started tracer,
+// e.g. to implement custom backpressure or health checks. If the tracer is not started,
+// the zero value is returned.
+func CurrentWriterStats() WriterStats {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		return t.writerStats()
+	}
+	return WriterStats{}
+}
+
+// HealthStatus describes how well the tracer is managing to send traces to the agent.
+type HealthStatus struct {
+	// LastFlushSuccess is the time at which traces were last sent to the agent
+	// successfully. It is the zero time if no send succeeded yet.
+	LastFlushSuccess time.Time
+
+	// ConsecutiveFailures is the number of sends to the agent which failed since
+	// the last successful one.
+	ConsecutiveFailures int
+
+	// DropRate is the fraction of traces which were dropped rather than sent to
+	// the agent over the last healthWindow, between 0 and 1. Traces dropped as
+	// configured, e.g. by a span filter or while paused, are not counted.
+	DropRate float64
+}
+
+// Healthy reports whether the last send to the agent succeeded, or none was
+// attempted yet, and the drop rate does not exceed maxDropRate.
+func (h HealthStatus) Healthy(maxDropRate float64) bool {
+	return h.ConsecutiveFailures == 0 && h.DropRate <= maxDropRate
+}
+
+// Health returns the health of the started tracer, e.g. to be reported by a health
+// check endpoint. If the tracer is not started, the zero value is returned.
+func Health() HealthStatus {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		return t.health.status(time.Now())
+	}
+	return HealthStatus{}
+}
+
+// AgentSamplingRates returns the sampling rates most recently returned by the agent
+// to the started tracer, keyed by "service:<service>,env:<env>". It returns nil if
+// the tracer is not started or has not received any rates yet.
+func AgentSamplingRates() map[string]float64 {
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		return t.prioritySampling.receivedRates()
+	}
+	return nil
+}
+
 // Stop stops the started tracer. Subsequent calls are valid but become no-op.
 func Stop() {
 	internal.SetGlobalTracer(&internal.NoopTracer{})
 	log.Flush()
 }
 
+// FlushAndStop stops the started tracer like Stop, but waits for the buffered traces
+// to be sent to the agent for as long as ctx allows, instead of the stop timeout,
+// e.g. when handling SIGTERM within a grace period. If ctx is done first, the sends
+// still in progress are abandoned and an *UnsentTracesError is returned. If the
+// tracer is not started, calling this function is a no-op.
+func FlushAndStop(ctx context.Context) error {
+	var err error
+	if t, ok := internal.GetGlobalTracer().(*tracer); ok {
+		err = t.flushAndStop(ctx)
+	}
+	Stop()
+	return err
+}
+
+// UnsentTracesError is returned by FlushAndStop when the context is done before all
+// the buffered traces were sent to the agent.
+type UnsentTracesError struct {
+	// Unsent is the number of traces which were abandoned.
+	Unsent int
+
+	// Err is the error of the context.
+	Err error
+}
+
+func (e *UnsentTracesError) Error() string {
+	return fmt.Sprintf("stopped with %d traces unsent: %v", e.Unsent, e.Err)
+}
+
 // Span is an alias for ddtrace.Span. It is here to allow godoc to group methods returning
 // ddtrace.Span. It is recommended and is considered more correct to refer to this type as
 // ddtrace.Span instead.
@@ -141,15 +536,71 @@ func newUnstartedTracer(opts ...StartOption) *tracer {
 	if envRules != nil {
 		c.samplingRules = envRules
 	}
+	var breaker *circuitBreaker
+	if c.breakerFailures > 0 {
+		breaker = newCircuitBreaker(c.breakerFailures, c.breakerCooldown)
+	}
+	rng := random
+	if c.randSource != nil {
+		rng = rand.New(&safeSource{source: c.randSource})
+	}
+	climit := newConnLimiter(c.maxConcurrentFlushes)
+	var concurrency *concurrencyController
+	if c.adaptiveMax > 0 {
+		climit = newConnLimiter(c.adaptiveMax)
+		concurrency = newConcurrencyController(climit, c.adaptiveMin, c.adaptiveMax, c.adaptiveTarget)
+	}
+	var acks *ackTracker
+	if c.trackDelivery {
+		acks = new(ackTracker)
+	}
+	var summary *healthSummary
+	if c.healthSummaryInterval > 0 {
+		summary = new(healthSummary)
+	}
+	var seenSpans map[uint64]struct{}
+	if c.dedupSize > 0 {
+		seenSpans = make(map[uint64]struct{})
+	}
+	var dumper *payloadDumper
+	if c.dumpDir != "" {
+		dumper = newPayloadDumper(c.dumpDir, c.dumpMaxSize)
+	}
+	var servicePayloads map[string]*payload
+	if c.payloadPerService {
+		servicePayloads = make(map[string]*payload)
+	}
+	var queue *payloadQueue
+	if c.retryBufferSize > 0 {
+		queue = newPayloadQueue(c.retryBufferSize)
+	}
+	sendCtx, cancelSends := context.WithCancel(context.Background())
 	return &tracer{
 		config:           c,
-		payload:          newPayload(),
+		payload:          newEncoderPayload(c.encoder),
 		payloadChan:      make(chan []*span, payloadQueueSize),
+		flushChan:        make(chan chan []<-chan struct{}),
+		drainChan:        make(chan chan []spanList),
+		inflight:         make(map[<-chan struct{}]int),
 		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+		abandon:          make(chan struct{}),
+		sendCtx:          sendCtx,
+		cancelSends:      cancelSends,
 		rulesSampling:    newRulesSampler(c.samplingRules),
-		climit:           make(chan struct{}, concurrentConnectionLimit),
+		climit:           climit,
+		concurrency:      concurrency,
 		prioritySampling: newPrioritySampler(),
 		pid:              strconv.Itoa(os.Getpid()),
+		retryQueue:       queue,
+		servicePayloads:  servicePayloads,
+		breaker:          breaker,
+		random:           rng,
+		dumper:           dumper,
+		seenSpans:        seenSpans,
+		summary:          summary,
+		acks:             acks,
+		sizer:            payloadSizer{max: c.payloadSizeLimit},
 	}
 }
 
@@ -170,11 +621,21 @@ func newTracer(opts ...StartOption) *tracer {
 		defer t.wg.Done()
 		tick := t.config.tickChan
 		if tick == nil {
-			ticker := time.NewTicker(flushInterval)
-			defer ticker.Stop()
-			tick = ticker.C
+			var stop func()
+			if t.config.flushJitter > 0 {
+				tick, stop = newJitterTicker(t.config.flushInterval, t.config.flushJitter, t.random)
+			} else {
+				tick, stop = newTicker(t.config.flushInterval)
+			}
+			defer stop()
+		}
+		var ageTick <-chan time.Time
+		if t.config.maxTraceAge > 0 {
+			var stop func()
+			ageTick, stop = newTicker(t.config.maxTraceAge / 4)
+			defer stop()
 		}
-		t.worker(tick)
+		t.worker(tick, ageTick)
 	}()
 
 	t.wg.Add(1)
@@ -182,56 +643,298 @@ func newTracer(opts ...StartOption) *tracer {
 		defer t.wg.Done()
 		t.reportHealthMetrics(statsInterval)
 	}()
+	if c.connectionWarmup || c.compressionThreshold > 0 {
+		// compression waits for the agent to confirm it is supported
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			if _, err := t.fetchAgentInfo(); err != nil {
+				log.Warn("Unable to connect to the agent ahead of the first flush: %v", err)
+			}
+		}()
+	}
+	if c.dropMetricsInterval > 0 {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.reportDropMetrics(c.dropMetricsInterval)
+		}()
+	}
+	if c.healthSummaryInterval > 0 {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.reportHealthSummary(c.healthSummaryInterval)
+		}()
+	}
 	return t
 }
 
 // worker receives finished traces to be added into the payload, as well
-// as periodically flushes traces to the transport.
-func (t *tracer) worker(tick <-chan time.Time) {
-	defer t.config.statsd.Close()
-
+// as periodically flushes traces to the transport. The buffered traces are
+// also flushed when they have exceeded their maximum age at a tick of ageTick.
+func (t *tracer) worker(tick, ageTick <-chan time.Time) {
 	for {
 		select {
 		case trace := <-t.payloadChan:
 			t.pushPayload(trace)
 
 		case <-tick:
-			t.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:scheduled"}, 1)
-			t.flush()
+			t.expirePriorityFlushes(time.Now())
+			if t.climit.full() {
+				// all connections are busy; keep buffering until the next tick
+				// rather than blocking the worker on a new flush.
+				log.Debug("Skipping scheduled flush, %d flushes in progress.", t.climit.len())
+				break
+			}
+			if t.holdPayload() {
+				_, size := t.buffered()
+				log.Debug("Skipping scheduled flush, payload of %d bytes is below the minimum flush size.", size)
+				break
+			}
+			t.flush(flushReasonScheduled)
 
-		case <-t.stop:
-		loop:
-			// the loop ensures that the payload channel is fully drained
-			// before the final flush to ensure no traces are lost (see #526)
-			for {
-				select {
-				case trace := <-t.payloadChan:
-					t.pushPayload(trace)
-				default:
-					break loop
-				}
+		case now := <-ageTick:
+			if t.aged(now) && !t.climit.full() {
+				t.flush(flushReasonAge)
+			}
+
+		case req := <-t.flushChan:
+			t.drainPayloadChan()
+			t.flush(flushReasonManual)
+			req <- t.inflightFlushes()
+
+		case req := <-t.drainChan:
+			t.drainPayloadChan()
+			traces := t.payload.traces
+			for service, p := range t.servicePayloads {
+				traces = append(traces, p.traces...)
+				failDeliveries(p)
+				delete(t.servicePayloads, service)
 			}
-			t.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:shutdown"}, 1)
-			t.flush()
+			req <- traces
+			failDeliveries(t.payload)
+			t.payload = t.emptyPayload()
+			t.updateBufferStats()
+
+		case <-t.stop:
+			// ensure that the payload channel is fully drained before
+			// the final flush to ensure no traces are lost (see #526)
+			t.drainPayloadChan()
+			t.flush(flushReasonShutdown)
+			t.expirePriorityFlushes(time.Time{})
 			t.config.statsd.Incr("datadog.tracer.stopped", nil, 1)
 			return
 		}
 	}
 }
 
+// holdPayload reports whether a scheduled flush should be skipped because the
+// payload is smaller than the size set using WithMinFlushSize and its oldest trace
+// has been held for less than the maximum hold time.
+func (t *tracer) holdPayload() bool {
+	traces, size := t.buffered()
+	if t.config.minFlushSize <= 0 || traces == 0 {
+		return false
+	}
+	return size < t.config.minFlushSize && time.Since(t.heldSince) < t.config.maxFlushHold
+}
+
+// aged reports whether the oldest buffered trace has exceeded the maximum age set
+// using WithMaxTraceAge at the given time.
+func (t *tracer) aged(now time.Time) bool {
+	if t.config.maxTraceAge <= 0 {
+		return false
+	}
+	traces, _ := t.buffered()
+	return traces > 0 && now.Sub(t.heldSince) >= t.config.maxTraceAge
+}
+
+// buffered returns the number of traces and bytes buffered across all payloads.
+// It must only be called by the worker.
+func (t *tracer) buffered() (traces, size int) {
+	traces, size = t.payload.itemCount(), t.payload.size()
+	for _, p := range t.servicePayloads {
+		traces += p.itemCount()
+		size += p.size()
+	}
+	return traces, size
+}
+
+// payloadFor returns the payload which trace should be pushed onto, creating it
+// if needed. It must only be called by the worker.
+func (t *tracer) payloadFor(trace []*span) *payload {
+	if t.servicePayloads == nil || len(trace) == 0 {
+		return t.payload
+	}
+	service := trace[0].Service
+	p, ok := t.servicePayloads[service]
+	if !ok {
+		p = t.emptyPayload()
+		p.service = service
+		t.servicePayloads[service] = p
+	}
+	return p
+}
+
+// emptyPayload returns a new payload with its buffer sized after the payloads
+// flushed recently, up to the payload size limit. Payloads are not presized when
+// they are segregated by service, since the payloads of all services would hold
+// that memory while possibly remaining small. It must only be called by the worker.
+func (t *tracer) emptyPayload() *payload {
+	p := newEncoderPayload(t.config.encoder)
+	if t.servicePayloads == nil {
+		p.buf.Grow(t.sizer.capacity())
+	}
+	return p
+}
+
+// drainPayloadChan adds all the traces waiting in the payload channel to the payload.
+func (t *tracer) drainPayloadChan() {
+	for {
+		select {
+		case trace := <-t.payloadChan:
+			t.pushPayload(trace)
+		default:
+			return
+		}
+	}
+}
+
+// flushSync requests the worker to flush the payload and waits until all the
+// flushes in progress at that point have completed, or until ctx is done.
+func (t *tracer) flushSync(ctx context.Context) error {
+	req := make(chan []<-chan struct{}, 1)
+	select {
+	case t.flushChan <- req:
+	case <-t.stop:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var pending []<-chan struct{}
+	select {
+	case pending = <-req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// inflightFlushes returns the completion channels of the flushes in progress.
+func (t *tracer) inflightFlushes() []<-chan struct{} {
+	t.inflightMu.Lock()
+	defer t.inflightMu.Unlock()
+	pending := make([]<-chan struct{}, 0, len(t.inflight))
+	for done := range t.inflight {
+		pending = append(pending, done)
+	}
+	return pending
+}
+
+// drain removes the traces buffered in the payload and returns them.
+func (t *tracer) drain() []spanList {
+	req := make(chan []spanList, 1)
+	select {
+	case t.drainChan <- req:
+	case <-t.stop:
+		return nil
+	}
+	return <-req
+}
+
+// writerStats returns a snapshot of the traces buffered by t.
+func (t *tracer) writerStats() WriterStats {
+	stats := WriterStats{
+		BufferedTraces: int(atomic.LoadInt64(&t.bufferedTraces)),
+		BufferedBytes:  int(atomic.LoadInt64(&t.bufferedBytes)),
+	}
+	if n := atomic.LoadInt64(&t.lastFlush); n != 0 {
+		stats.LastFlush = time.Unix(0, n)
+	}
+	t.inflightMu.Lock()
+	stats.InFlightFlushes = len(t.inflight)
+	t.inflightMu.Unlock()
+	return stats
+}
+
+// updateBufferStats records the current contents of the payload for writerStats.
+// It must only be called by the worker.
+func (t *tracer) updateBufferStats() {
+	traces, size := t.buffered()
+	atomic.StoreInt64(&t.bufferedTraces, int64(traces))
+	atomic.StoreInt64(&t.bufferedBytes, int64(size))
+}
+
 func (t *tracer) pushTrace(trace []*span) {
 	select {
 	case <-t.stop:
 		return
 	default:
 	}
+	if !t.admit(len(trace)) {
+		t.failPriorityFlush(trace)
+		return
+	}
 	select {
 	case t.payloadChan <- trace:
 	default:
+		t.failPriorityFlush(trace)
 		log.Error("payload queue full, dropping %d traces", len(trace))
 	}
 }
 
+// isPaused reports whether writing traces was paused using Pause.
+func (t *tracer) isPaused() bool {
+	return atomic.LoadInt32(&t.paused) == 1
+}
+
+// admit reports whether a finished trace of the given number of spans may be queued
+// for sending. While the data buffered and in flight exceeds the backpressure
+// high-water mark, it applies the configured policy, either blocking until enough
+// data has been sent or dropping the trace.
+func (t *tracer) admit(spans int) bool {
+	limit := int64(t.config.backpressureBytes)
+	if limit <= 0 || t.pendingBytes() <= limit {
+		return true
+	}
+	t.config.statsd.Incr("datadog.tracer.backpressure", []string{"policy:" + t.config.backpressurePolicy.String()}, 1)
+	if t.config.backpressurePolicy == BackpressureBlock {
+		timeout := time.NewTimer(t.config.backpressureTimeout)
+		defer timeout.Stop()
+		poll := time.NewTicker(backpressurePollInterval)
+		defer poll.Stop()
+	wait:
+		for {
+			select {
+			case <-poll.C:
+				if t.pendingBytes() <= limit {
+					return true
+				}
+			case <-timeout.C:
+				break wait
+			case <-t.stop:
+				return false
+			}
+		}
+	}
+	t.recordDrop(dropReasonBackpressure, 1)
+	t.notifyDrop(dropReasonBackpressure, spans)
+	return false
+}
+
+// pendingBytes returns the size of the data buffered and in flight to the agent.
+func (t *tracer) pendingBytes() int64 {
+	return atomic.LoadInt64(&t.bufferedBytes) + atomic.LoadInt64(&t.inflightBytes)
+}
+
 // StartSpan creates, starts, and returns a new Span with the given `operationName`.
 func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOption) ddtrace.Span {
 	var opts ddtrace.StartSpanConfig
@@ -252,7 +955,7 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 	}
 	id := opts.SpanID
 	if id == 0 {
-		id = random.Uint64()
+		id = t.random.Uint64()
 	}
 	// span defaults
 	span := &span{
@@ -264,9 +967,14 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 		Start:    startTime,
 		taskEnd:  startExecutionTracerTask(operationName),
 	}
+	if len(opts.SpanLinks) > 0 {
+		span.SpanLinks = append([]ddtrace.SpanLink(nil), opts.SpanLinks...)
+	}
 	if context != nil {
 		// this is a child span
 		span.TraceID = context.traceID
+		span.TraceIDUpper = context.traceIDUpper
+		span.Tracestate = context.tracestate
 		span.ParentID = context.spanID
 		if p, ok := context.samplingPriority(); ok {
 			span.setMetric(keySamplingPriority, float64(p))
@@ -284,6 +992,12 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 			}
 		}
 	}
+	if span.TraceIDUpper != 0 {
+		span.setMeta(keyTraceIDUpper, fmt.Sprintf("%016x", span.TraceIDUpper))
+	}
+	if span.Tracestate != "" {
+		span.setMeta(keyTracestate, span.Tracestate)
+	}
 	span.context = newSpanContext(span, context)
 	if context == nil || context.span == nil {
 		// this is either a root span or it has a remote parent, we should add the PID.
@@ -318,12 +1032,71 @@ func (t *tracer) StartSpan(operationName string, options ...ddtrace.StartSpanOpt
 	return span
 }
 
-// Stop stops the tracer.
+// Stop stops the tracer. It waits up to the configured stop timeout for buffered
+// traces to be sent, after which any sends still in progress are abandoned.
 func (t *tracer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.stopTimeout)
+	defer cancel()
+	if err, ok := t.flushAndStop(ctx).(*UnsentTracesError); ok {
+		log.Error("Timed out stopping the tracer after %s, abandoned %d traces.", t.config.stopTimeout, err.Unsent)
+	}
+}
+
+// flushAndStop stops the tracer and waits for the buffered traces to be sent until
+// ctx is done, after which any sends still in progress are abandoned and an
+// *UnsentTracesError is returned.
+func (t *tracer) flushAndStop(ctx context.Context) error {
 	t.stopOnce.Do(func() {
 		close(t.stop)
+		go func() {
+			t.wg.Wait()
+			// report any drops which occurred while stopping, including those of
+			// abandoned flushes, then close the client once nothing reports
+			// metrics anymore
+			t.reportDrops()
+			if t.config.ownStatsd {
+				t.config.statsd.Close()
+			}
+			close(t.stopped)
+		}()
 	})
-	t.wg.Wait()
+	var err error
+	select {
+	case <-t.stopped:
+	case <-t.abandon:
+		// abandoned by a previous call
+	case <-ctx.Done():
+		t.abandonOnce.Do(func() {
+			err = &UnsentTracesError{Unsent: t.abandonFlushes(), Err: ctx.Err()}
+		})
+	}
+	return err
+}
+
+// abandonFlushes signals the flushes in progress to stop sending, canceling their
+// sends, and reports the traces they hold as dropped, returning their number.
+func (t *tracer) abandonFlushes() int {
+	close(t.abandon)
+	t.cancelSends()
+	var n int
+	t.inflightMu.Lock()
+	for _, count := range t.inflight {
+		n += count
+	}
+	t.inflightMu.Unlock()
+	t.config.statsd.Incr("datadog.tracer.stop_timeout", nil, 1)
+	t.recordDrop(dropReasonStopTimeout, int64(n))
+	return n
+}
+
+// abandoned reports whether Stop has abandoned the flushes in progress.
+func (t *tracer) abandoned() bool {
+	select {
+	case <-t.abandon:
+		return true
+	default:
+		return false
+	}
 }
 
 // Inject uses the configured or default TextMap Propagator.
@@ -336,47 +1109,1457 @@ func (t *tracer) Extract(carrier interface{}) (ddtrace.SpanContext, error) {
 	return t.config.propagator.Extract(carrier)
 }
 
-// flush will push any currently buffered traces to the server.
-func (t *tracer) flush() {
-	if t.payload.itemCount() == 0 {
+// flushReason specifies the event which triggered a flush.
+type flushReason int
+
+const (
+	flushReasonScheduled flushReason = iota // the flush interval has elapsed
+	flushReasonSize                         // the payload has exceeded its size limit
+	flushReasonShutdown                     // the tracer is stopping
+	flushReasonManual                       // a flush was requested using Flush
+	flushReasonAge                          // the oldest buffered trace has exceeded its maximum age
+	flushReasonPriority                     // a trace marked using FlushTrace was buffered
+)
+
+// String returns the value used in the "reason" tag of flush metrics.
+func (r flushReason) String() string {
+	switch r {
+	case flushReasonScheduled:
+		return "scheduled"
+	case flushReasonSize:
+		return "size"
+	case flushReasonShutdown:
+		return "shutdown"
+	case flushReasonManual:
+		return "manual"
+	case flushReasonAge:
+		return "age"
+	case flushReasonPriority:
+		return "priority"
+	default:
+		return "unknown"
+	}
+}
+
+// flush will push any currently buffered traces to the server. The reason
+// specifies what triggered the flush.
+func (t *tracer) flush(reason flushReason) {
+	if reason != flushReasonShutdown && t.isPaused() {
 		return
 	}
-	t.wg.Add(1)
-	t.climit <- struct{}{}
-	go func(p *payload) {
-		defer func(start time.Time) {
-			<-t.climit
-			t.wg.Done()
-			t.config.statsd.Timing("datadog.tracer.flush_duration", time.Since(start), nil, 1)
-		}(time.Now())
-		size, count := p.size(), p.itemCount()
-		log.Debug("Sending payload: size: %d traces: %d\n", size, count)
-		rc, err := t.config.transport.send(p)
-		if err != nil {
-			t.config.statsd.Count("datadog.tracer.traces_dropped", int64(count), []string{"reason:send_failed"}, 1)
-			log.Error("lost %d traces: %v", count, err)
-		} else {
-			t.config.statsd.Count("datadog.tracer.flush_bytes", int64(size), nil, 1)
-			t.config.statsd.Count("datadog.tracer.flush_traces", int64(count), nil, 1)
-			if err := t.prioritySampling.readRatesJSON(rc); err != nil {
-				t.config.statsd.Incr("datadog.tracer.decode_error", nil, 1)
-			}
+	t.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:" + reason.String()}, t.config.metricsSampleRate)
+	var flushed bool
+	for service, p := range t.servicePayloads {
+		if p.itemCount() > 0 {
+			t.flushPayload(p, reason)
+			flushed = true
 		}
-	}(t.payload)
-	t.payload = newPayload()
+		delete(t.servicePayloads, service)
+	}
+	if t.payload.itemCount() > 0 || (!flushed && t.stopping() && t.retryQueue.len() > 0) {
+		t.flushPayload(t.payload, reason)
+		t.payload = t.emptyPayload()
+		flushed = true
+	}
+	if !flushed {
+		return
+	}
+	t.updateBufferStats()
+	atomic.StoreInt64(&t.lastFlush, now())
 }
 
-// pushPayload pushes the trace onto the payload. If the payload becomes
-// larger than the threshold as a result, it sends a flush request.
-func (t *tracer) pushPayload(trace []*span) {
-	if err := t.payload.push(trace); err != nil {
-		t.config.statsd.Incr("datadog.tracer.traces_dropped", []string{"reason:encoding_error"}, 1)
-		log.Error("error encoding msgpack: %v", err)
+// flushService pushes the traces buffered for the given service to the server,
+// leaving the payloads of other services untouched. It is used with
+// WithPayloadPerService.
+func (t *tracer) flushService(service string, reason flushReason) {
+	if t.isPaused() {
+		return
+	}
+	t.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:" + reason.String()}, t.config.metricsSampleRate)
+	p, ok := t.servicePayloads[service]
+	if !ok || p.itemCount() == 0 {
+		return
+	}
+	t.flushPayload(p, reason)
+	delete(t.servicePayloads, service)
+	t.updateBufferStats()
+	atomic.StoreInt64(&t.lastFlush, now())
+}
+
+// flushTags returns tags along with the service tag of p, if it holds the traces
+// of a single service.
+func flushTags(p *payload, tags ...string) []string {
+	if p.service != "" {
+		tags = append(tags, "service:"+p.service)
+	}
+	return tags
+}
+
+// flushPayload sends p to the server in the background. The caller must replace
+// p with an empty payload.
+func (t *tracer) flushPayload(p *payload, reason flushReason) {
+	if t.config.endpointSelector != nil && p.itemCount() > 0 {
+		p.target = t.config.endpointSelector(newPayloadMeta(p))
+	}
+	p.traces, p.sizes = nil, nil // only needed for draining and evicting
+	if t.seenSpans != nil {
+		t.seenSpans = make(map[uint64]struct{})
 	}
-	if t.payload.size() > payloadSizeLimit {
-		t.config.statsd.Incr("datadog.tracer.flush_triggered", []string{"reason:size"}, 1)
-		t.flush()
+	t.config.statsd.Gauge("datadog.tracer.payload_fill_ratio", float64(p.size())/float64(t.config.payloadSizeLimit), flushTags(p, "reason:"+reason.String()), 1)
+	if p.itemCount() > 0 {
+		t.config.statsd.Histogram("datadog.tracer.payload_spans", float64(p.spans), flushTags(p), t.config.metricsSampleRate)
+		t.config.statsd.Count("datadog.tracer.payload_buffer_grows", int64(p.grows), flushTags(p), 1)
+		t.sizer.observe(p.buf.Len())
+	}
+	t.wg.Add(1)
+	done := make(chan struct{})
+	t.inflightMu.Lock()
+	t.inflight[done] = p.itemCount()
+	t.reportActiveFlushesLocked()
+	t.inflightMu.Unlock()
+	atomic.AddInt64(&t.inflightBytes, int64(p.size()))
+	t.acquireConn()
+	go func(p *payload, stats FlushStats) {
+		start := time.Now()
+		var sent, delivered bool
+		defer func() {
+			if sent {
+				t.summary.flushed(time.Since(start))
+			}
+			atomic.AddInt64(&t.inflightBytes, -int64(stats.Size))
+			t.inflightMu.Lock()
+			delete(t.inflight, done)
+			t.reportActiveFlushesLocked()
+			t.inflightMu.Unlock()
+			close(done)
+			t.climit.release()
+			if sent && t.concurrency != nil {
+				if limit, ok := t.concurrency.observe(time.Since(start)); ok {
+					t.config.statsd.Gauge("datadog.tracer.flush_concurrency_limit", float64(limit), nil, 1)
+				}
+			}
+			t.wg.Done()
+			outcome := "outcome:error"
+			if delivered {
+				outcome = "outcome:success"
+			}
+			t.config.statsd.Timing("datadog.tracer.flush_duration", time.Since(start), flushTags(p, "reason:"+stats.Reason, outcome), t.config.metricsSampleRate)
+		}()
+		sent = p.itemCount() > 0 && !t.abandoned()
+		delivered = sent && t.send(p)
+		for _, ch := range p.deliveries {
+			ch <- delivered
+		}
+		if delivered || t.stopping() {
+			t.sendQueued()
+		}
+		if t.config.flushHook != nil && stats.Traces > 0 {
+			stats.Delivered = delivered
+			stats.Duration = time.Since(start)
+			t.config.flushHook(stats)
+		}
+	}(p, FlushStats{
+		Reason:  reason.String(),
+		Service: p.service,
+		Size:    p.size(),
+		Traces:  p.itemCount(),
+	})
+}
+
+// reportActiveFlushesLocked reports the number of flushes in progress. It is called
+// whenever that number changes, with inflightMu held so that the reported values
+// are ordered.
+func (t *tracer) reportActiveFlushesLocked() {
+	t.config.statsd.Gauge("datadog.tracer.active_flushes", float64(len(t.inflight)), nil, 1)
+}
+
+// acquireConn takes one of the concurrent connection slots in climit, blocking
+// until one is available. The time spent waiting is reported, so that users can
+// tell whether flushing is held back by the concurrency limit.
+func (t *tracer) acquireConn() {
+	start := time.Now()
+	if !t.climit.tryAcquire() {
+		t.config.statsd.Incr("datadog.tracer.flush_climit_blocked", nil, t.config.metricsSampleRate)
+		t.climit.acquire()
+	}
+	t.config.statsd.Timing("datadog.tracer.flush_climit_wait", time.Since(start), nil, t.config.metricsSampleRate)
+}
+
+// connLimiter is a semaphore limiting the number of concurrent connections to the
+// agent. Unlike a buffered channel, its capacity can be changed while connections
+// are in use; when reduced below the number of connections in use, no connection
+// is acquired until enough are released. It is safe for concurrent use.
+type connLimiter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	n     int // connections in use
+	limit int // maximum connections in use
+}
+
+// newConnLimiter returns a connLimiter allowing limit concurrent connections.
+func newConnLimiter(limit int) *connLimiter {
+	l := &connLimiter{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// tryAcquire takes a connection if one is available, reporting whether it did.
+func (l *connLimiter) tryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n >= l.limit {
+		return false
+	}
+	l.n++
+	return true
+}
+
+// acquire takes a connection, blocking until one is available.
+func (l *connLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.n >= l.limit {
+		l.cond.Wait()
+	}
+	l.n++
+}
+
+// release gives back a connection taken by acquire or tryAcquire.
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	l.n--
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+// setCap sets the maximum number of connections in use to limit.
+func (l *connLimiter) setCap(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// len returns the number of connections in use.
+func (l *connLimiter) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+// cap returns the maximum number of connections in use.
+func (l *connLimiter) cap() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// full reports whether no connection is available.
+func (l *connLimiter) full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n >= l.limit
+}
+
+// concurrencyController adjusts the capacity of a connLimiter to the latency of
+// the flushes using it. The capacity grows by one with every flush while the
+// average latency is below the target, and shrinks by a quarter with every flush
+// while it is above, staying within bounds. It is safe for concurrent use.
+type concurrencyController struct {
+	limiter  *connLimiter
+	min, max int           // bounds of the capacity
+	target   time.Duration // flush latency aimed for
+
+	mu  sync.Mutex
+	avg time.Duration // exponentially weighted moving average of the latency
+}
+
+// newConcurrencyController returns a concurrencyController adjusting the capacity
+// of l between min and max, aiming for flushes taking target.
+func newConcurrencyController(l *connLimiter, min, max int, target time.Duration) *concurrencyController {
+	return &concurrencyController{limiter: l, min: min, max: max, target: target}
+}
+
+// observe records a flush having taken d, adjusting the capacity of the limiter.
+// It returns the new capacity and whether it changed.
+func (c *concurrencyController) observe(d time.Duration) (limit int, changed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.avg == 0 {
+		c.avg = d
+	} else {
+		c.avg = (4*c.avg + d) / 5
+	}
+	old := c.limiter.cap()
+	limit = old
+	switch {
+	case c.avg > c.target:
+		limit = old * 3 / 4
+		if limit == old {
+			limit--
+		}
+	case c.avg < c.target:
+		limit++
+	}
+	if limit < c.min {
+		limit = c.min
+	}
+	if limit > c.max {
+		limit = c.max
+	}
+	if limit == old {
+		return old, false
+	}
+	c.limiter.setCap(limit)
+	return limit, true
+}
+
+// FlushStats holds information about a flush of buffered traces to the agent. It is
+// passed to the hook set using WithFlushHook.
+type FlushStats struct {
+	// Reason specifies what triggered the flush: "scheduled", "size", "shutdown",
+	// "manual", "age" or "priority".
+	Reason string
+
+	// Service is the service of the traces in the payload when WithPayloadPerService
+	// is used. It is empty otherwise.
+	Service string
+
+	// Size is the size of the payload in bytes, before any compression.
+	Size int
+
+	// Traces is the number of traces in the payload.
+	Traces int
+
+	// Duration is the time taken by the flush, including retries.
+	Duration time.Duration
+
+	// Delivered is true if the payload was accepted by the agent.
+	Delivered bool
+}
+
+// PayloadMeta describes a payload of traces about to be sent. It is passed to the
+// function set using WithEndpointSelector.
+type PayloadMeta struct {
+	// Service is the service having the most traces in the payload, a trace belonging
+	// to the service of its first span. On ties, the service reaching that count first
+	// is chosen.
+	Service string
+
+	// Traces is the number of traces in the payload.
+	Traces int
+}
+
+// newPayloadMeta returns the PayloadMeta describing p. It must be called before the
+// traces of p are cleared.
+func newPayloadMeta(p *payload) PayloadMeta {
+	meta := PayloadMeta{Service: p.service, Traces: p.itemCount()}
+	if meta.Service != "" {
+		return meta
+	}
+	counts := make(map[string]int)
+	for _, trace := range p.traces {
+		if len(trace) == 0 {
+			continue
+		}
+		svc := trace[0].Service
+		counts[svc]++
+		if counts[svc] > counts[meta.Service] {
+			meta.Service = svc
+		}
+	}
+	return meta
+}
+
+// send sends the payload p to the agent and reports the outcome, returning true
+// if it was delivered. Payloads which could not be delivered are added to the
+// retry queue when enabled and the tracer is not stopping, or dropped otherwise.
+func (t *tracer) send(p *payload) bool {
+	size, count := p.size(), p.itemCount()
+	if !t.breaker.allow(time.Now()) {
+		log.Debug("Dropping payload of %d traces, sends are paused after consecutive failures.", count)
+		t.recordDrop(dropReasonCircuitOpen, int64(count))
+		return false
+	}
+	t.compress(p)
+	log.Debug("Sending payload: size: %d traces: %d\n", p.size(), count)
+	rc, err := t.sendPayload(p)
+	if err != nil {
+		if t.abandoned() {
+			// already reported as dropped when the stop timed out
+			return false
+		}
+		t.breaker.record(false, time.Now())
+		t.config.statsd.Incr("datadog.tracer.send_errors", sendErrorTags(err), 1)
+		t.health.failure()
+		_, timedOut := err.(*sendTimeoutError)
+		if t.retryQueue != nil && !t.stopping() && !timedOut {
+			t.sendErrors.queued(count, err)
+			p.decompress()
+			p.rewind()
+			for _, dp := range t.retryQueue.push(p) {
+				t.config.statsd.Count("datadog.tracer.queue_dropped", int64(dp.itemCount()), nil, 1)
+				t.recordDrop(dropReasonSendFailed, int64(dp.itemCount()))
+				t.sendErrors.evicted(dp.itemCount())
+			}
+			return false
+		}
+		reason := dropReasonSendFailed
+		if timedOut {
+			reason = dropReasonSendTimeout
+		}
+		t.recordDrop(reason, int64(count))
+		t.sendErrors.record(p.id, size, count, err)
+		return false
+	}
+	t.breaker.record(true, time.Now())
+	t.health.success(time.Now(), count)
+	t.summary.deliver(int64(count))
+	t.acks.ack(p.seqs)
+	t.config.statsd.Count("datadog.tracer.flush_bytes", int64(size), flushTags(p), t.config.metricsSampleRate)
+	if p.compressed() {
+		t.config.statsd.Count("datadog.tracer.flush_bytes_compressed", int64(p.size()), flushTags(p), t.config.metricsSampleRate)
+	}
+	t.config.statsd.Count("datadog.tracer.flush_traces", int64(count), flushTags(p), t.config.metricsSampleRate)
+	if p.target != "" {
+		// only the agent responds with sampling rates
+		rc.Close()
+		return true
+	}
+	if err := t.prioritySampling.readRatesJSON(rc); err != nil {
+		t.config.statsd.Incr("datadog.tracer.decode_error", nil, 1)
+	} else if rates := t.prioritySampling.receivedRates(); rates != nil && t.config.samplingRatesHook != nil {
+		t.config.samplingRatesHook(rates)
+	}
+	return true
+}
+
+// sendQueued attempts to send the payloads held in the retry queue. Payloads which
+// fail again are queued back, unless the tracer is stopping, in which case they are
+// dropped. When stopping, payloads still queued after retryQueueDrainTimeout or
+// after the stop timed out are dropped without being sent, so that shutdown is
+// not held up.
+func (t *tracer) sendQueued() {
+	if t.retryQueue == nil {
+		return
+	}
+	deadline := time.Now().Add(retryQueueDrainTimeout)
+	for _, p := range t.retryQueue.popAll() {
+		if t.abandoned() {
+			t.recordDrop(dropReasonStopTimeout, int64(p.itemCount()))
+			continue
+		}
+		if t.stopping() && time.Now().After(deadline) {
+			t.recordDrop(dropReasonSendFailed, int64(p.itemCount()))
+			log.Error("lost %d traces: retry queue drain timed out", p.itemCount())
+			continue
+		}
+		t.send(p)
+	}
+}
+
+// sendErrorLog coalesces the logs reporting failed sends, so that an unreachable
+// agent results in at most one log of each kind every sendErrorLogInterval rather
+// than one per flush. The traces_dropped metric is unaffected.
+type sendErrorLog struct {
+	mu      sync.Mutex
+	lost    coalescedLog // traces lost to failed sends
+	retried coalescedLog // traces queued for retry after failed sends
+	evict   coalescedLog // traces evicted from the full retry queue
+}
+
+// coalescedLog counts the events reported by a log between two of its lines.
+type coalescedLog struct {
+	last   time.Time // time of the most recent log
+	traces int       // traces involved since the most recent log
+	events int       // events since the most recent log
+}
+
+// add records an event involving count traces at now. If at least
+// sendErrorLogInterval has passed since the most recent log, it reports true along
+// with the traces and events to log, which are then reset.
+func (c *coalescedLog) add(now time.Time, count int) (traces, events int, ok bool) {
+	c.traces += count
+	c.events++
+	if now.Sub(c.last) < sendErrorLogInterval {
+		return 0, 0, false
+	}
+	traces, events = c.traces, c.events
+	c.last = now
+	c.traces, c.events = 0, 0
+	return traces, events, true
+}
+
+// record records the count traces of the payload with the given id and size as
+// lost due to err, logging the traces lost since the most recent log if at least
+// sendErrorLogInterval has passed since.
+func (l *sendErrorLog) record(id string, size, count int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if traces, failures, ok := l.lost.add(time.Now(), count); ok {
+		log.Error("lost %d traces over the last %d failed flushes; last failure (request ID %s, %d bytes, %d traces): %v",
+			traces, failures, id, size, count, err)
+	}
+}
+
+// queued records the count traces of a payload as queued for retry after failing
+// to send due to err, logging them like record.
+func (l *sendErrorLog) queued(count int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if traces, failures, ok := l.retried.add(time.Now(), count); ok {
+		log.Warn("failed to send %d traces over the last %d flushes, queued for retry; last failure: %v", traces, failures, err)
+	}
+}
+
+// evicted records the count traces of a payload as lost after being evicted from
+// the full retry queue, logging them like record.
+func (l *sendErrorLog) evicted(count int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if traces, evictions, ok := l.evict.add(time.Now(), count); ok {
+		log.Error("retry queue full, lost %d traces over the last %d evictions", traces, evictions)
+	}
+}
+
+// breakerState specifies the state of a circuitBreaker.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // sends are let through
+	breakerOpen                         // sends are paused
+	breakerHalfOpen                     // a probing send is in progress
+)
+
+// circuitBreaker pauses sends to the agent for a cooldown period after a number of
+// consecutive failures. Once the cooldown elapses, a single probing send is let
+// through, whose outcome decides whether sends resume or are paused again. It is
+// safe for concurrent use. A nil *circuitBreaker lets all sends through.
+type circuitBreaker struct {
+	threshold int           // consecutive failures pausing sends
+	cooldown  time.Duration // duration of the pause
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // consecutive failed sends
+	openedAt time.Time // time at which sends were last paused
+}
+
+// newCircuitBreaker returns a circuitBreaker pausing sends for cooldown after
+// threshold consecutive failures.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a send may be attempted at now. The outcome of allowed
+// sends must be passed to record.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// record records the outcome of a send completed at now.
+func (b *circuitBreaker) record(ok bool, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		if b.state != breakerClosed {
+			log.Info("Agent is reachable again, resuming sends.")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	switch b.state {
+	case breakerClosed:
+		if b.failures < b.threshold {
+			return
+		}
+		log.Warn("Pausing sends for %s after %d consecutive failures.", b.cooldown, b.failures)
+	case breakerOpen:
+		// a send started before the pause; keep the current cooldown
+		return
+	}
+	b.state = breakerOpen
+	b.openedAt = now
+}
+
+// healthWindow specifies the period over which HealthStatus.DropRate is computed.
+const healthWindow = time.Minute
+
+// healthBuckets specifies the number of buckets healthWindow is divided into.
+const healthBuckets = 6
+
+// healthTracker tracks the outcome of sends to the agent along with the number
+// of traces sent and dropped over a sliding window of healthWindow.
+type healthTracker struct {
+	mu          sync.Mutex
+	lastSuccess time.Time                   // time of the most recent successful send
+	failures    int                         // failed sends since lastSuccess
+	buckets     [healthBuckets]healthBucket // ring of per-interval counts
+}
+
+// healthBucket holds the number of traces sent and dropped during one
+// healthWindow/healthBuckets interval.
+type healthBucket struct {
+	interval      int64 // index of the interval since epoch
+	sent, dropped int64
+}
+
+// bucket returns the bucket for the interval containing now, resetting it if it
+// last held counts for an earlier interval. h.mu must be held.
+func (h *healthTracker) bucket(now time.Time) *healthBucket {
+	i := now.UnixNano() / int64(healthWindow/healthBuckets)
+	b := &h.buckets[i%healthBuckets]
+	if b.interval != i {
+		*b = healthBucket{interval: i}
+	}
+	return b
+}
+
+// success records the successful send of the given number of traces at now.
+func (h *healthTracker) success(now time.Time, traces int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess = now
+	h.failures = 0
+	h.bucket(now).sent += int64(traces)
+}
+
+// failure records a failed send. The traces it held are recorded separately,
+// through dropped, once they are given up on.
+func (h *healthTracker) failure() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+}
+
+// dropped records the given number of traces as dropped at now.
+func (h *healthTracker) dropped(now time.Time, traces int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bucket(now).dropped += traces
+}
+
+// status returns the health as of now.
+func (h *healthTracker) status(now time.Time) HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := HealthStatus{
+		LastFlushSuccess:    h.lastSuccess,
+		ConsecutiveFailures: h.failures,
+	}
+	var sent, dropped int64
+	i := now.UnixNano() / int64(healthWindow/healthBuckets)
+	for _, b := range h.buckets {
+		if b.interval > i-healthBuckets && b.interval <= i {
+			sent += b.sent
+			dropped += b.dropped
+		}
+	}
+	if sent+dropped > 0 {
+		status.DropRate = float64(dropped) / float64(sent+dropped)
+	}
+	return status
+}
+
+// stopping reports whether the tracer has been asked to stop.
+func (t *tracer) stopping() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendPayload sends p using the configured transport. Sends failing due to network
+// errors or 5xx responses are retried up to sendAttempts times in total, using an
+// exponential backoff with jitter. Retries are abandoned once the tracer is stopped
+// or when they would exceed sendRetryTimeout. The caller holds a climit slot for
+// the whole duration, so retries do not increase the number of connections. Each
+// attempt is aborted after the send timeout, in which case a *sendTimeoutError is
+// returned without retrying.
+func (t *tracer) sendPayload(p *payload) (io.ReadCloser, error) {
+	start := time.Now()
+	delay := sendRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		if t.dumper != nil {
+			if err := t.dumper.dump(p); err != nil {
+				log.Warn("Unable to dump payload %s: %v", p.id, err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(t.sendCtx, t.config.sendTimeout)
+		rc, err := t.config.transport.send(ctx, p)
+		if err == nil {
+			return cancelOnClose{ReadCloser: rc, cancel: cancel}, nil
+		}
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut {
+			return nil, &sendTimeoutError{timeout: t.config.sendTimeout, err: err}
+		}
+		if p.compressed() && isStatus(err, http.StatusBadRequest, http.StatusUnsupportedMediaType) {
+			log.Warn("Agent rejected compressed payload (%v), disabling payload compression.", err)
+			atomic.StoreUint32(&t.compressionRejected, 1)
+			p.decompress()
+			p.rewind()
+			continue
+		}
+		if attempt >= sendAttempts || !isRetriable(err) {
+			return nil, err
+		}
+		// wait between delay/2 and delay
+		wait := delay/2 + time.Duration(t.random.Int63n(int64(delay/2)+1))
+		if time.Since(start)+wait > sendRetryTimeout {
+			return nil, err
+		}
+		select {
+		case <-time.After(wait):
+		case <-t.stop:
+			return nil, err
+		}
+		delay *= 2
+		p.rewind()
+		t.config.statsd.Incr("datadog.tracer.flush_retries", []string{"attempt:" + strconv.Itoa(attempt+1)}, 1)
+		log.Debug("Retrying payload send (attempt %d) after error: %v", attempt+1, err)
+	}
+}
+
+// sendErrorTags returns the tags of the send_errors metric for a send which failed
+// with err, classifying it with a bounded set of values: the payload's request ID is
+// only logged, so as not to make a new metric context for every failed send.
+func sendErrorTags(err error) []string {
+	switch err := err.(type) {
+	case *sendTimeoutError:
+		return []string{"error:timeout"}
+	case *statusError:
+		return []string{"error:status", "status_code:" + strconv.Itoa(err.code)}
+	default:
+		return []string{"error:network"}
+	}
+}
+
+// sendTimeoutError is returned by sendPayload when an attempt at sending a payload
+// exceeds the send timeout.
+type sendTimeoutError struct {
+	timeout time.Duration // the send timeout
+	err     error         // the error returned by the aborted send
+}
+
+func (e *sendTimeoutError) Error() string {
+	return fmt.Sprintf("send timed out after %s: %v", e.timeout, e.err)
+}
+
+// cancelOnClose cancels the context of a send once its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// fetchAgentInfo returns the response of the agent's /info endpoint, requesting it
+// on the first call using the transport's warmup. It returns nil if the transport
+// can not request it or the agent does not serve it. Failed requests are retried
+// on the next call.
+func (t *tracer) fetchAgentInfo() (*agentInfo, error) {
+	w, ok := t.config.transport.(warmer)
+	if !ok {
+		return nil, nil
+	}
+	t.agentInfoMu.Lock()
+	defer t.agentInfoMu.Unlock()
+	if !t.agentInfoFetched {
+		info, err := w.warmup()
+		if err != nil {
+			return nil, err
+		}
+		t.agentInfo, t.agentInfoFetched = info, true
+	}
+	return t.agentInfo, nil
+}
+
+// compress compresses p if payload compression is enabled, p is large enough and
+// the agent's /info response shows that it accepts compressed payloads. On failure,
+// p is left uncompressed.
+func (t *tracer) compress(p *payload) {
+	min := t.config.compressionThreshold
+	if min <= 0 || p.compressed() || p.size() < min || atomic.LoadUint32(&t.compressionRejected) == 1 {
+		return
+	}
+	if info, _ := t.fetchAgentInfo(); info == nil || !info.supportsCompression() {
+		return
+	}
+	if err := p.compress(); err != nil {
+		log.Error("error compressing payload: %v", err)
+		p.decompress()
+	}
+}
+
+// pushPayload pushes the trace onto the payload. If the payload becomes
+// larger than the threshold as a result, it sends a flush request.
+func (t *tracer) pushPayload(trace []*span) {
+	atomic.AddInt64(&t.spansAdded, int64(len(trace)))
+	t.summary.add(1)
+	deliveries := t.priorityDeliveries(trace)
+	if deliveries != nil {
+		defer func() {
+			// the trace was not buffered
+			for _, ch := range deliveries {
+				ch <- false
+			}
+		}()
+	}
+	if t.isPaused() {
+		t.recordDrop(dropReasonPaused, 1)
+		t.notifyDrop(dropReasonPaused, len(trace))
+		return
+	}
+	if t.seenSpans != nil {
+		var skipped int
+		trace, skipped = t.dedupSpans(trace)
+		if skipped > 0 {
+			t.config.statsd.Count("datadog.tracer.dedup_skipped", int64(skipped), nil, 1)
+		}
+		if len(trace) == 0 {
+			return
+		}
+	}
+	if !t.config.passInvalidIDs && hasInvalidID(trace) {
+		t.recordDrop(dropReasonInvalidID, 1)
+		t.notifyDrop(dropReasonInvalidID, len(trace))
+		return
+	}
+	if len(t.config.writeTags) > 0 {
+		setWriteTags(trace, t.config.writeTags)
+	}
+	normalizeMeasured(trace)
+	// filter the spans before sanitizing them, so that redacted values are not
+	// counted as truncated or invalid, and filtered spans cost nothing more
+	if t.config.spanRedactor != nil || t.config.spanFilter != nil {
+		var filtered int
+		trace, filtered = filterSpans(trace, t.config.spanRedactor, t.config.spanFilter)
+		if len(trace) == 0 {
+			t.recordDrop(dropReasonFiltered, 1)
+			t.notifyDrop(dropReasonFiltered, filtered)
+			return
+		}
+	}
+	if t.config.exportFunc != nil {
+		spans := make([]Span, len(trace))
+		for i, s := range trace {
+			spans[i] = s
+		}
+		t.config.exportFunc(spans)
+		for _, ch := range deliveries {
+			ch <- true
+		}
+		deliveries = nil
+		return
+	}
+	if limit := t.config.maxMemory; limit > 0 && t.pendingBytes() >= int64(limit) {
+		rank := rankTrace(trace)
+		if !t.evictLowerRanks(t.payloadFor(trace), rank, int64(limit)) {
+			t.recordPriorityDrop(dropReasonMemoryLimit, rank.priority, 1)
+			t.notifyDrop(dropReasonMemoryLimit, len(trace))
+			return
+		}
+	}
+	if t.config.maxTagValueLength > 0 {
+		truncateTags(trace, t.config.maxTagValueLength)
+	}
+	if t.config.maxTagsPerSpan > 0 {
+		// after truncation, so that its marker counts towards the limit
+		if n := capTags(trace, t.config.maxTagsPerSpan); n > 0 {
+			t.config.statsd.Count("datadog.tracer.tags_truncated", int64(n), nil, 1)
+		}
+	}
+	if t.config.validateUTF8 {
+		policy := t.config.invalidUTF8Policy
+		var invalid int
+		trace, invalid = validateUTF8(trace, policy)
+		if invalid > 0 {
+			t.config.statsd.Count("datadog.tracer.invalid_utf8", int64(invalid), []string{"policy:" + policy.String()}, 1)
+		}
+		if len(trace) == 0 {
+			t.recordDrop(dropReasonInvalidUTF8, 1)
+			t.notifyDrop(dropReasonInvalidUTF8, invalid)
+			return
+		}
+	}
+	if policy := t.config.emptyResourcePolicy; policy != EmptyResourceKeep {
+		var empty int
+		trace, empty = handleEmptyResources(trace, policy)
+		if empty > 0 {
+			t.config.statsd.Count("datadog.tracer.empty_resource", int64(empty), []string{"policy:" + policy.String()}, 1)
+		}
+		if len(trace) == 0 {
+			t.recordDrop(dropReasonEmptyResource, 1)
+			t.notifyDrop(dropReasonEmptyResource, empty)
+			return
+		}
+	}
+	p := t.payloadFor(trace)
+	start := time.Now()
+	outcome := "outcome:success"
+	b, err := p.encode(trace)
+	if err != nil {
+		outcome = "outcome:error"
+		t.recordEncodingDrop(err)
+		t.notifyDrop(dropReasonEncodingError, len(trace))
+		log.Error("error encoding msgpack: %v", err)
+	}
+	t.config.statsd.Timing("datadog.tracer.encode_duration", time.Since(start), []string{outcome}, t.config.metricsSampleRate)
+	t.config.statsd.Histogram("datadog.tracer.spans_per_trace", float64(len(trace)), nil, t.config.metricsSampleRate)
+	if err == nil {
+		switch max := t.config.payloadMaxSize; {
+		case len(b)+len(p.header) > max:
+			// the trace alone would be rejected by the agent
+			t.recordDrop(dropReasonTraceTooLarge, 1)
+			t.notifyDrop(dropReasonTraceTooLarge, len(trace))
+			log.Error("dropping trace of %d bytes, exceeding the maximum payload size of %d bytes", len(b), max)
+		case p.sizeWith(len(b)) > max:
+			// send the buffered traces first, so that the payload stays below the maximum
+			t.flushFull(p)
+			p = t.payloadFor(trace)
+			fallthrough
+		default:
+			if traces, _ := t.buffered(); traces == 0 {
+				t.heldSince = time.Now()
+			}
+			p.pushEncoded(trace, b)
+			if t.acks != nil {
+				p.seqs = append(p.seqs, t.acks.assign())
+			}
+			if deliveries != nil {
+				p.deliveries = append(p.deliveries, deliveries...)
+				deliveries = nil
+				t.flushNow(p, flushReasonPriority)
+				return
+			}
+		}
+	}
+	t.updateBufferStats()
+	if p.size() > t.config.payloadSizeLimit {
+		t.flushFull(p)
+	} else if t.aged(time.Now()) {
+		t.flush(flushReasonAge)
+	}
+}
+
+// flushFull flushes the payload p, which has reached its size limit.
+func (t *tracer) flushFull(p *payload) { t.flushNow(p, flushReasonSize) }
+
+// flushNow flushes the payload p for the given reason.
+func (t *tracer) flushNow(p *payload, reason flushReason) {
+	if t.servicePayloads != nil {
+		t.flushService(p.service, reason)
+	} else {
+		t.flush(reason)
+	}
+}
+
+// priorityFlush holds the channels reporting the delivery of a trace marked using
+// FlushTrace, along with the time it was first marked.
+type priorityFlush struct {
+	marked     time.Time
+	deliveries []chan<- bool
+}
+
+// flushTrace marks the trace whose local root span has the given ID to be flushed
+// as soon as it is buffered, returning the channel reporting its delivery.
+func (t *tracer) flushTrace(rootSpanID uint64) <-chan bool {
+	ch := make(chan bool, 1)
+	t.priorityMu.Lock()
+	defer t.priorityMu.Unlock()
+	if t.stopping() {
+		ch <- false
+		return ch
+	}
+	pf, ok := t.priorityFlushes[rootSpanID]
+	if !ok {
+		if len(t.priorityFlushes) >= maxPriorityFlushes {
+			log.Debug("Not flushing trace %d, %d traces are already marked.", rootSpanID, len(t.priorityFlushes))
+			ch <- false
+			return ch
+		}
+		if t.priorityFlushes == nil {
+			t.priorityFlushes = make(map[uint64]*priorityFlush)
+		}
+		pf = &priorityFlush{marked: time.Now()}
+		t.priorityFlushes[rootSpanID] = pf
+	}
+	pf.deliveries = append(pf.deliveries, ch)
+	return ch
+}
+
+// expirePriorityFlushes reports the traces marked using FlushTrace before now minus
+// priorityFlushTimeout as not delivered, and forgets them. A zero now expires all of
+// them, e.g. when stopping.
+func (t *tracer) expirePriorityFlushes(now time.Time) {
+	t.priorityMu.Lock()
+	defer t.priorityMu.Unlock()
+	for id, pf := range t.priorityFlushes {
+		if now.IsZero() || now.Sub(pf.marked) >= priorityFlushTimeout {
+			for _, ch := range pf.deliveries {
+				ch <- false
+			}
+			delete(t.priorityFlushes, id)
+		}
+	}
+}
+
+// failPriorityFlush reports trace as not delivered if it was marked using FlushTrace.
+func (t *tracer) failPriorityFlush(trace []*span) {
+	for _, ch := range t.priorityDeliveries(trace) {
+		ch <- false
+	}
+}
+
+// failDeliveries reports the traces of p marked using FlushTrace as not delivered,
+// when p is discarded without being sent.
+func failDeliveries(p *payload) {
+	for _, ch := range p.deliveries {
+		ch <- false
+	}
+	p.deliveries = nil
+}
+
+// priorityDeliveries removes and returns the channels reporting the delivery of
+// trace if it was marked using FlushTrace, or nil otherwise.
+func (t *tracer) priorityDeliveries(trace []*span) []chan<- bool {
+	if len(trace) == 0 {
+		return nil
+	}
+	t.priorityMu.Lock()
+	defer t.priorityMu.Unlock()
+	if len(t.priorityFlushes) == 0 {
+		return nil
+	}
+	id := trace[0].SpanID
+	pf, ok := t.priorityFlushes[id]
+	if !ok {
+		return nil
+	}
+	delete(t.priorityFlushes, id)
+	return pf.deliveries
+}
+
+// traceRank orders traces by how much they are worth keeping when some must be
+// dropped: by sampling priority, then traces with errors above those without.
+type traceRank struct {
+	priority int  // sampling priority of the trace
+	errored  bool // whether any span of the trace has an error
+}
+
+// less reports whether r ranks below o.
+func (r traceRank) less(o traceRank) bool {
+	if r.priority != o.priority {
+		return r.priority < o.priority
+	}
+	return !r.errored && o.errored
+}
+
+// rankTrace returns the rank of trace. Traces without a sampling priority rank
+// as if they were kept by the sampler.
+func rankTrace(trace []*span) traceRank {
+	r := traceRank{priority: ext.PriorityAutoKeep}
+	var prioritized bool
+	for _, s := range trace {
+		s.RLock()
+		if p, ok := s.Metrics[keySamplingPriority]; ok && !prioritized {
+			r.priority = int(p)
+			prioritized = true
+		}
+		if s.Error != 0 {
+			r.errored = true
+		}
+		s.RUnlock()
+	}
+	return r
+}
+
+// evictLowerRanks makes room for a trace of the given rank once the memory budget
+// of limit bytes is used up, by dropping the traces buffered in p which rank below
+// it, lowest and oldest first. It reports whether enough room was made; if not, no
+// trace is dropped.
+func (t *tracer) evictLowerRanks(p *payload, rank traceRank, limit int64) bool {
+	excess := t.pendingBytes() - limit + 1
+	ranks := make([]traceRank, len(p.traces))
+	var evictable int64
+	for i, trace := range p.traces {
+		ranks[i] = rankTrace(trace)
+		if ranks[i].less(rank) {
+			evictable += int64(p.sizes[i])
+		}
+	}
+	if evictable < excess {
+		return false
+	}
+	for excess > 0 {
+		min := -1
+		for i, r := range ranks {
+			if r.less(rank) && (min < 0 || r.less(ranks[min])) {
+				min = i
+			}
+		}
+		excess -= int64(p.sizes[min])
+		t.recordPriorityDrop(dropReasonMemoryLimit, ranks[min].priority, 1)
+		t.notifyDrop(dropReasonMemoryLimit, len(p.traces[min]))
+		p.remove(min)
+		ranks = append(ranks[:min], ranks[min+1:]...)
+	}
+	t.updateBufferStats()
+	return true
+}
+
+// hasInvalidID reports whether any span of trace has a zero trace or span ID.
+func hasInvalidID(trace []*span) bool {
+	for _, s := range trace {
+		if s.TraceID == 0 || s.SpanID == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupSpans removes from trace the spans whose ID was seen since the last flush,
+// remembering the IDs of the others while fewer than dedupSize are. It returns the
+// resulting trace along with the number of removed spans.
+func (t *tracer) dedupSpans(trace []*span) ([]*span, int) {
+	var (
+		skipped int
+		kept    []*span // spans kept, once a span was skipped
+	)
+	for i, s := range trace {
+		if _, ok := t.seenSpans[s.SpanID]; ok {
+			if kept == nil {
+				kept = append(make([]*span, 0, len(trace)-1), trace[:i]...)
+			}
+			skipped++
+			continue
+		}
+		if len(t.seenSpans) < t.config.dedupSize {
+			t.seenSpans[s.SpanID] = struct{}{}
+		}
+		if kept != nil {
+			kept = append(kept, s)
+		}
+	}
+	if kept != nil {
+		return kept, skipped
+	}
+	return trace, skipped
+}
+
+// normalizeMeasured makes the spans of trace which are marked as measured carry the
+// _dd.measured metric with a value of 1, as expected by the agent, whether they were
+// marked using the Measured option or by setting the tag to another value or type.
+// The tag is removed from the other spans.
+func normalizeMeasured(trace []*span) {
+	for _, s := range trace {
+		s.Lock()
+		v, inMeta := s.Meta[keyMeasured]
+		m, inMetrics := s.Metrics[keyMeasured]
+		if inMeta || inMetrics {
+			measured := m != 0
+			if inMeta {
+				b, err := strconv.ParseBool(v)
+				measured = measured || (err == nil && b)
+				delete(s.Meta, keyMeasured)
+			}
+			if measured {
+				if s.Metrics == nil {
+					s.Metrics = make(map[string]float64, 1)
+				}
+				s.Metrics[keyMeasured] = 1
+			} else {
+				delete(s.Metrics, keyMeasured)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// setWriteTags sets the given tags on the spans of trace which do not already
+// have a tag with the same key.
+func setWriteTags(trace []*span, tags map[string]string) {
+	for _, s := range trace {
+		s.Lock()
+		if s.Meta == nil {
+			s.Meta = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			if _, ok := s.Meta[k]; !ok {
+				s.Meta[k] = v
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// truncatedSuffix is appended to the tag values truncated by truncateTags.
+const truncatedSuffix = "..."
+
+// truncateTags truncates the tag values of the spans of trace which are longer than
+// max bytes to at most max bytes, suffix included, listing the keys of the truncated
+// tags in the keyTruncatedTags tag.
+func truncateTags(trace []*span, max int) {
+	for _, s := range trace {
+		s.Lock()
+		var truncated []string
+		for k, v := range s.Meta {
+			if len(v) > max {
+				if max > len(truncatedSuffix) {
+					s.Meta[k] = truncateUTF8(v, max-len(truncatedSuffix)) + truncatedSuffix
+				} else {
+					// no room for the suffix
+					s.Meta[k] = truncateUTF8(v, max)
+				}
+				truncated = append(truncated, k)
+			}
+		}
+		if len(truncated) > 0 {
+			sort.Strings(truncated)
+			s.Meta[keyTruncatedTags] = strings.Join(truncated, ",")
+		}
+		s.Unlock()
+	}
+}
+
+// capTags removes the string tags of the spans of trace having more than max of them,
+// keeping the first keys in sorted order so that, along with the keyTagsTruncated tag
+// and the keyTruncatedTags tag set by truncateTags, spans hold at most max tags. It
+// returns the number of removed tags.
+func capTags(trace []*span, max int) int {
+	var removed int
+	for _, s := range trace {
+		s.Lock()
+		if len(s.Meta) > max {
+			keep := max - 1 // room for keyTagsTruncated
+			truncated, hasTruncated := s.Meta[keyTruncatedTags]
+			if hasTruncated {
+				delete(s.Meta, keyTruncatedTags)
+				keep--
+			}
+			if keep < 0 {
+				// no room for keyTruncatedTags
+				hasTruncated = false
+				keep = 0
+			}
+			keys := make([]string, 0, len(s.Meta))
+			for k := range s.Meta {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys[keep:] {
+				delete(s.Meta, k)
+			}
+			n := len(keys) - keep
+			s.Meta[keyTagsTruncated] = strconv.Itoa(n)
+			removed += n
+			if hasTruncated {
+				// only list the truncated tags which were kept
+				var kept []string
+				for _, k := range strings.Split(truncated, ",") {
+					if _, ok := s.Meta[k]; ok {
+						kept = append(kept, k)
+					}
+				}
+				if len(kept) > 0 {
+					s.Meta[keyTruncatedTags] = strings.Join(kept, ",")
+				}
+			}
+		}
+		s.Unlock()
+	}
+	return removed
+}
+
+// truncateUTF8 truncates s to at most n bytes, without splitting a UTF-8 encoded
+// character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// validateUTF8 applies policy to the spans of trace having string fields which are
+// not valid UTF-8, returning the resulting trace along with the number of such spans.
+func validateUTF8(trace []*span, policy InvalidUTF8Policy) ([]*span, int) {
+	var (
+		invalid int
+		kept    []*span // spans kept, once a span was dropped
+	)
+	for i, s := range trace {
+		s.Lock()
+		valid := validSpanUTF8(s)
+		if !valid && policy == InvalidUTF8Sanitize {
+			sanitizeSpanUTF8(s)
+		}
+		s.Unlock()
+		switch {
+		case !valid && policy == InvalidUTF8Drop:
+			if kept == nil {
+				kept = append(make([]*span, 0, len(trace)-1), trace[:i]...)
+			}
+		case kept != nil:
+			kept = append(kept, s)
+		}
+		if !valid {
+			invalid++
+		}
+	}
+	if kept != nil {
+		return kept, invalid
+	}
+	return trace, invalid
+}
+
+// handleEmptyResources applies policy to the spans of trace having an empty resource
+// name. It returns the spans kept and the number of spans having an empty resource.
+func handleEmptyResources(trace []*span, policy EmptyResourcePolicy) ([]*span, int) {
+	var (
+		empty int
+		kept  []*span // spans kept, once a span was dropped
+	)
+	for i, s := range trace {
+		s.Lock()
+		isEmpty := s.Resource == ""
+		if isEmpty && policy == EmptyResourceBackfill {
+			s.Resource = s.Name
+		}
+		s.Unlock()
+		switch {
+		case isEmpty && policy == EmptyResourceDrop:
+			if kept == nil {
+				kept = append(make([]*span, 0, len(trace)-1), trace[:i]...)
+			}
+		case kept != nil:
+			kept = append(kept, s)
+		}
+		if isEmpty {
+			empty++
+		}
+	}
+	if kept != nil {
+		return kept, empty
+	}
+	return trace, empty
+}
+
+// filterSpans applies redact, then filter, to each span of trace, either of which
+// may be nil. It returns the spans accepted by filter and the number of rejected spans.
+func filterSpans(trace []*span, redact func(*SpanData), filter func(*SpanData) bool) ([]*span, int) {
+	var (
+		filtered int
+		kept     []*span // spans kept, once a span was filtered
+	)
+	for i, s := range trace {
+		d := s.data()
+		if redact != nil {
+			redact(&d)
+			s.setData(&d)
+		}
+		switch {
+		case filter != nil && !filter(&d):
+			filtered++
+			if kept == nil {
+				kept = append(make([]*span, 0, len(trace)-1), trace[:i]...)
+			}
+		case kept != nil:
+			kept = append(kept, s)
+		}
+	}
+	if kept != nil {
+		return kept, filtered
+	}
+	return trace, filtered
+}
+
+// validSpanUTF8 reports whether the string fields and tags of s are valid UTF-8.
+func validSpanUTF8(s *span) bool {
+	if !utf8.ValidString(s.Name) || !utf8.ValidString(s.Service) || !utf8.ValidString(s.Resource) || !utf8.ValidString(s.Type) {
+		return false
+	}
+	for k, v := range s.Meta {
+		if !utf8.ValidString(k) || !utf8.ValidString(v) {
+			return false
+		}
+	}
+	for k := range s.Metrics {
+		if !utf8.ValidString(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeSpanUTF8 replaces the invalid UTF-8 in the string fields and tags of s.
+func sanitizeSpanUTF8(s *span) {
+	s.Name = toValidUTF8(s.Name)
+	s.Service = toValidUTF8(s.Service)
+	s.Resource = toValidUTF8(s.Resource)
+	s.Type = toValidUTF8(s.Type)
+	for k, v := range s.Meta {
+		if !utf8.ValidString(k) || !utf8.ValidString(v) {
+			delete(s.Meta, k)
+			s.Meta[toValidUTF8(k)] = toValidUTF8(v)
+		}
+	}
+	for k, v := range s.Metrics {
+		if !utf8.ValidString(k) {
+			delete(s.Metrics, k)
+			s.Metrics[toValidUTF8(k)] = v
+		}
+	}
+}
+
+// toValidUTF8 returns s with each byte which is not part of a valid UTF-8 encoded
+// character replaced with U+FFFD.
+func toValidUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 {
+			b.WriteRune(utf8.RuneError)
+		} else {
+			b.WriteString(s[:size])
+		}
+		s = s[size:]
 	}
+	return b.String()
 }
 
 // sampleRateMetricKey is the metric key holding the applied sample rate. Has to be the same as the Agent.
@@ -6,15 +6,22 @@
 package tracer
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,6 +31,7 @@ import (
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/globalconfig"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 
+	"github.com/DataDog/datadog-go/statsd"
 	"github.com/stretchr/testify/assert"
 	"github.com/tinylib/msgp/msgp"
 )
@@ -218,6 +226,68 @@ func TestTracerStartSpan(t *testing.T) {
 	})
 }
 
+func TestTracerNormalizeMeasured(t *testing.T) {
+	for name, tt := range map[string]struct {
+		value    interface{}
+		measured bool
+	}{
+		"option":     {value: nil, measured: true},
+		"int":        {value: 1, measured: true},
+		"float":      {value: 2.0, measured: true},
+		"bool":       {value: true, measured: true},
+		"string":     {value: "1", measured: true},
+		"zero":       {value: 0, measured: false},
+		"false":      {value: false, measured: false},
+		"not-a-bool": {value: "yes", measured: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			tracer := newUnstartedTracer()
+			var s *span
+			if tt.value == nil {
+				s = tracer.StartSpan("op", Measured()).(*span)
+			} else {
+				s = tracer.StartSpan("op", Tag(keyMeasured, tt.value)).(*span)
+			}
+			tracer.pushPayload([]*span{s})
+
+			assert.NotContains(s.Meta, keyMeasured)
+			if tt.measured {
+				assert.Equal(1.0, s.Metrics[keyMeasured])
+			} else {
+				assert.NotContains(s.Metrics, keyMeasured)
+			}
+		})
+	}
+
+	t.Run("unmeasured", func(t *testing.T) {
+		tracer := newUnstartedTracer()
+		s := tracer.StartSpan("op").(*span)
+		tracer.pushPayload([]*span{s})
+		assert.NotContains(t, s.Metrics, keyMeasured)
+		assert.NotContains(t, s.Meta, keyMeasured)
+	})
+
+	t.Run("extracted", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, flush, stop := startTestTracer(t)
+		defer stop()
+		ctx, err := tracer.Extract(TextMapCarrier(map[string]string{
+			DefaultTraceIDHeader:  "1",
+			DefaultParentIDHeader: "2",
+		}))
+		assert.Nil(err)
+		child := tracer.StartSpan("child", ChildOf(ctx))
+		child.SetTag(keyMeasured, true)
+		child.Finish()
+		flush(1)
+
+		traces := transport.Traces()
+		assert.Len(traces, 1)
+		assert.Equal(1.0, traces[0][0].Metrics[keyMeasured])
+	})
+}
+
 func TestTracerRuntimeMetrics(t *testing.T) {
 	t.Run("on", func(t *testing.T) {
 		tp := new(testLogger)
@@ -357,6 +427,28 @@ func TestStartSpanOrigin(t *testing.T) {
 	assert.Equal("synthetics", carrier2[originHeader])
 }
 
+func TestStartSpanTracestate(t *testing.T) {
+	assert := assert.New(t)
+	tracer := newTracer()
+	ctx, err := tracer.Extract(TextMapCarrier(map[string]string{
+		DefaultTraceIDHeader:  "1",
+		DefaultParentIDHeader: "1",
+		tracestateHeader:      "rojo=00f067aa0ba902b7",
+	}))
+	assert.Nil(err)
+	child := tracer.StartSpan("child", ChildOf(ctx)).(*span)
+	grandchild := tracer.StartSpan("grandchild", ChildOf(child.Context())).(*span)
+	other := tracer.StartSpan("other").(*span)
+
+	p := newPayload()
+	assert.NoError(p.push(spanList{child, grandchild, other}))
+	var got spanLists
+	assert.NoError(msgp.Decode(p, &got))
+	assert.Equal("rojo=00f067aa0ba902b7", got[0][0].Meta[keyTracestate])
+	assert.Equal("rojo=00f067aa0ba902b7", got[0][1].Meta[keyTracestate])
+	assert.NotContains(got[0][2].Meta, keyTracestate)
+}
+
 func TestPropagationDefaults(t *testing.T) {
 	assert := assert.New(t)
 
@@ -442,6 +534,588 @@ func TestTracerSpanGlobalTags(t *testing.T) {
 	assert.Equal("value", child.Meta["key"])
 }
 
+func TestTracerWriteTags(t *testing.T) {
+	assert := assert.New(t)
+	tracer, transport, flush, stop := startTestTracer(t,
+		WithGlobalTags(map[string]string{"region": "us-east-1", "cluster": "a"}),
+		WithGlobalTags(map[string]string{"cluster": "b"}),
+	)
+	defer stop()
+
+	root := tracer.StartSpan("web.request", Tag("region", "eu-west-1"))
+	tracer.StartSpan("db.query", ChildOf(root.Context())).Finish()
+	root.Finish()
+	flush(1)
+
+	traces := transport.Traces()
+	assert.Len(traces, 1)
+	assert.Len(traces[0], 2)
+	for _, s := range traces[0] {
+		assert.Equal("b", s.Meta["cluster"])
+		if s.Name == "web.request" {
+			assert.Equal("eu-west-1", s.Meta["region"])
+		} else {
+			assert.Equal("us-east-1", s.Meta["region"])
+		}
+	}
+}
+
+func TestTracerExportFunc(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		mu     sync.Mutex
+		traces [][]SpanData
+	)
+	tracer, transport, _, stop := startTestTracer(t, WithExportFunc(func(trace []Span) {
+		data := make([]SpanData, len(trace))
+		for i, s := range trace {
+			var ok bool
+			data[i], ok = SpanDataOf(s)
+			assert.True(ok)
+		}
+		mu.Lock()
+		traces = append(traces, data)
+		mu.Unlock()
+	}))
+	for i := 0; i < 100; i++ {
+		root := tracer.StartSpan("root", ResourceName(strconv.Itoa(i)))
+		child := tracer.StartSpan("child", ChildOf(root.Context()), Tag("key", "value"))
+		child.Finish()
+		root.Finish()
+	}
+	stop()
+
+	assert.Len(traces, 100)
+	seen := make(map[string]bool)
+	for _, trace := range traces {
+		assert.Len(trace, 2)
+		root, child := trace[0], trace[1]
+		assert.Equal("root", root.Name)
+		assert.Equal("child", child.Name)
+		assert.Equal(root.SpanID, child.ParentID)
+		assert.Equal(root.TraceID, child.TraceID)
+		assert.Equal("value", child.Meta["key"])
+		assert.False(seen[root.Resource])
+		seen[root.Resource] = true
+	}
+	assert.Equal(0, transport.Len())
+}
+
+func TestTracerValidateUTF8(t *testing.T) {
+	invalid := "a\xffb\xc3"
+	// newTrace returns a trace whose second span has invalid UTF-8 in a meta value.
+	newTrace := func() []*span {
+		root, child := newBasicSpan("root"), newBasicSpan("child")
+		child.Meta["key"] = invalid
+		return []*span{root, child}
+	}
+	// invalidCount returns the value of the invalid_utf8 metric, and its tags.
+	invalidCount := func(tg *testStatsdClient) (int64, []string) {
+		for _, c := range tg.CountCalls() {
+			if c.name == "datadog.tracer.invalid_utf8" {
+				return c.intVal, c.tags
+			}
+		}
+		return 0, nil
+	}
+
+	t.Run("sanitize", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), WithValidateUTF8(InvalidUTF8Sanitize))
+		trace := newTrace()
+		trace[0].Resource = invalid
+		trace[0].Meta[invalid] = "value"
+		tracer.pushPayload(trace)
+
+		traces := tracer.payload.traces
+		assert.Len(traces, 1)
+		assert.Len(traces[0], 2)
+		assert.Equal("a\ufffdb\ufffd", traces[0][0].Resource)
+		assert.Equal("value", traces[0][0].Meta["a\ufffdb\ufffd"])
+		assert.NotContains(traces[0][0].Meta, invalid)
+		assert.Equal("a\ufffdb\ufffd", traces[0][1].Meta["key"])
+		n, tags := invalidCount(&tg)
+		assert.Equal(int64(2), n)
+		assert.Equal([]string{"policy:sanitize"}, tags)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), WithValidateUTF8(InvalidUTF8Drop))
+		tracer.pushPayload(newTrace())
+
+		traces := tracer.payload.traces
+		assert.Len(traces, 1)
+		assert.Len(traces[0], 1)
+		assert.Equal("root", traces[0][0].Name)
+		n, tags := invalidCount(&tg)
+		assert.Equal(int64(1), n)
+		assert.Equal([]string{"policy:drop"}, tags)
+	})
+
+	t.Run("drop-trace", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), WithValidateUTF8(InvalidUTF8Drop))
+		trace := newTrace()[1:]
+		tracer.pushPayload(trace)
+
+		assert.Equal(0, tracer.payload.itemCount())
+		assert.Equal(int64(1), tg.Counts()["datadog.tracer.traces_dropped"])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg))
+		tracer.pushPayload(newTrace())
+
+		assert.Equal(invalid, tracer.payload.traces[0][1].Meta["key"])
+		n, _ := invalidCount(&tg)
+		assert.Equal(int64(0), n)
+	})
+}
+
+func TestTracerInvalidID(t *testing.T) {
+	// traces returns traces having, in turn, a span with a zero trace ID, a span
+	// with a zero span ID and valid spans only.
+	traces := func() [][]*span {
+		noTraceID, noSpanID := newBasicSpan("op"), newBasicSpan("op")
+		noTraceID.TraceID = 0
+		noSpanID.SpanID = 0
+		return [][]*span{
+			{newBasicSpan("root"), noTraceID},
+			{noSpanID},
+			{newBasicSpan("root"), newBasicSpan("child")},
+		}
+	}
+
+	t.Run("dropped", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		var dropped []int
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), WithDropHook(func(reason string, spans int) {
+			assert.Equal("invalid_id", reason)
+			dropped = append(dropped, spans)
+		}))
+		for _, trace := range traces() {
+			tracer.pushPayload(trace)
+		}
+		assert.Equal(1, tracer.payload.itemCount())
+		assert.Equal([]int{2, 1}, dropped)
+		for _, c := range tg.CountCalls() {
+			if c.name == "datadog.tracer.traces_dropped" {
+				assert.Equal([]string{"reason:invalid_id"}, c.tags)
+			}
+		}
+		assert.Equal(int64(2), tg.Counts()["datadog.tracer.traces_dropped"])
+	})
+
+	t.Run("passthrough", func(t *testing.T) {
+		tracer := newUnstartedTracer(WithInvalidIDPassthrough())
+		for _, trace := range traces() {
+			tracer.pushPayload(trace)
+		}
+		assert.Equal(t, 3, tracer.payload.itemCount())
+	})
+}
+
+func TestTracerEmptyResource(t *testing.T) {
+	// newTrace returns a trace having a span with a resource followed by a span
+	// without one.
+	newTrace := func() []*span {
+		return []*span{newSpan("root", "svc", "GET /", 1, 1, 0), newSpan("child", "svc", "", 2, 1, 1)}
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg))
+		tracer.pushPayload(newTrace())
+
+		assert.Equal(t, 2, tracer.payload.spans)
+		assert.Equal(t, "", tracer.payload.traces[0][1].Resource)
+		assert.NotContains(t, tg.Counts(), "datadog.tracer.empty_resource")
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), WithEmptyResourcePolicy(EmptyResourceDrop))
+		tracer.pushPayload(newTrace())
+		tracer.pushPayload([]*span{newSpan("op", "svc", "", 3, 3, 0)})
+
+		if assert.Equal(1, tracer.payload.itemCount()) {
+			trace := tracer.payload.traces[0]
+			assert.Len(trace, 1)
+			assert.Equal("root", trace[0].Name)
+		}
+		assert.Equal(int64(2), tg.Counts()["datadog.tracer.empty_resource"])
+		assert.Equal(int64(1), tg.Counts()["datadog.tracer.traces_dropped"])
+		for _, c := range tg.CountCalls() {
+			switch c.name {
+			case "datadog.tracer.empty_resource":
+				assert.Equal([]string{"policy:drop"}, c.tags)
+			case "datadog.tracer.traces_dropped":
+				assert.Equal([]string{"reason:empty_resource"}, c.tags)
+			}
+		}
+	})
+
+	t.Run("backfill", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), WithEmptyResourcePolicy(EmptyResourceBackfill))
+		tracer.pushPayload(newTrace())
+
+		trace := tracer.payload.traces[0]
+		assert.Equal("GET /", trace[0].Resource)
+		assert.Equal("child", trace[1].Resource)
+		assert.Equal(int64(1), tg.Counts()["datadog.tracer.empty_resource"])
+		assert.NotContains(tg.Counts(), "datadog.tracer.traces_dropped")
+	})
+}
+
+func TestTracerSpanFilter(t *testing.T) {
+	// newTrace returns a trace whose second span has a secret tag.
+	newTrace := func() []*span {
+		root, child := newBasicSpan("root"), newBasicSpan("child")
+		child.Meta["password"] = "hunter2"
+		return []*span{root, child}
+	}
+	redact := func(s *SpanData) {
+		if _, ok := s.Meta["password"]; ok {
+			s.Meta["password"] = "?"
+		}
+	}
+
+	t.Run("redact", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithSpanRedactor(redact))
+		tracer.pushPayload(newTrace())
+
+		traces := tracer.payload.traces
+		assert.Len(traces, 1)
+		assert.Len(traces[0], 2)
+		assert.Equal("?", traces[0][1].Meta["password"])
+		assert.NotContains(traces[0][0].Meta, "password")
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithSpanFilter(func(s *SpanData) bool {
+			return s.Name != "child"
+		}))
+		tracer.pushPayload(newTrace())
+
+		traces := tracer.payload.traces
+		assert.Len(traces, 1)
+		assert.Len(traces[0], 1)
+		assert.Equal("root", traces[0][0].Name)
+	})
+
+	t.Run("order", func(t *testing.T) {
+		assert := assert.New(t)
+		var seen []string
+		tracer := newUnstartedTracer(
+			WithSpanFilter(func(s *SpanData) bool {
+				seen = append(seen, s.Meta["password"])
+				return s.Meta["password"] != "?"
+			}),
+			WithSpanRedactor(redact),
+		)
+		tracer.pushPayload(newTrace())
+
+		// the filter sees the redacted spans
+		assert.Equal([]string{"", "?"}, seen)
+		assert.Len(tracer.payload.traces[0], 1)
+	})
+
+	t.Run("before-sanitization", func(t *testing.T) {
+		assert := assert.New(t)
+		var (
+			tg   testStatsdClient
+			seen []string
+		)
+		tracer := newUnstartedTracer(
+			WithStatsdClient(&tg),
+			WithMaxTagValueLength(5),
+			WithSpanRedactor(func(s *SpanData) {
+				seen = append(seen, s.Meta["password"])
+				if _, ok := s.Meta["password"]; ok {
+					s.Meta["password"] = "?"
+				}
+			}),
+		)
+		trace := newTrace()
+		trace[1].Meta["password"] = "hunter2hunter2"
+		tracer.pushPayload(trace)
+
+		// the redactor sees the original value, and the redacted one is not
+		// truncated
+		assert.Equal([]string{"", "hunter2hunter2"}, seen)
+		assert.Equal("?", tracer.payload.traces[0][1].Meta["password"])
+		assert.NotContains(tracer.payload.traces[0][1].Meta, keyTruncatedTags)
+		assert.Zero(tg.Counts()["datadog.tracer.tags_truncated"])
+	})
+
+	t.Run("drop-trace", func(t *testing.T) {
+		assert := assert.New(t)
+		var (
+			tg      testStatsdClient
+			dropped []string
+		)
+		tracer := newUnstartedTracer(
+			WithStatsdClient(&tg),
+			WithSpanFilter(func(*SpanData) bool { return false }),
+			WithDropHook(func(reason string, spans int) {
+				dropped = append(dropped, fmt.Sprintf("%s:%d", reason, spans))
+			}),
+		)
+		tracer.pushPayload(newTrace())
+
+		assert.Equal(0, tracer.payload.itemCount())
+		assert.Equal([]string{"filtered:2"}, dropped)
+		calls := tg.CountCalls()
+		assert.Len(calls, 1)
+		assert.Equal([]string{"reason:filtered"}, calls[0].tags)
+	})
+}
+
+func TestTracerPayloadPresize(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	tracer := newUnstartedTracer(WithStatsdClient(&tg), withTransport(newDummyTransport()))
+	// fill pushes n traces into the payload and flushes it, returning its size.
+	fill := func(n int) int {
+		for i := 0; i < n; i++ {
+			tracer.pushPayload([]*span{newBasicSpan("root"), newBasicSpan("child")})
+		}
+		size := tracer.payload.buf.Len()
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+		return size
+	}
+
+	assert.Equal(0, tracer.payload.buf.Cap())
+	size := fill(100)
+	assert.True(tg.Counts()["datadog.tracer.payload_buffer_grows"] > 0)
+	assert.True(tracer.payload.buf.Cap() >= size)
+
+	// a payload of the same size does not grow its buffer
+	grows := tg.Counts()["datadog.tracer.payload_buffer_grows"]
+	fill(100)
+	assert.Equal(grows, tg.Counts()["datadog.tracer.payload_buffer_grows"])
+
+	// the capacity follows the size of the payloads flushed recently
+	for i := 0; i < 20; i++ {
+		fill(10)
+	}
+	assert.True(tracer.payload.buf.Cap() < size/2)
+
+	// the capacity does not exceed the payload size limit
+	tracer = newUnstartedTracer(withTransport(newDummyTransport()), WithPayloadSizeLimit(1000))
+	for i := 0; i < 100; i++ {
+		tracer.pushPayload([]*span{newBasicSpan("root"), newBasicSpan("child")})
+	}
+	tracer.wg.Wait()
+	assert.Equal(1000, tracer.sizer.capacity())
+
+	// payloads segregated by service are not presized
+	tracer = newUnstartedTracer(withTransport(newDummyTransport()), WithPayloadPerService())
+	for i := 0; i < 100; i++ {
+		tracer.pushPayload([]*span{newBasicSpan("root")})
+	}
+	tracer.flush(flushReasonScheduled)
+	tracer.wg.Wait()
+	assert.True(tracer.sizer.capacity() > 0)
+	assert.Equal(0, tracer.emptyPayload().buf.Cap())
+}
+
+func TestTracerSpanDedup(t *testing.T) {
+	newSpanWithID := func(id uint64) *span {
+		s := newBasicSpan("op")
+		s.SpanID = id
+		return s
+	}
+	// spanIDs returns the IDs of the spans buffered by tracer.
+	spanIDs := func(tracer *tracer) []uint64 {
+		var ids []uint64
+		for _, trace := range tracer.payload.traces {
+			for _, s := range trace {
+				ids = append(ids, s.SpanID)
+			}
+		}
+		return ids
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), withTransport(newDummyTransport()), WithSpanDedup(100))
+		tracer.pushPayload([]*span{newSpanWithID(1), newSpanWithID(2)})
+		tracer.pushPayload([]*span{newSpanWithID(2), newSpanWithID(3), newSpanWithID(3)})
+		tracer.pushPayload([]*span{newSpanWithID(1)})
+
+		assert.Equal([]uint64{1, 2, 3}, spanIDs(tracer))
+		assert.Equal(2, tracer.payload.itemCount())
+		assert.Equal(int64(3), tg.Counts()["datadog.tracer.dedup_skipped"])
+
+		// the IDs are forgotten once flushed
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+		tracer.pushPayload([]*span{newSpanWithID(1)})
+		assert.Equal([]uint64{1}, spanIDs(tracer))
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithSpanDedup(2))
+		tracer.pushPayload([]*span{newSpanWithID(1), newSpanWithID(2), newSpanWithID(3)})
+		tracer.pushPayload([]*span{newSpanWithID(1), newSpanWithID(3)})
+
+		assert.Equal([]uint64{1, 2, 3, 3}, spanIDs(tracer))
+		assert.Len(tracer.seenSpans, 2)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tracer := newUnstartedTracer()
+		tracer.pushPayload([]*span{newSpanWithID(1)})
+		tracer.pushPayload([]*span{newSpanWithID(1)})
+		assert.Equal(t, []uint64{1, 1}, spanIDs(tracer))
+	})
+}
+
+func TestToValidUTF8(t *testing.T) {
+	for in, want := range map[string]string{
+		"":             "",
+		"valid \u00e9": "valid \u00e9",
+		"\xff":         "\ufffd",
+		"a\xe2\x82b":   "a\ufffd\ufffdb",
+		"\ufffd\xfe":   "\ufffd\ufffd",
+		"trailing\xc3": "trailing\ufffd",
+	} {
+		assert.Equal(t, want, toValidUTF8(in))
+	}
+}
+
+func TestTracerTruncateTags(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		tracer := newUnstartedTracer()
+		assert.Equal(t, defaultMaxTagValueLength, tracer.config.maxTagValueLength)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithMaxTagValueLength(10))
+		s := newBasicSpan("op")
+		s.Meta["small"] = "value"
+		s.Meta["exact"] = strings.Repeat("a", 10)
+		s.Meta["large"] = strings.Repeat("b", 100)
+		s.Meta["utf8"] = strings.Repeat("é", 10) // 2 bytes each
+		s.Meta["utf8-odd"] = "a" + strings.Repeat("é", 10)
+		tracer.pushPayload([]*span{s})
+
+		assert.Equal("value", s.Meta["small"])
+		assert.Equal(strings.Repeat("a", 10), s.Meta["exact"])
+		assert.Equal(strings.Repeat("b", 7)+"...", s.Meta["large"])
+		assert.Equal(strings.Repeat("é", 3)+"...", s.Meta["utf8"])
+		assert.Equal("a"+strings.Repeat("é", 3)+"...", s.Meta["utf8-odd"])
+		assert.Equal("large,utf8,utf8-odd", s.Meta[keyTruncatedTags])
+		for k, v := range s.Meta {
+			if k != keyTruncatedTags {
+				assert.True(len(v) <= 10, "%s has %d bytes", k, len(v))
+			}
+		}
+	})
+
+	t.Run("no-suffix", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithMaxTagValueLength(3))
+		s := newBasicSpan("op")
+		s.Meta["large"] = strings.Repeat("b", 100)
+		s.Meta["utf8"] = strings.Repeat("é", 10)
+		tracer.pushPayload([]*span{s})
+
+		assert.Equal("bbb", s.Meta["large"])
+		assert.Equal("é", s.Meta["utf8"])
+		assert.Equal("large,utf8", s.Meta[keyTruncatedTags])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithMaxTagValueLength(0))
+		s := newBasicSpan("op")
+		s.Meta["large"] = strings.Repeat("b", 100)
+		tracer.pushPayload([]*span{s})
+
+		assert.Len(s.Meta["large"], 100)
+		assert.NotContains(s.Meta, keyTruncatedTags)
+	})
+}
+
+func TestTracerMaxTagsPerSpan(t *testing.T) {
+	// newTagsSpan returns a span with n tags, keyed "key00" to "key<n-1>".
+	newTagsSpan := func(n int) *span {
+		s := newBasicSpan("op")
+		s.Meta = make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			s.Meta[fmt.Sprintf("key%02d", i)] = "value"
+		}
+		return s
+	}
+
+	t.Run("capped", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg), WithMaxTagsPerSpan(10), WithMaxTagValueLength(0))
+		over, exact, under := newTagsSpan(25), newTagsSpan(10), newTagsSpan(5)
+		tracer.pushPayload([]*span{over, exact, under})
+
+		// the marker counts towards the limit
+		assert.Len(over.Meta, 10)
+		for i := 0; i < 9; i++ {
+			assert.Contains(over.Meta, fmt.Sprintf("key%02d", i))
+		}
+		assert.Equal("16", over.Meta[keyTagsTruncated])
+		assert.Len(exact.Meta, 10)
+		assert.NotContains(exact.Meta, keyTagsTruncated)
+		assert.Len(under.Meta, 5)
+		assert.NotContains(under.Meta, keyTagsTruncated)
+		assert.Equal(int64(16), tg.Counts()["datadog.tracer.tags_truncated"])
+	})
+
+	t.Run("value-length", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer := newUnstartedTracer(WithMaxTagsPerSpan(10))
+		s := newTagsSpan(25)
+		s.Meta["key01"] = strings.Repeat("a", defaultMaxTagValueLength+1)
+		s.Meta["key20"] = strings.Repeat("b", defaultMaxTagValueLength+1)
+		tracer.pushPayload([]*span{s})
+
+		// both markers count towards the limit
+		assert.Len(s.Meta, 10)
+		for i := 0; i < 8; i++ {
+			assert.Contains(s.Meta, fmt.Sprintf("key%02d", i))
+		}
+		assert.Equal("17", s.Meta[keyTagsTruncated])
+		assert.Equal("key01", s.Meta[keyTruncatedTags])
+		assert.True(len(s.Meta["key01"]) <= defaultMaxTagValueLength)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithStatsdClient(&tg))
+		s := newTagsSpan(25)
+		tracer.pushPayload([]*span{s})
+
+		assert.Len(s.Meta, 25)
+		assert.NotContains(tg.Counts(), "datadog.tracer.tags_truncated")
+	})
+}
+
 func TestNewSpan(t *testing.T) {
 	assert := assert.New(t)
 
@@ -454,6 +1128,32 @@ func TestNewSpan(t *testing.T) {
 	assert.Equal("/", span.Resource)
 }
 
+func TestTracerRandomSource(t *testing.T) {
+	// ids returns the trace, span and sampling priority of a few spans started by tracer.
+	ids := func(tracer *tracer) []uint64 {
+		var ids []uint64
+		for i := 0; i < 5; i++ {
+			root := tracer.newRootSpan("root", "service", "resource")
+			child := tracer.newChildSpan("child", root)
+			p, _ := root.context.samplingPriority()
+			ids = append(ids, root.TraceID, root.SpanID, child.SpanID, uint64(p))
+		}
+		return ids
+	}
+
+	t.Run("seeded", func(t *testing.T) {
+		tracer1 := newUnstartedTracer(WithRandomSource(rand.NewSource(42)))
+		tracer2 := newUnstartedTracer(WithRandomSource(rand.NewSource(42)))
+		assert.Equal(t, ids(tracer1), ids(tracer2))
+	})
+
+	t.Run("default", func(t *testing.T) {
+		tracer1 := newUnstartedTracer()
+		tracer2 := newUnstartedTracer()
+		assert.NotEqual(t, ids(tracer1), ids(tracer2))
+	})
+}
+
 func TestNewSpanChild(t *testing.T) {
 	assert := assert.New(t)
 
@@ -923,6 +1623,24 @@ func TestPushPayload(t *testing.T) {
 	flush(2)
 }
 
+func TestPushPayloadSizeLimit(t *testing.T) {
+	assert := assert.New(t)
+	transport := newDummyTransport()
+	tracer := newUnstartedTracer(withTransport(transport), WithPayloadSizeLimit(500), WithMaxConcurrentFlushes(1))
+	assert.Equal(1, tracer.climit.cap())
+
+	s := newBasicSpan("op")
+	s.Meta["key"] = strings.Repeat("X", 300)
+	tracer.pushPayload([]*span{s})
+	assert.Equal(1, tracer.payload.itemCount())
+
+	// the size limit is exceeded
+	tracer.pushPayload([]*span{s})
+	assert.Equal(0, tracer.payload.itemCount())
+	tracer.wg.Wait()
+	assert.Equal(2, transport.Len())
+}
+
 func TestPushTrace(t *testing.T) {
 	assert := assert.New(t)
 
@@ -997,43 +1715,1777 @@ func TestTracerFlush(t *testing.T) {
 	})
 }
 
-func TestTracerReportsHostname(t *testing.T) {
-	t.Run("enabled", func(t *testing.T) {
-		os.Setenv("DD_TRACE_REPORT_HOSTNAME", "true")
-		defer os.Unsetenv("DD_TRACE_REPORT_HOSTNAME")
-
-		tracer, _, _, stop := startTestTracer(t)
-		defer stop()
-
-		root := tracer.StartSpan("root").(*span)
-		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
-		child.Finish()
-		root.Finish()
+func TestTracerPayloadCompression(t *testing.T) {
+	// newServer returns an agent reporting the given version from /info, or not
+	// serving it if empty, and recording the encoding of the payloads sent to it.
+	newServer := func(version string, reject bool) (*httptest.Server, *[]string) {
+		var (
+			mu        sync.Mutex
+			encodings []string
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/info" {
+				if version == "" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				fmt.Fprintf(w, `{"version":%q}`, version)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			enc := r.Header.Get("Content-Encoding")
+			encodings = append(encodings, enc)
+			if enc == "gzip" {
+				if reject {
+					w.WriteHeader(http.StatusUnsupportedMediaType)
+					return
+				}
+				if _, err := gzip.NewReader(r.Body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.Write([]byte("{}"))
+		}))
+		return srv, &encodings
+	}
+	trace := []*span{newBasicSpan("a"), newBasicSpan("b")}
 
+	t.Run("enabled", func(t *testing.T) {
 		assert := assert.New(t)
+		srv, encodings := newServer("7.21.1", false)
+		defer srv.Close()
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")), WithPayloadCompression(1), WithStatsdClient(&tg))
+		tracer.pushPayload(trace)
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+		assert.Equal([]string{"gzip"}, *encodings)
+		counts := tg.Counts()
+		assert.True(counts["datadog.tracer.flush_bytes_compressed"] > 0)
+		assert.True(counts["datadog.tracer.flush_bytes"] > 0)
+	})
 
-		name, ok := root.Meta[keyHostname]
-		assert.True(ok)
-		assert.Equal(name, tracer.hostname)
+	t.Run("threshold", func(t *testing.T) {
+		srv, encodings := newServer("7.21.1", false)
+		defer srv.Close()
+		tracer := newUnstartedTracer(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")), WithPayloadCompression(1<<20))
+		tracer.pushPayload(trace)
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+		assert.Equal(t, []string{""}, *encodings)
+	})
 
-		_, ok = child.Meta[keyHostname]
-		assert.False(ok)
+	t.Run("rejected", func(t *testing.T) {
+		assert := assert.New(t)
+		srv, encodings := newServer("7.21.1", true)
+		defer srv.Close()
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")), WithPayloadCompression(1), WithStatsdClient(&tg))
+		tracer.pushPayload(trace)
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+		assert.Equal([]string{"gzip", ""}, *encodings)
+		assert.Equal(int64(1), tg.Counts()["datadog.tracer.flush_traces"])
+
+		// compression stays disabled
+		tracer.pushPayload(trace)
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+		assert.Equal([]string{"gzip", "", ""}, *encodings)
 	})
 
-	t.Run("disabled", func(t *testing.T) {
-		tracer, _, _, stop := startTestTracer(t)
-		defer stop()
+	for name, version := range map[string]string{
+		"unsupported": "6.22.0",
+		"no-info":     "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv, encodings := newServer(version, false)
+			defer srv.Close()
+			tracer := newUnstartedTracer(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")), WithPayloadCompression(1))
+			tracer.pushPayload(trace)
+			tracer.flush(flushReasonScheduled)
+			tracer.wg.Wait()
+			assert.Equal(t, []string{""}, *encodings)
+		})
+	}
+}
 
-		root := tracer.StartSpan("root").(*span)
-		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
-		child.Finish()
-		root.Finish()
+// jsonEncoder encodes each trace as a line of JSON.
+type jsonEncoder struct{}
 
-		assert := assert.New(t)
+func (jsonEncoder) encode(trace []*span) ([]byte, error) {
+	b, err := json.Marshal(trace)
+	return append(b, '\n'), err
+}
 
-		_, ok := root.Meta[keyHostname]
-		assert.False(ok)
-		_, ok = child.Meta[keyHostname]
+func (jsonEncoder) contentType() string { return "application/x-ndjson" }
+
+func TestTracerEncoder(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		mu          sync.Mutex
+		contentType string
+		body        []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	tracer := newUnstartedTracer(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")), withEncoder(jsonEncoder{}))
+	tracer.pushPayload([]*span{newBasicSpan("a"), newBasicSpan("b")})
+	tracer.pushPayload([]*span{newBasicSpan("c")})
+	tracer.flush(flushReasonScheduled)
+	tracer.wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal("application/x-ndjson", contentType)
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	assert.Len(lines, 2)
+	var names []string
+	for _, line := range lines {
+		var trace []struct{ Name string }
+		assert.NoError(json.Unmarshal([]byte(line), &trace))
+		for _, s := range trace {
+			names = append(names, s.Name)
+		}
+	}
+	assert.Equal([]string{"a", "b", "c"}, names)
+}
+
+func TestTracerFlushRetry(t *testing.T) {
+	defer func(old time.Duration) { sendRetryBaseDelay = old }(sendRetryBaseDelay)
+	sendRetryBaseDelay = time.Millisecond
+	trace := []*span{newBasicSpan("a"), newBasicSpan("b")}
+
+	for name, tt := range map[string]struct {
+		err       error
+		failures  int
+		calls     int
+		delivered int
+	}{
+		"network":   {err: errors.New("connection refused"), failures: 2, calls: 3, delivered: 1},
+		"5xx":       {err: &statusError{code: http.StatusServiceUnavailable}, failures: 2, calls: 3, delivered: 1},
+		"4xx":       {err: &statusError{code: http.StatusBadRequest}, failures: 1, calls: 1, delivered: 0},
+		"exhausted": {err: &statusError{code: http.StatusInternalServerError}, failures: 3, calls: 3, delivered: 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var tg testStatsdClient
+			transport := newFailingTransport(tt.failures, tt.err)
+			tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg))
+			tracer.pushPayload(trace)
+			tracer.flush(flushReasonScheduled)
+			tracer.wg.Wait()
+
+			assert.Equal(tt.calls, transport.Calls())
+			assert.Equal(tt.delivered, transport.Len())
+			counts := tg.Counts()
+			assert.Equal(int64(tt.calls-1), counts["datadog.tracer.flush_retries"])
+			assert.Equal(int64(1-tt.delivered), counts["datadog.tracer.traces_dropped"])
+			var attempt int
+			for _, c := range tg.IncrCalls() {
+				if c.name == "datadog.tracer.flush_retries" {
+					assert.Equal([]string{"attempt:" + strconv.Itoa(attempt+2)}, c.tags)
+					attempt++
+				}
+			}
+			if tt.delivered > 0 {
+				comparePayloadSpans(t, trace[0], transport.Traces()[0][0])
+			}
+		})
+	}
+
+	t.Run("stop", func(t *testing.T) {
+		sendRetryBaseDelay = time.Second
+		transport := newFailingTransport(sendAttempts, errors.New("connection refused"))
+		tracer := newUnstartedTracer(withTransport(transport))
+		tracer.pushPayload(trace)
+		start := time.Now()
+		tracer.flush(flushReasonScheduled)
+		close(tracer.stop)
+		tracer.wg.Wait()
+		assert.True(t, time.Since(start) < 500*time.Millisecond)
+		assert.Equal(t, 1, transport.Calls())
+	})
+}
+
+func TestTracerRetryBuffer(t *testing.T) {
+	defer func(old time.Duration) { sendRetryBaseDelay = old }(sendRetryBaseDelay)
+	sendRetryBaseDelay = time.Millisecond
+	errRefused := errors.New("connection refused")
+
+	t.Run("no-loss", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		// fail all the attempts of the first two flushes
+		transport := newFailingTransport(2*sendAttempts, errRefused)
+		tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg), WithRetryBuffer(0))
+		for i := 0; i < 3; i++ {
+			tracer.pushPayload([]*span{newBasicSpan("op" + strconv.Itoa(i))})
+			tracer.flush(flushReasonScheduled)
+			tracer.wg.Wait()
+			if i < 2 {
+				assert.Equal(i+1, tracer.retryQueue.len())
+			}
+		}
+		assert.Equal(0, tracer.retryQueue.len())
+		var names []string
+		for _, trace := range transport.Traces() {
+			names = append(names, trace[0].Name)
+		}
+		assert.ElementsMatch([]string{"op0", "op1", "op2"}, names)
+		assert.Equal(int64(0), tg.Counts()["datadog.tracer.traces_dropped"])
+		assert.Equal(int64(3), tg.Counts()["datadog.tracer.flush_traces"])
+	})
+
+	t.Run("full", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		transport := newFailingTransport(100, errRefused)
+		p := newPayload()
+		p.push([]*span{newBasicSpan("op")})
+		tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg), WithRetryBuffer(p.size()))
+		for i := 0; i < 3; i++ {
+			tracer.pushPayload([]*span{newBasicSpan("op")})
+			tracer.flush(flushReasonScheduled)
+			tracer.wg.Wait()
+		}
+		assert.Equal(1, tracer.retryQueue.len())
+		assert.Equal(int64(2), tg.Counts()["datadog.tracer.queue_dropped"])
+		assert.Equal(int64(2), tg.Counts()["datadog.tracer.traces_dropped"])
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		assert := assert.New(t)
+		transport := newFailingTransport(sendAttempts, errRefused)
+		tracer := newUnstartedTracer(withTransport(transport), WithRetryBuffer(0))
+		tracer.pushPayload([]*span{newBasicSpan("op")})
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+		assert.Equal(1, tracer.retryQueue.len())
+
+		close(tracer.stop)
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+		assert.Equal(0, tracer.retryQueue.len())
+		assert.Equal(1, transport.Len())
+	})
+}
+
+func TestTracerBackpressure(t *testing.T) {
+	defer func(old time.Duration) { backpressurePollInterval = old }(backpressurePollInterval)
+	backpressurePollInterval = time.Millisecond
+	trace := []*span{newBasicSpan("op")}
+	p := newPayload()
+	p.push(trace)
+	traceSize := p.size()
+
+	t.Run("drop-newest", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		transport := newBlockingTransport()
+		defer transport.Unblock()
+		highWater := 10 * traceSize
+		tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg),
+			WithBackpressure(highWater, BackpressureDropNewest, 0))
+		var flushed int
+		for i := 0; i < 100; i++ {
+			tracer.pushTrace(trace)
+			if len(tracer.payloadChan) > 0 {
+				tracer.pushPayload(<-tracer.payloadChan)
+			}
+			if i == 50 {
+				// the flush stalls on the transport, holding its payload in flight
+				flushed = tracer.payload.itemCount()
+				tracer.flush(flushReasonScheduled)
+			}
+			assert.True(tracer.pendingBytes() <= int64(highWater+traceSize))
+		}
+		dropped := 100 - flushed - tracer.payload.itemCount()
+		assert.True(dropped > 0)
+		assert.Equal(int64(dropped), tg.Counts()["datadog.tracer.traces_dropped"])
+		assert.Equal(dropped, tg.CallsByName()["datadog.tracer.backpressure"])
+		for _, c := range tg.IncrCalls() {
+			if c.name == "datadog.tracer.backpressure" {
+				assert.Equal([]string{"policy:drop_newest"}, c.tags)
+			}
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		transport := newBlockingTransport()
+		tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg),
+			WithBackpressure(1, BackpressureBlock, time.Minute))
+		tracer.pushPayload(trace)
+		tracer.flush(flushReasonScheduled)
+
+		pushed := make(chan struct{})
+		go func() {
+			tracer.pushTrace(trace)
+			close(pushed)
+		}()
+		select {
+		case <-pushed:
+			t.Fatal("pushTrace did not block")
+		case <-time.After(20 * time.Millisecond):
+		}
+		transport.Unblock()
+		<-pushed
+		tracer.wg.Wait()
+		assert.Len(tracer.payloadChan, 1)
+		assert.Equal(int64(0), tg.Counts()["datadog.tracer.traces_dropped"])
+		assert.Equal(1, tg.CallsByName()["datadog.tracer.backpressure"])
+	})
+
+	t.Run("block-timeout", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		transport := newBlockingTransport()
+		defer transport.Unblock()
+		tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg),
+			WithBackpressure(1, BackpressureBlock, 10*time.Millisecond))
+		tracer.pushPayload(trace)
+		tracer.flush(flushReasonScheduled)
+
+		start := time.Now()
+		tracer.pushTrace(trace)
+		assert.True(time.Since(start) >= 10*time.Millisecond)
+		assert.Len(tracer.payloadChan, 0)
+		assert.Equal(int64(1), tg.Counts()["datadog.tracer.traces_dropped"])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		c := newConfig(WithBackpressure(0, BackpressureDropNewest, 0))
+		assert.Equal(t, 0, c.backpressureBytes)
+		c = newConfig(WithBackpressure(1, BackpressureBlock, 0))
+		assert.Equal(t, defaultBackpressureTimeout, c.backpressureTimeout)
+	})
+}
+
+func TestTracerDryRun(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	transport := newFailingTransport(0, nil)
+	tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg), withEncoder(jsonEncoder{}), WithDryRun())
+	tracer.pushPayload([]*span{newBasicSpan("a")})
+	bad := newBasicSpan("b")
+	bad.Metrics["nan"] = math.NaN()
+	tracer.pushPayload([]*span{bad})
+	tracer.flush(flushReasonManual)
+	tracer.wg.Wait()
+
+	assert.Equal(0, transport.Calls())
+	counts := tg.Counts()
+	assert.Equal(int64(1), counts["datadog.tracer.traces_dropped"])
+	assert.Equal(int64(1), counts["datadog.tracer.flush_traces"])
+	assert.True(counts["datadog.tracer.flush_bytes"] > 0)
+	assert.Equal(0, tg.CallsByName()["datadog.tracer.decode_error"])
+}
+
+func TestTracerMaxMemory(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	transport := newBlockingTransport()
+	trace := []*span{newBasicSpan("op")}
+	p := newPayload()
+	p.push(trace)
+	traceSize := p.size()
+	budget := 20 * traceSize
+	tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg),
+		WithMaxMemory(budget), WithMaxConcurrentFlushes(2))
+
+	for i := 1; i <= 200; i++ {
+		tracer.pushPayload(trace)
+		if i%10 == 0 && !tracer.climit.full() {
+			// the flush stalls on the transport, holding its payload in flight
+			tracer.flush(flushReasonScheduled)
+		}
+		assert.True(tracer.pendingBytes() <= int64(budget+traceSize), tracer.pendingBytes())
+	}
+	held := tracer.payload.itemCount()
+	tracer.inflightMu.Lock()
+	for _, n := range tracer.inflight {
+		held += n
+	}
+	tracer.inflightMu.Unlock()
+	counts := tg.Counts()
+	assert.True(counts["datadog.tracer.traces_dropped"] > 0)
+	assert.Equal(int64(200-held), counts["datadog.tracer.traces_dropped"])
+	for _, c := range tg.CountCalls() {
+		if c.name == "datadog.tracer.traces_dropped" {
+			assert.Equal([]string{"reason:memory_limit", "priority:1"}, c.tags)
+		}
+	}
+
+	transport.Unblock()
+	tracer.wg.Wait()
+	assert.Equal(int64(0), atomic.LoadInt64(&tracer.inflightBytes))
+}
+
+func TestTracerMaxMemoryPriority(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		tg      testStatsdClient
+		evicted []string
+	)
+	newTrace := func(name string, priority float64, errored bool) []*span {
+		s := newBasicSpan(name)
+		s.Metrics[keySamplingPriority] = priority
+		if errored {
+			s.Error = 1
+		}
+		return []*span{s}
+	}
+	p := newPayload()
+	p.push(newTrace("a", 0, false))
+	traceSize := p.size() - 1 // without the header
+	tracer := newUnstartedTracer(WithStatsdClient(&tg), WithMaxMemory(4*traceSize),
+		WithDropHook(func(reason string, spans int) {
+			evicted = append(evicted, reason)
+		}))
+	names := func() []string {
+		var names []string
+		for _, trace := range tracer.payload.traces {
+			names = append(names, trace[0].Name)
+		}
+		return names
+	}
+
+	tracer.pushPayload(newTrace("a", 0, false))
+	tracer.pushPayload(newTrace("b", 1, false))
+	tracer.pushPayload(newTrace("c", 0, false))
+	tracer.pushPayload(newTrace("d", 2, false))
+	assert.Equal([]string{"a", "b", "c", "d"}, names())
+
+	// the oldest of the lowest priority traces is dropped first
+	tracer.pushPayload(newTrace("e", 1, false))
+	assert.Equal([]string{"b", "c", "d", "e"}, names())
+	tracer.pushPayload(newTrace("f", 1, true))
+	assert.Equal([]string{"b", "d", "e", "f"}, names())
+
+	// with equal priorities, traces without errors are dropped first
+	tracer.pushPayload(newTrace("g", 1, true))
+	assert.Equal([]string{"d", "e", "f", "g"}, names())
+
+	// traces ranking below all the buffered ones are dropped themselves
+	tracer.pushPayload(newTrace("h", 0, false))
+	assert.Equal([]string{"d", "e", "f", "g"}, names())
+	assert.Equal(4, tracer.payload.itemCount())
+	assert.Len(evicted, 4)
+
+	dropped := make(map[string]int64)
+	for _, c := range tg.CountCalls() {
+		if c.name == "datadog.tracer.traces_dropped" {
+			assert.Equal("reason:memory_limit", c.tags[0])
+			dropped[c.tags[1]] += c.intVal
+		}
+	}
+	assert.Equal(map[string]int64{"priority:0": 3, "priority:1": 1}, dropped)
+
+	// the payload remains decodable after evictions
+	traces, err := decode(tracer.payload)
+	assert.NoError(err)
+	assert.Len(traces, 4)
+}
+
+func TestTracerSendErrorLog(t *testing.T) {
+	defer func(old time.Duration) { sendErrorLogInterval = old }(sendErrorLogInterval)
+	sendErrorLogInterval = time.Hour
+	assert := assert.New(t)
+	log.Flush()
+	tp := new(testLogger)
+	log.UseLogger(tp)
+	linesWith := func(level string) []string {
+		var lines []string
+		for _, l := range tp.Lines() {
+			if strings.Contains(l, level) {
+				lines = append(lines, l)
+			}
+		}
+		return lines
+	}
+	errorLines := func() []string { return linesWith("ERROR") }
+	var tg testStatsdClient
+	transport := newFailingTransport(1000, &statusError{code: http.StatusBadRequest, msg: "400 Bad Request"})
+	tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg))
+
+	for i := 0; i < 100; i++ {
+		tracer.pushPayload([]*span{newBasicSpan("a")})
+		tracer.pushPayload([]*span{newBasicSpan("b")})
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+	}
+	log.Flush()
+	lines := errorLines()
+	assert.Len(lines, 1)
+	assert.Contains(lines[0], "lost 2 traces over the last 1 failed flushes")
+	assert.Contains(lines[0], "2 traces): 400 Bad Request")
+	assert.Equal(int64(200), tg.Counts()["datadog.tracer.traces_dropped"])
+
+	// the next log reports the failures since the previous one
+	tp.Reset()
+	sendErrorLogInterval = 0
+	tracer.pushPayload([]*span{newBasicSpan("c")})
+	tracer.flush(flushReasonScheduled)
+	tracer.wg.Wait()
+	log.Flush()
+	lines = errorLines()
+	assert.Len(lines, 1)
+	assert.Contains(lines[0], "lost 199 traces over the last 100 failed flushes")
+	assert.Equal(int64(201), tg.Counts()["datadog.tracer.traces_dropped"])
+
+	// sends queued for retry and evictions from the full retry queue are coalesced too
+	tp.Reset()
+	sendErrorLogInterval = time.Hour
+	tracer = newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg), WithRetryBuffer(1))
+	for i := 0; i < 100; i++ {
+		tracer.pushPayload([]*span{newBasicSpan("a")})
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+	}
+	log.Flush()
+	lines = linesWith("WARN")
+	assert.Len(lines, 1)
+	assert.Contains(lines[0], "failed to send 1 traces over the last 1 flushes, queued for retry; last failure: 400 Bad Request")
+	lines = errorLines()
+	assert.Len(lines, 1)
+	assert.Contains(lines[0], "retry queue full, lost 1 traces over the last 1 evictions")
+	assert.Equal(int64(301), tg.Counts()["datadog.tracer.traces_dropped"])
+}
+
+func TestTracerHealth(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(HealthStatus{}, Health())
+
+	transport := newFailingTransport(3, &statusError{code: http.StatusBadRequest, msg: "400 Bad Request"})
+	tracer := newUnstartedTracer(withTransport(transport))
+	flush := func() {
+		tracer.pushPayload([]*span{newBasicSpan("a")})
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+	}
+	assert.True(tracer.health.status(time.Now()).Healthy(0))
+
+	for i := 1; i <= 3; i++ {
+		flush()
+		h := tracer.health.status(time.Now())
+		assert.Equal(i, h.ConsecutiveFailures)
+		assert.True(h.LastFlushSuccess.IsZero())
+		assert.Equal(1., h.DropRate)
+		assert.False(h.Healthy(1))
+	}
+
+	before := time.Now()
+	flush()
+	h := tracer.health.status(time.Now())
+	assert.Equal(0, h.ConsecutiveFailures)
+	assert.False(h.LastFlushSuccess.Before(before))
+	assert.Equal(0.75, h.DropRate)
+	assert.True(h.Healthy(0.75))
+	assert.False(h.Healthy(0.5))
+
+	// traces dropped as configured do not count as failures
+	tracer.recordDrop(dropReasonPaused, 1)
+	tracer.recordDrop(dropReasonFiltered, 1)
+	tracer.recordDrop(dropReasonEmptyResource, 1)
+	assert.Equal(0.75, tracer.health.status(time.Now()).DropRate)
+	log.Flush()
+}
+
+func TestConnLimiter(t *testing.T) {
+	assert := assert.New(t)
+	l := newConnLimiter(2)
+	assert.True(l.tryAcquire())
+	assert.True(l.tryAcquire())
+	assert.False(l.tryAcquire())
+	assert.True(l.full())
+
+	// shrinking below the connections in use holds back new ones
+	l.setCap(1)
+	l.release()
+	assert.Equal(1, l.len())
+	assert.False(l.tryAcquire())
+
+	// growing lets blocked acquisitions through
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a connection beyond the capacity")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.setCap(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for acquire")
+	}
+	assert.Equal(2, l.len())
+	assert.Equal(2, l.cap())
+}
+
+func TestConcurrencyController(t *testing.T) {
+	assert := assert.New(t)
+	l := newConnLimiter(10)
+	c := newConcurrencyController(l, 2, 10, 100*time.Millisecond)
+
+	// fast flushes can not grow the capacity beyond max
+	_, changed := c.observe(10 * time.Millisecond)
+	assert.False(changed)
+	assert.Equal(10, l.cap())
+
+	// rising latency shrinks the capacity, down to min
+	last := l.cap()
+	for d := 100 * time.Millisecond; d <= time.Second; d += 100 * time.Millisecond {
+		c.observe(d)
+		assert.True(l.cap() <= last, "capacity grew under rising latency")
+		last = l.cap()
+	}
+	assert.Equal(2, l.cap())
+
+	// low latency grows it back, up to max
+	for i := 0; i < 100; i++ {
+		c.observe(time.Millisecond)
+	}
+	assert.Equal(10, l.cap())
+}
+
+func TestTracerAdaptiveConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	transport := slowTransport{dummyTransport: newDummyTransport(), delay: 20 * time.Millisecond}
+	tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg),
+		WithAdaptiveConcurrency(1, 8, time.Millisecond))
+	assert.Equal(8, tracer.climit.cap())
+
+	for i := 0; i < 3; i++ {
+		tracer.pushPayload([]*span{newBasicSpan("op")})
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+	}
+	assert.Equal(3, tracer.climit.cap()) // 8, 6, 4, 3
+	var limits []float64
+	for _, c := range tg.GaugeCalls() {
+		if c.name == "datadog.tracer.flush_concurrency_limit" {
+			limits = append(limits, c.floatVal)
+		}
+	}
+	assert.Equal([]float64{6, 4, 3}, limits)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	b := newCircuitBreaker(2, time.Minute)
+	start := time.Unix(0, 0)
+
+	// closed: failures below the threshold, or interrupted by a success, keep it closed
+	assert.True(b.allow(start))
+	b.record(false, start)
+	b.record(true, start)
+	b.record(false, start)
+	assert.Equal(breakerClosed, b.state)
+	assert.True(b.allow(start))
+
+	// open: the threshold is reached
+	b.record(false, start)
+	assert.Equal(breakerOpen, b.state)
+	assert.False(b.allow(start.Add(time.Minute - 1)))
+
+	// half-open: a single probe is let through after the cooldown
+	probe := start.Add(time.Minute)
+	assert.True(b.allow(probe))
+	assert.Equal(breakerHalfOpen, b.state)
+	assert.False(b.allow(probe))
+
+	// a failed probe opens it again for another cooldown
+	b.record(false, probe)
+	assert.Equal(breakerOpen, b.state)
+	assert.False(b.allow(probe.Add(time.Minute - 1)))
+
+	// a successful probe closes it
+	probe = probe.Add(time.Minute)
+	assert.True(b.allow(probe))
+	b.record(true, probe)
+	assert.Equal(breakerClosed, b.state)
+	assert.True(b.allow(probe))
+	assert.True(b.allow(probe))
+
+	// a nil breaker lets everything through
+	var nb *circuitBreaker
+	assert.True(nb.allow(start))
+	nb.record(false, start)
+}
+
+func TestTracerSendTimeout(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	tracer := newUnstartedTracer(
+		withTransport(hangingTransport{newDummyTransport()}),
+		WithStatsdClient(&tg),
+		WithSendTimeout(10*time.Millisecond),
+		WithRetryBuffer(0),
+	)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		tracer.pushPayload([]*span{newBasicSpan("a")})
+		tracer.flush(flushReasonScheduled)
+	}
+	tracer.wg.Wait()
+
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(0, tracer.climit.len())
+	assert.Equal(0, tracer.retryQueue.len())
+	dropped := make(map[string]int64)
+	for _, c := range tg.CountCalls() {
+		if c.name == "datadog.tracer.traces_dropped" {
+			dropped[c.tags[0]] += c.intVal
+		}
+	}
+	assert.Equal(map[string]int64{"reason:send_timeout": 3}, dropped)
+	log.Flush()
+}
+
+func TestTracerCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	transport := newFailingTransport(2, &statusError{code: http.StatusBadRequest, msg: "400 Bad Request"})
+	tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg), WithCircuitBreaker(2, time.Hour))
+	flush := func() {
+		tracer.pushPayload([]*span{newBasicSpan("a")})
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+	}
+	flush()
+	flush()
+	assert.Equal(2, transport.Calls())
+
+	// the circuit is open: flushes are dropped without sending
+	flush()
+	assert.Equal(2, transport.Calls())
+	dropped := make(map[string]int64)
+	for _, c := range tg.CountCalls() {
+		if c.name == "datadog.tracer.traces_dropped" {
+			dropped[c.tags[0]] += c.intVal
+		}
+	}
+	assert.Equal(map[string]int64{"reason:send_failed": 2, "reason:circuit_open": 1}, dropped)
+
+	// the probe after the cooldown succeeds, closing the circuit
+	tracer.breaker.cooldown = 0
+	flush()
+	flush()
+	assert.Equal(4, transport.Calls())
+	assert.Equal(2, transport.Len())
+	log.Flush()
+}
+
+func TestHealthTrackerWindow(t *testing.T) {
+	assert := assert.New(t)
+	var h healthTracker
+	start := time.Unix(0, 0)
+	h.dropped(start, 1)
+	h.success(start.Add(healthWindow/2), 1)
+	assert.Equal(0.5, h.status(start.Add(healthWindow/2)).DropRate)
+
+	// the drop falls out of the window first
+	assert.Equal(0., h.status(start.Add(healthWindow)).DropRate)
+	assert.Equal(0., h.status(start.Add(healthWindow*3/2)).DropRate)
+
+	// stale buckets are reset when reused
+	h.dropped(start.Add(healthWindow*2), 1)
+	assert.Equal(1., h.status(start.Add(healthWindow*2)).DropRate)
+}
+
+func TestTracerSendErrorRequestID(t *testing.T) {
+	assert := assert.New(t)
+	log.Flush()
+	tp := new(testLogger)
+	log.UseLogger(tp)
+	var tg testStatsdClient
+	var (
+		mu  sync.Mutex
+		ids []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ids = append(ids, r.Header.Get(requestIDHeader))
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	tracer := newUnstartedTracer(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")), WithStatsdClient(&tg))
+	tracer.pushPayload([]*span{newBasicSpan("a")})
+	size := tracer.payload.size()
+	tracer.flush(flushReasonManual)
+	tracer.wg.Wait()
+	log.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(ids, 1)
+	assert.Len(ids[0], 16)
+	var logged bool
+	for _, l := range tp.Lines() {
+		if strings.Contains(l, "ERROR") {
+			assert.Contains(l, fmt.Sprintf("(request ID %s, %d bytes, 1 traces)", ids[0], size))
+			logged = true
+		}
+	}
+	assert.True(logged)
+	calls := tg.IncrCalls()
+	var tagged bool
+	for _, c := range calls {
+		if c.name == "datadog.tracer.send_errors" {
+			assert.Equal([]string{"error:status", "status_code:400"}, c.tags)
+			tagged = true
+		}
+	}
+	assert.True(tagged)
+}
+
+func TestSendErrorTags(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{"error:timeout"}, sendErrorTags(&sendTimeoutError{timeout: time.Second, err: errors.New("timeout")}))
+	assert.Equal([]string{"error:status", "status_code:503"}, sendErrorTags(&statusError{code: 503}))
+	assert.Equal([]string{"error:network"}, sendErrorTags(errors.New("connection refused")))
+}
+
+func TestTracerFlushSync(t *testing.T) {
+	t.Run("blocks", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, _, stop := startTestTracer(t)
+		defer stop()
+
+		root := tracer.StartSpan("root")
+		tracer.StartSpan("child", ChildOf(root.Context())).Finish()
+		root.Finish()
+		assert.NoError(tracer.flushSync(context.Background()))
+		assert.Equal(1, transport.Len())
+	})
+
+	t.Run("global", func(t *testing.T) {
+		_, transport, _, stop := startTestTracer(t)
+		defer stop()
+
+		StartSpan("op").Finish()
+		Flush()
+		assert.Equal(t, 1, transport.Len())
+	})
+
+	t.Run("waits-inflight", func(t *testing.T) {
+		assert := assert.New(t)
+		transport := newBlockingTransport()
+		tracer, _, _, stop := startTestTracer(t, withTransport(transport))
+		defer stop()
+
+		tracer.StartSpan("op").Finish()
+		done := make(chan error)
+		go func() { done <- FlushContext(context.Background()) }()
+		select {
+		case <-done:
+			t.Fatal("returned before the payload was sent")
+		case <-time.After(20 * time.Millisecond):
+		}
+		transport.Unblock()
+		assert.NoError(<-done)
+		assert.Equal(1, transport.Len())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		transport := newBlockingTransport()
+		tracer, _, _, stop := startTestTracer(t, withTransport(transport))
+		defer stop()
+		defer transport.Unblock()
+
+		tracer.StartSpan("op").Finish()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, tracer.flushSync(ctx))
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		tracer, _, _, stop := startTestTracer(t)
+		stop()
+		assert.NoError(t, tracer.flushSync(context.Background()))
+	})
+}
+
+func TestJitterInterval(t *testing.T) {
+	assert := assert.New(t)
+	rng := rand.New(rand.NewSource(1))
+	d := 2 * time.Second
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		v := jitterInterval(d, 500*time.Millisecond, rng)
+		assert.True(v >= 1500*time.Millisecond && v <= 2500*time.Millisecond, v)
+		seen[v] = true
+	}
+	assert.True(len(seen) > 1)
+	for i := 0; i < 1000; i++ {
+		// capped at d/2
+		v := jitterInterval(d, time.Minute, rng)
+		assert.True(v >= time.Second && v <= 3*time.Second, v)
+	}
+	assert.Equal(d, jitterInterval(d, 0, rng))
+}
+
+func TestNewJitterTicker(t *testing.T) {
+	d, jitter := 20*time.Millisecond, 10*time.Millisecond
+	// replaying the seed yields the intervals picked by the ticker
+	want := rand.New(rand.NewSource(42))
+	start := time.Now()
+	tick, stop := newJitterTicker(d, jitter, rand.New(rand.NewSource(42)))
+	defer stop()
+	last := start
+	for i := 0; i < 5; i++ {
+		now := <-tick
+		interval := jitterInterval(d, jitter, want)
+		assert.True(t, interval >= d-jitter && interval <= d+jitter, interval)
+		assert.True(t, now.Sub(last) >= interval, "tick %d after %s, want at least %s", i, now.Sub(last), interval)
+		assert.True(t, now.Sub(last) < interval+100*time.Millisecond, "tick %d after %s, want about %s", i, now.Sub(last), interval)
+		last = now
+	}
+}
+
+func TestTracerFlushInterval(t *testing.T) {
+	ticks := make(chan time.Time)
+	intervals := make(chan time.Duration, 1)
+	defer func(old func(time.Duration) (<-chan time.Time, func())) { newTicker = old }(newTicker)
+	newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		intervals <- d
+		return ticks, func() {}
+	}
+	// tickUntil ticks the tracer until the transport has received n traces.
+	tickUntil := func(t *testing.T, transport *dummyTransport, n int) {
+		timeout := time.After(time.Second)
+		for transport.Len() != n {
+			select {
+			case ticks <- time.Now():
+			case <-timeout:
+				t.Fatalf("timed out waiting for %d trace(s), got %d", n, transport.Len())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("cadence", func(t *testing.T) {
+		assert := assert.New(t)
+		transport := newDummyTransport()
+		tracer := newTracer(withTransport(transport), WithFlushInterval(time.Minute))
+		internal.SetGlobalTracer(tracer)
+		defer func() {
+			internal.SetGlobalTracer(&internal.NoopTracer{})
+			tracer.Stop()
+		}()
+
+		assert.Equal(time.Minute, <-intervals)
+		for i := 1; i <= 3; i++ {
+			tracer.StartSpan("op").Finish()
+			tickUntil(t, transport, i)
+		}
+	})
+
+	t.Run("saturated", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		transport := newBlockingTransport()
+		tracer := newTracer(withTransport(transport), WithStatsdClient(&tg), WithMaxConcurrentFlushes(1))
+		internal.SetGlobalTracer(tracer)
+		defer func() {
+			internal.SetGlobalTracer(&internal.NoopTracer{})
+			tracer.Stop()
+		}()
+		<-intervals
+
+		tracer.StartSpan("op").Finish()
+		timeout := time.After(time.Second)
+		for tracer.climit.len() == 0 {
+			select {
+			case ticks <- time.Now():
+			case <-timeout:
+				t.Fatal("timed out waiting for flush")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		tracer.StartSpan("op").Finish()
+		ticks <- time.Now()
+		ticks <- time.Now()
+		assert.Equal(int64(1), tg.Counts()["datadog.tracer.flush_triggered"])
+
+		transport.Unblock()
+		tickUntil(t, transport.dummyTransport, 2)
+	})
+}
+
+func TestTracerMaxTraceAge(t *testing.T) {
+	assert := assert.New(t)
+	ageTicks := make(chan time.Time)
+	intervals := make(chan time.Duration, 1)
+	defer func(old func(time.Duration) (<-chan time.Time, func())) { newTicker = old }(newTicker)
+	newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		intervals <- d
+		return ageTicks, func() {}
+	}
+	var tg testStatsdClient
+	tracer, transport, _, stop := startTestTracer(t, WithStatsdClient(&tg), WithMaxTraceAge(time.Minute))
+	defer stop()
+	assert.Equal(15*time.Second, <-intervals)
+
+	tracer.StartSpan("op").Finish()
+	for tracer.writerStats().BufferedTraces == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the trace is younger than the maximum age
+	ageTicks <- time.Now()
+	ageTicks <- time.Now()
+	assert.Equal(0, transport.Len())
+
+	// the clock moves past the maximum age
+	ageTicks <- time.Now().Add(time.Minute)
+	timeout := time.After(time.Second)
+	for transport.Len() == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the aged trace to be flushed")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+	var triggered []string
+	for _, c := range tg.IncrCalls() {
+		if c.name == "datadog.tracer.flush_triggered" {
+			triggered = append(triggered, c.tags...)
+		}
+	}
+	assert.Equal([]string{"reason:age"}, triggered)
+}
+
+func TestTracerHeldSince(t *testing.T) {
+	assert := assert.New(t)
+	tracer := newUnstartedTracer(withEncoder(&failingEncoder{n: 1}))
+
+	// a trace which is not buffered does not start the hold
+	tracer.pushPayload([]*span{newBasicSpan("dropped")})
+	assert.Equal(0, tracer.payload.itemCount())
+	assert.True(tracer.heldSince.IsZero())
+
+	start := time.Now()
+	tracer.pushPayload([]*span{newBasicSpan("kept")})
+	held := tracer.heldSince
+	assert.False(held.Before(start))
+
+	// nor does a later trace while traces are buffered
+	tracer.pushPayload([]*span{newBasicSpan("kept")})
+	assert.Equal(held, tracer.heldSince)
+}
+
+func TestTracerDrainTraces(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(DrainTraces())
+
+	tracer, transport, _, stop := startTestTracer(t)
+	defer stop()
+	root := tracer.StartSpan("root")
+	child := tracer.StartSpan("child", ChildOf(root.Context()))
+	child.Finish()
+	root.Finish()
+	other := tracer.StartSpan("other")
+	other.Finish()
+
+	var drained [][]ddtrace.Span
+	timeout := time.After(time.Second)
+	for len(drained) < 2 {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for traces, got %d", len(drained))
+		default:
+			drained = append(drained, DrainTraces()...)
+		}
+	}
+	assert.Len(drained, 2)
+	assert.Equal([]ddtrace.Span{root, child}, drained[0])
+	assert.Equal([]ddtrace.Span{other}, drained[1])
+	assert.Equal(0, CurrentWriterStats().BufferedTraces)
+
+	Flush()
+	assert.Equal(0, transport.Len())
+	assert.Empty(DrainTraces())
+}
+
+func TestTracerWriterStats(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(WriterStats{}, CurrentWriterStats())
+
+	tracer, transport, _, stop := startTestTracer(t)
+	defer stop()
+	tracer.StartSpan("op").Finish()
+	tracer.StartSpan("op").Finish()
+	timeout := time.After(time.Second)
+	for CurrentWriterStats().BufferedTraces != 2 {
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for traces to be buffered")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+	stats := CurrentWriterStats()
+	assert.True(stats.BufferedBytes > 0)
+	assert.True(stats.LastFlush.IsZero())
+
+	Flush()
+	assert.Equal(2, transport.Len())
+	stats = CurrentWriterStats()
+	assert.Equal(0, stats.BufferedTraces)
+	assert.Equal(0, stats.BufferedBytes)
+	assert.False(stats.LastFlush.IsZero())
+	assert.Equal(0, stats.InFlightFlushes)
+}
+
+func TestTracerFlushHook(t *testing.T) {
+	for name, tt := range map[string]struct {
+		transport transport
+		delivered bool
+	}{
+		"success": {transport: newDummyTransport(), delivered: true},
+		"failure": {transport: newFailingTransport(1, &statusError{code: http.StatusBadRequest}), delivered: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			var got []FlushStats
+			tracer := newUnstartedTracer(withTransport(tt.transport), WithFlushHook(func(stats FlushStats) {
+				got = append(got, stats)
+			}))
+			tracer.pushPayload([]*span{newBasicSpan("a"), newBasicSpan("b")})
+			tracer.pushPayload([]*span{newBasicSpan("c")})
+			size := tracer.payload.size()
+			tracer.flush(flushReasonManual)
+			tracer.wg.Wait()
+
+			assert.Len(got, 1)
+			assert.Equal("manual", got[0].Reason)
+			assert.Equal(size, got[0].Size)
+			assert.Equal(2, got[0].Traces)
+			assert.Equal(tt.delivered, got[0].Delivered)
+			assert.True(got[0].Duration > 0)
+		})
+	}
+}
+
+func TestTracerSamplingRatesHook(t *testing.T) {
+	assert := assert.New(t)
+	transport := &ratesTransport{
+		dummyTransport: newDummyTransport(),
+		rates:          `{"rate_by_service":{"service:,env:":0.8,"service:web,env:prod":0.25}}`,
+	}
+	var got []map[string]float64
+	tracer := newUnstartedTracer(withTransport(transport), WithSamplingRatesHook(func(rates map[string]float64) {
+		got = append(got, rates)
+	}))
+	assert.Nil(tracer.prioritySampling.receivedRates())
+	tracer.pushPayload([]*span{newBasicSpan("a")})
+	tracer.flush(flushReasonManual)
+	tracer.wg.Wait()
+
+	want := map[string]float64{"service:,env:": 0.8, "service:web,env:prod": 0.25}
+	assert.Len(got, 1)
+	assert.Equal(want, got[0])
+	assert.Equal(want, tracer.prioritySampling.receivedRates())
+
+	internal.SetGlobalTracer(tracer)
+	defer internal.SetGlobalTracer(&internal.NoopTracer{})
+	assert.Equal(want, AgentSamplingRates())
+}
+
+func TestTracerPayloadMaxSize(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		tg      testStatsdClient
+		dropped []string
+	)
+	transport := newPayloadsTransport()
+	tracer := newUnstartedTracer(
+		withTransport(transport),
+		WithStatsdClient(&tg),
+		WithDropHook(func(reason string, spans int) {
+			dropped = append(dropped, fmt.Sprintf("%s:%d", reason, spans))
+		}),
+	)
+	newTrace := func(resource string) []*span {
+		s := newBasicSpan("op")
+		s.Resource = resource
+		return []*span{s}
+	}
+	b, err := msgpackEncoder{}.encode(newTrace("a"))
+	assert.NoError(err)
+	// room for two of the small traces only
+	tracer.config.payloadMaxSize = 2*len(b) + len(tracer.payload.header)
+
+	tracer.pushPayload(newTrace("a"))
+	tracer.pushPayload(newTrace("b"))
+	tracer.pushPayload(newTrace(strings.Repeat("x", 3*len(b))))
+	assert.Equal([]string{"trace_too_large:1"}, dropped)
+	assert.Equal(2, tracer.payload.itemCount())
+	assert.Empty(transport.Payloads())
+
+	tracer.pushPayload(newTrace("c"))
+	tracer.wg.Wait()
+	payloads := transport.Payloads()
+	assert.Len(payloads, 1)
+	assert.Len(payloads[0], 2)
+	assert.Equal("a", payloads[0][0][0].Resource)
+	assert.Equal("b", payloads[0][1][0].Resource)
+	assert.Equal(1, tracer.payload.itemCount())
+	assert.Equal("c", tracer.payload.traces[0][0].Resource)
+	assert.True(tracer.payload.size() <= tracer.config.payloadMaxSize)
+
+	calls := tg.CountCalls()
+	var n int64
+	for _, c := range calls {
+		if c.name == "datadog.tracer.traces_dropped" {
+			assert.Equal([]string{"reason:trace_too_large"}, c.tags)
+			n += c.intVal
+		}
+	}
+	assert.Equal(int64(1), n)
+	log.Flush()
+}
+
+func TestTracerPayloadPerService(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	transport := newPayloadsTransport()
+	tracer := newUnstartedTracer(withTransport(transport), WithStatsdClient(&tg), WithPayloadPerService())
+	push := func(service string) {
+		s := newBasicSpan("op")
+		s.Service = service
+		tracer.pushPayload([]*span{s, newBasicSpan("child")})
+	}
+
+	push("a")
+	push("b")
+	push("a")
+	traces, _ := tracer.buffered()
+	assert.Equal(3, traces)
+	tracer.flush(flushReasonScheduled)
+	tracer.wg.Wait()
+
+	payloads := transport.Payloads()
+	assert.Len(payloads, 2)
+	counts := make(map[string]int)
+	for _, p := range payloads {
+		service := p[0][0].Service
+		for _, trace := range p {
+			assert.Equal(service, trace[0].Service)
+		}
+		counts[service] += len(p)
+	}
+	assert.Equal(map[string]int{"a": 2, "b": 1}, counts)
+	flushed := make(map[string]int64)
+	for _, c := range tg.CountCalls() {
+		if c.name == "datadog.tracer.flush_traces" {
+			assert.Len(c.tags, 1)
+			flushed[c.tags[0]] += c.intVal
+		}
+	}
+	assert.Equal(map[string]int64{"service:a": 2, "service:b": 1}, flushed)
+
+	// reaching the size limit only flushes the payload of that service
+	push("b")
+	tracer.config.payloadSizeLimit = 1
+	push("a")
+	tracer.wg.Wait()
+	traces, _ = tracer.buffered()
+	assert.Equal(1, traces)
+	payloads = transport.Payloads()
+	assert.Len(payloads, 3)
+	assert.Len(payloads[2], 1)
+	assert.Equal("a", payloads[2][0][0].Service)
+}
+
+func TestTracerEndpointSelector(t *testing.T) {
+	// endpoint is a fake collector counting the traces it receives.
+	type endpoint struct {
+		*httptest.Server
+		response string
+		traces   int64
+	}
+	newEndpoint := func(response string) *endpoint {
+		e := &endpoint{response: response}
+		e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := strconv.Atoi(r.Header.Get(traceCountHeader))
+			atomic.AddInt64(&e.traces, int64(n))
+			w.Write([]byte(e.response))
+		}))
+		return e
+	}
+	agent, shardA, shardB := newEndpoint(`{}`), newEndpoint("OK"), newEndpoint(`{"rate_by_service":{"service:,env:":0.1}}`)
+	defer agent.Close()
+	defer shardA.Close()
+	defer shardB.Close()
+	var (
+		mu    sync.Mutex
+		metas []PayloadMeta
+	)
+	selector := func(meta PayloadMeta) string {
+		mu.Lock()
+		metas = append(metas, meta)
+		mu.Unlock()
+		switch meta.Service {
+		case "a":
+			return shardA.URL + "/v0.4/traces"
+		case "b":
+			return shardB.URL + "/v0.4/traces"
+		}
+		return ""
+	}
+	// flush pushes a trace for each of the given services and flushes them.
+	flush := func(tracer *tracer, services ...string) {
+		for _, service := range services {
+			s := newBasicSpan("op")
+			s.Service = service
+			tracer.pushPayload([]*span{s})
+		}
+		tracer.flush(flushReasonScheduled)
+		tracer.wg.Wait()
+	}
+	// assertTraces asserts the number of traces received by the agent and each shard.
+	assertTraces := func(t *testing.T, agentTraces, aTraces, bTraces int64) {
+		assert.Equal(t, agentTraces, atomic.LoadInt64(&agent.traces), "agent")
+		assert.Equal(t, aTraces, atomic.LoadInt64(&shardA.traces), "shard a")
+		assert.Equal(t, bTraces, atomic.LoadInt64(&shardB.traces), "shard b")
+	}
+	addr := strings.TrimPrefix(agent.URL, "http://")
+
+	t.Run("per-service", func(t *testing.T) {
+		var tg testStatsdClient
+		tracer := newUnstartedTracer(WithAgentAddr(addr), WithPayloadPerService(), WithEndpointSelector(selector), WithStatsdClient(&tg))
+		flush(tracer, "a", "b", "a", "c")
+		assertTraces(t, 1, 2, 1)
+		// the responses of the shards are not read as sampling rates
+		assert.Empty(t, tracer.prioritySampling.receivedRates())
+		for _, c := range tg.IncrCalls() {
+			assert.NotEqual(t, "datadog.tracer.decode_error", c.name)
+		}
+	})
+
+	t.Run("dominant", func(t *testing.T) {
+		tracer := newUnstartedTracer(WithAgentAddr(addr), WithEndpointSelector(selector))
+		flush(tracer, "b", "a", "b")
+		assertTraces(t, 1, 2, 4)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, PayloadMeta{Service: "b", Traces: 3}, metas[len(metas)-1])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tracer := newUnstartedTracer(WithAgentAddr(addr))
+		flush(tracer, "a", "b")
+		assertTraces(t, 3, 2, 4)
+	})
+}
+
+func TestTracerMinFlushSize(t *testing.T) {
+	// tickFlushed ticks the tracer twice, ensuring the first tick was handled, and
+	// reports whether it flushed the buffered trace.
+	tickFlushed := func(tracer *tracer, ticks chan time.Time) bool {
+		ticks <- time.Now()
+		ticks <- time.Now()
+		return atomic.LoadInt64(&tracer.bufferedTraces) == 0
+	}
+	// buffer finishes a trace and waits for the worker to buffer it.
+	buffer := func(t *testing.T, tracer *tracer) {
+		tracer.StartSpan("op").Finish()
+		timeout := time.After(time.Second)
+		for atomic.LoadInt64(&tracer.bufferedTraces) != 1 {
+			select {
+			case <-timeout:
+				t.Fatal("timed out waiting for the trace to be buffered")
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	t.Run("held", func(t *testing.T) {
+		assert := assert.New(t)
+		ticks := make(chan time.Time)
+		maxHold := 50 * time.Millisecond
+		tracer, transport, _, stop := startTestTracer(t, withTickChan(ticks), WithMinFlushSize(1<<20, maxHold))
+		defer stop()
+
+		buffer(t, tracer)
+		start := time.Now()
+		assert.False(tickFlushed(tracer, ticks))
+		time.Sleep(maxHold - time.Since(start))
+		assert.True(tickFlushed(tracer, ticks))
+		timeout := time.After(time.Second)
+		for transport.Len() != 1 {
+			select {
+			case <-timeout:
+				t.Fatal("timed out waiting for the flush")
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+	})
+
+	t.Run("above", func(t *testing.T) {
+		assert := assert.New(t)
+		ticks := make(chan time.Time)
+		tracer, _, _, stop := startTestTracer(t, withTickChan(ticks), WithMinFlushSize(1, time.Minute))
+		defer stop()
+
+		buffer(t, tracer)
+		assert.True(tickFlushed(tracer, ticks))
+	})
+}
+
+func TestTracerStopTimeout(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	transport := newBlockingTransport()
+	defer transport.Unblock()
+	tracer, _, _, stop := startTestTracer(t, withTransport(transport), WithStatsdClient(&tg), WithStopTimeout(50*time.Millisecond))
+	defer stop()
+
+	tracer.StartSpan("op").Finish()
+	tracer.StartSpan("op").Finish()
+	start := time.Now()
+	tracer.Stop()
+	assert.True(time.Since(start) < time.Second)
+	assert.True(tracer.abandoned())
+	assert.Equal(int64(1), tg.Counts()["datadog.tracer.stop_timeout"])
+	var dropped []testStatsdCall
+	for _, c := range tg.CountCalls() {
+		if c.name == "datadog.tracer.traces_dropped" && c.tags[0] == "reason:stop_timeout" {
+			dropped = append(dropped, c)
+		}
+	}
+	assert.Len(dropped, 1)
+	assert.Equal(int64(2), dropped[0].intVal)
+}
+
+func TestPauseResume(t *testing.T) {
+	assert := assert.New(t)
+	var tg testStatsdClient
+	tracer, transport, _, stop := startTestTracer(t, WithStatsdClient(&tg))
+	defer stop()
+
+	tracer.StartSpan("before").Finish()
+	for tracer.writerStats().BufferedTraces == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	Pause()
+	tracer.StartSpan("paused").Finish()
+	tracer.StartSpan("paused").Finish()
+	Flush()
+	assert.Equal(0, transport.Len())
+	var tags []string
+	for _, c := range tg.CountCalls() {
+		if c.name == "datadog.tracer.traces_dropped" {
+			tags = append(tags, c.tags...)
+		}
+	}
+	assert.Equal([]string{"reason:paused", "reason:paused"}, tags)
+
+	Resume()
+	Flush()
+	assert.Equal(1, transport.Len())
+	tracer.StartSpan("after").Finish()
+	Flush()
+	traces := transport.Traces()
+	if assert.Len(traces, 2) {
+		assert.Equal("before", traces[0][0].Name)
+		assert.Equal("after", traces[1][0].Name)
+	}
+}
+
+func TestPauseStop(t *testing.T) {
+	tracer, transport, _, stop := startTestTracer(t)
+	defer stop()
+
+	tracer.StartSpan("before").Finish()
+	for tracer.writerStats().BufferedTraces == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	Pause()
+	tracer.Stop()
+	// buffered traces are still sent when stopping
+	assert.Equal(t, 1, transport.Len())
+}
+
+func TestFlushTrace(t *testing.T) {
+	// receive returns the value received on ch, failing the test after a second.
+	receive := func(t *testing.T, ch <-chan bool) bool {
+		select {
+		case ok := <-ch:
+			return ok
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the delivery")
+			return false
+		}
+	}
+
+	t.Run("delivered", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		tracer, transport, _, stop := startTestTracer(t, WithStatsdClient(&tg))
+		defer stop()
+
+		tracer.StartSpan("other").Finish()
+		root := tracer.StartSpan("root")
+		delivered := FlushTrace(root.Context().SpanID())
+		tracer.StartSpan("child", ChildOf(root.Context())).Finish()
+		root.Finish()
+
+		// flushed without waiting for the flush interval
+		assert.True(receive(t, delivered))
+		assert.Len(transport.Traces(), 2)
+		var reasons []string
+		for _, c := range tg.IncrCalls() {
+			if c.name == "datadog.tracer.flush_triggered" {
+				reasons = append(reasons, c.tags...)
+			}
+		}
+		assert.Equal([]string{"reason:priority"}, reasons)
+		assert.Empty(tracer.priorityFlushes)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		defer func(old time.Duration) { sendRetryBaseDelay = old }(sendRetryBaseDelay)
+		sendRetryBaseDelay = time.Millisecond
+		transport := newFailingTransport(sendAttempts, errors.New("connection refused"))
+		tracer, _, _, stop := startTestTracer(t, withTransport(transport))
+		defer stop()
+
+		root := tracer.StartSpan("root")
+		delivered := FlushTrace(root.Context().SpanID())
+		root.Finish()
+		assert.False(t, receive(t, delivered))
+		log.Flush()
+	})
+
+	t.Run("dropped", func(t *testing.T) {
+		tracer, transport, _, stop := startTestTracer(t, WithSpanFilter(func(*SpanData) bool { return false }))
+		defer stop()
+
+		root := tracer.StartSpan("root")
+		delivered := FlushTrace(root.Context().SpanID())
+		root.Finish()
+		assert.False(t, receive(t, delivered))
+		assert.Equal(t, 0, transport.Len())
+	})
+
+	t.Run("exported", func(t *testing.T) {
+		var exported int32
+		tracer, transport, _, stop := startTestTracer(t, WithExportFunc(func([]Span) {
+			atomic.AddInt32(&exported, 1)
+		}))
+		defer stop()
+
+		root := tracer.StartSpan("root")
+		delivered := FlushTrace(root.Context().SpanID())
+		root.Finish()
+		assert.True(t, receive(t, delivered))
+		assert.EqualValues(t, 1, atomic.LoadInt32(&exported))
+		assert.Equal(t, 0, transport.Len())
+	})
+
+	t.Run("not-started", func(t *testing.T) {
+		assert.False(t, receive(t, FlushTrace(1)))
+	})
+
+	t.Run("backpressure", func(t *testing.T) {
+		tracer := newUnstartedTracer(WithBackpressure(1, BackpressureDropNewest, 0))
+		atomic.StoreInt64(&tracer.bufferedBytes, 10)
+		root := newBasicSpan("root")
+		delivered := tracer.flushTrace(root.SpanID)
+		tracer.pushTrace([]*span{root})
+		assert.False(t, receive(t, delivered))
+		assert.Empty(t, tracer.priorityFlushes)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		defer func(old time.Duration) { priorityFlushTimeout = old }(priorityFlushTimeout)
+		priorityFlushTimeout = time.Hour
+		tracer := newUnstartedTracer()
+		old := tracer.flushTrace(1)
+		tracer.priorityFlushes[1].marked = time.Now().Add(-2 * time.Hour)
+		recent := tracer.flushTrace(2)
+		tracer.expirePriorityFlushes(time.Now())
+		assert.False(t, receive(t, old))
+		assert.Len(t, tracer.priorityFlushes, 1)
+
+		// all the remaining traces expire when stopping
+		close(tracer.stop)
+		tracer.expirePriorityFlushes(time.Time{})
+		assert.False(t, receive(t, recent))
+		assert.Empty(t, tracer.priorityFlushes)
+		assert.False(t, receive(t, tracer.flushTrace(3)))
+		assert.Empty(t, tracer.priorityFlushes)
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		tracer, _, _, stop := startTestTracer(t)
+		root := tracer.StartSpan("root")
+		delivered := FlushTrace(root.Context().SpanID())
+		stop()
+		assert.False(t, receive(t, delivered))
+		assert.Empty(t, tracer.priorityFlushes)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		tracer := newUnstartedTracer()
+		for i := 1; i <= maxPriorityFlushes; i++ {
+			tracer.flushTrace(uint64(i))
+		}
+		// marking an already marked trace is allowed
+		tracer.flushTrace(1)
+		assert.Len(t, tracer.priorityFlushes, maxPriorityFlushes)
+		assert.False(t, receive(t, tracer.flushTrace(maxPriorityFlushes+1)))
+		assert.Len(t, tracer.priorityFlushes, maxPriorityFlushes)
+	})
+
+	t.Run("drained", func(t *testing.T) {
+		tracer := newUnstartedTracer()
+		ch := make(chan bool, 1)
+		tracer.pushPayload([]*span{newBasicSpan("root")})
+		tracer.payload.deliveries = append(tracer.payload.deliveries, ch)
+		go tracer.worker(nil, nil)
+		defer close(tracer.stop)
+		assert.Len(t, tracer.drain(), 1)
+		assert.False(t, receive(t, ch))
+	})
+}
+
+func TestFlushAndStop(t *testing.T) {
+	t.Run("sent", func(t *testing.T) {
+		assert := assert.New(t)
+		tracer, transport, _, stop := startTestTracer(t)
+		defer stop()
+
+		tracer.StartSpan("op").Finish()
+		tracer.StartSpan("op").Finish()
+		assert.NoError(FlushAndStop(context.Background()))
+		assert.Len(transport.Traces(), 2)
+		assert.False(tracer.abandoned())
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		assert := assert.New(t)
+		var tg testStatsdClient
+		transport := newBlockingTransport()
+		defer transport.Unblock()
+		tracer, _, _, stop := startTestTracer(t, withTransport(transport), WithStatsdClient(&tg), WithStopTimeout(time.Minute))
+		defer stop()
+
+		tracer.StartSpan("op").Finish()
+		tracer.StartSpan("op").Finish()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := FlushAndStop(ctx)
+		assert.True(time.Since(start) < time.Second)
+		assert.True(tracer.abandoned())
+		if assert.IsType(&UnsentTracesError{}, err) {
+			assert.Equal(2, err.(*UnsentTracesError).Unsent)
+			assert.Equal(context.DeadlineExceeded, err.(*UnsentTracesError).Err)
+		}
+		var dropped int64
+		for _, c := range tg.CountCalls() {
+			if c.name == "datadog.tracer.traces_dropped" && c.tags[0] == "reason:stop_timeout" {
+				dropped += c.intVal
+			}
+		}
+		assert.Equal(int64(2), dropped)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		assert := assert.New(t)
+		release := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// hold the request until the tracer gives up on it
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}))
+		defer srv.Close()
+		defer close(release)
+		transport := newHTTPTransport(strings.TrimPrefix(srv.URL, "http://"), defaultClient)
+		tracer, _, _, stop := startTestTracer(t, withTransport(transport), WithStopTimeout(time.Minute))
+		defer stop()
+
+		tracer.StartSpan("op").Finish()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.IsType(&UnsentTracesError{}, FlushAndStop(ctx))
+
+		// the abandoned send is interrupted rather than left running
+		done := make(chan struct{})
+		go func() {
+			tracer.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("abandoned flush is still running")
+		}
+	})
+}
+
+func TestTracerReportsHostname(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		os.Setenv("DD_TRACE_REPORT_HOSTNAME", "true")
+		defer os.Unsetenv("DD_TRACE_REPORT_HOSTNAME")
+
+		tracer, _, _, stop := startTestTracer(t)
+		defer stop()
+
+		root := tracer.StartSpan("root").(*span)
+		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+		child.Finish()
+		root.Finish()
+
+		assert := assert.New(t)
+
+		name, ok := root.Meta[keyHostname]
+		assert.True(ok)
+		assert.Equal(name, tracer.hostname)
+
+		_, ok = child.Meta[keyHostname]
+		assert.False(ok)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		tracer, _, _, stop := startTestTracer(t)
+		defer stop()
+
+		root := tracer.StartSpan("root").(*span)
+		child := tracer.StartSpan("child", ChildOf(root.Context())).(*span)
+		child.Finish()
+		root.Finish()
+
+		assert := assert.New(t)
+
+		_, ok := root.Meta[keyHostname]
+		assert.False(ok)
+		_, ok = child.Meta[keyHostname]
 		assert.False(ok)
 	})
 }
@@ -1062,6 +3514,27 @@ func TestVersion(t *testing.T) {
 
 // BenchmarkConcurrentTracing tests the performance of spawning a lot of
 // goroutines where each one creates a trace with a parent and a child.
+func BenchmarkPushPayload(b *testing.B) {
+	for _, n := range []int{1, 100} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			tracer := newUnstartedTracer(WithStatsdClient(&statsd.NoOpClient{}))
+			trace := make([]*span, n)
+			for i := range trace {
+				trace[i] = newBasicSpan("op")
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if tracer.payload.size() > payloadSizeLimit/2 {
+					// don't let the payload reach the size which triggers a flush
+					tracer.payload.reset()
+				}
+				tracer.pushPayload(trace)
+			}
+		})
+	}
+}
+
 func BenchmarkConcurrentTracing(b *testing.B) {
 	tracer, _, _, stop := startTestTracer(b, WithSampler(NewRateSampler(0)))
 	defer stop()
@@ -1163,7 +3636,7 @@ func (t *dummyTransport) Len() int {
 	return len(t.traces)
 }
 
-func (t *dummyTransport) send(p *payload) (io.ReadCloser, error) {
+func (t *dummyTransport) send(ctx context.Context, p *payload) (io.ReadCloser, error) {
 	traces, err := decode(p)
 	if err != nil {
 		return nil, err
@@ -1179,6 +3652,132 @@ func (t *dummyTransport) endpoint() string {
 	return "http://localhost:9/v0.4/traces"
 }
 
+// failingTransport is a dummyTransport which consumes the payload and fails
+// with a given error for the first few calls to send.
+type failingTransport struct {
+	*dummyTransport
+
+	mu       sync.Mutex
+	failures int   // number of sends left to fail
+	err      error // error to fail with
+	calls    int   // total number of calls to send
+}
+
+func newFailingTransport(failures int, err error) *failingTransport {
+	return &failingTransport{
+		dummyTransport: newDummyTransport(),
+		failures:       failures,
+		err:            err,
+	}
+}
+
+func (t *failingTransport) send(ctx context.Context, p *payload) (io.ReadCloser, error) {
+	t.mu.Lock()
+	t.calls++
+	fail := t.failures > 0
+	if fail {
+		t.failures--
+	}
+	t.mu.Unlock()
+	if fail {
+		ioutil.ReadAll(p)
+		return nil, t.err
+	}
+	return t.dummyTransport.send(ctx, p)
+}
+
+func (t *failingTransport) Calls() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls
+}
+
+// ratesTransport is a dummyTransport which responds with the given sampling rates.
+type ratesTransport struct {
+	*dummyTransport
+	rates string
+}
+
+func (t *ratesTransport) send(ctx context.Context, p *payload) (io.ReadCloser, error) {
+	if _, err := t.dummyTransport.send(ctx, p); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(strings.NewReader(t.rates)), nil
+}
+
+// payloadsTransport is a dummyTransport which also records the traces of each
+// payload separately.
+type payloadsTransport struct {
+	*dummyTransport
+
+	mu       sync.Mutex
+	payloads []spanLists
+}
+
+func newPayloadsTransport() *payloadsTransport {
+	return &payloadsTransport{dummyTransport: newDummyTransport()}
+}
+
+func (t *payloadsTransport) send(ctx context.Context, p *payload) (io.ReadCloser, error) {
+	traces, err := decode(p)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.payloads = append(t.payloads, traces)
+	t.mu.Unlock()
+	return ioutil.NopCloser(strings.NewReader("OK")), nil
+}
+
+func (t *payloadsTransport) Payloads() []spanLists {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]spanLists(nil), t.payloads...)
+}
+
+// hangingTransport is a dummyTransport whose sends never complete, until their
+// context is done.
+type hangingTransport struct {
+	*dummyTransport
+}
+
+func (t hangingTransport) send(ctx context.Context, p *payload) (io.ReadCloser, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// slowTransport is a dummyTransport whose sends take delay to complete.
+type slowTransport struct {
+	*dummyTransport
+	delay time.Duration
+}
+
+func (t slowTransport) send(ctx context.Context, p *payload) (io.ReadCloser, error) {
+	time.Sleep(t.delay)
+	return ioutil.NopCloser(strings.NewReader("OK")), nil
+}
+
+// blockingTransport is a dummyTransport which blocks on send until unblocked.
+type blockingTransport struct {
+	*dummyTransport
+	unblock chan struct{}
+}
+
+func newBlockingTransport() *blockingTransport {
+	return &blockingTransport{
+		dummyTransport: newDummyTransport(),
+		unblock:        make(chan struct{}),
+	}
+}
+
+func (t *blockingTransport) send(ctx context.Context, p *payload) (io.ReadCloser, error) {
+	<-t.unblock
+	return t.dummyTransport.send(ctx, p)
+}
+
+// Unblock unblocks all pending and future sends.
+func (t *blockingTransport) Unblock() { close(t.unblock) }
+
 func decode(p *payload) (spanLists, error) {
 	var traces spanLists
 	err := msgp.Decode(p, &traces)
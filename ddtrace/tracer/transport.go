@@ -6,17 +6,24 @@
 package tracer
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/DataDog/dd-trace-go.v1/internal"
+	"gopkg.in/DataDog/dd-trace-go.v1/internal/log"
 	"gopkg.in/DataDog/dd-trace-go.v1/internal/version"
 )
 
@@ -45,13 +52,15 @@ const (
 	defaultAddress     = defaultHostname + ":" + defaultPort
 	defaultHTTPTimeout = 2 * time.Second         // defines the current timeout before giving up with the send process
 	traceCountHeader   = "X-Datadog-Trace-Count" // header containing the number of traces in the payload
+	requestIDHeader    = "X-Datadog-Request-Id"  // header identifying the payload, for correlation with the agent's logs
 )
 
 // transport is an interface for span submission to the agent.
 type transport interface {
-	// send sends the payload p to the agent using the transport set up.
-	// It returns a non-nil response body when no error occurred.
-	send(p *payload) (body io.ReadCloser, err error)
+	// send sends the payload p to the agent using the transport set up, giving
+	// up once ctx is done. It returns a non-nil response body when no error
+	// occurred, which must be closed to release the resources tied to ctx.
+	send(ctx context.Context, p *payload) (body io.ReadCloser, err error)
 	// endpoint returns the URL to which the transport will send traces.
 	endpoint() string
 }
@@ -60,28 +69,94 @@ type transport interface {
 // trace agent running on the given hostname and port, using a given
 // http.RoundTripper. If the zero values for hostname and port are provided,
 // the default values will be used ("localhost" for hostname, and "8126" for
-// port). If roundTripper is nil, a default is used.
+// port). If roundTripper is nil, a default is used. If path is not empty, traces
+// are sent to it instead of the path of the trace API version.
 //
 // In general, using this method is only necessary if you have a trace agent
 // running on a non-default port, if it's located on another machine, or when
 // otherwise needing to customize the transport layer, for instance when using
 // a unix domain socket.
-func newTransport(addr string, client *http.Client) transport {
+func newTransport(addr string, client *http.Client, version, path string) transport {
 	if client == nil {
 		client = defaultClient
 	}
-	return newHTTPTransport(addr, client)
+	t := newHTTPTransport(addr, client)
+	if path != "" {
+		t.path = path
+		t.useVersion(t.version)
+	}
+	if version != "" {
+		t.useVersion(version)
+	}
+	return t
+}
+
+// newUDSClient returns an HTTP client which connects to the agent through the
+// Unix domain socket at the given path, regardless of the request URL.
+func newUDSClient(path string) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, "unix", path)
+				if err != nil {
+					return nil, socketError(path, err)
+				}
+				return conn, nil
+			},
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		Timeout: defaultHTTPTimeout,
+	}
+}
+
+// socketError returns err, which occurred when dialing the agent socket at path,
+// with an explanation of the common causes of failure.
+func socketError(path string, err error) error {
+	cause := err
+	if oerr, ok := cause.(*net.OpError); ok {
+		cause = oerr.Err
+	}
+	if serr, ok := cause.(*os.SyscallError); ok {
+		cause = serr.Err
+	}
+	switch cause {
+	case syscall.ENOENT:
+		return fmt.Errorf("agent socket %s not found, is the agent's socket mounted? (%v)", path, err)
+	case syscall.ECONNREFUSED:
+		return fmt.Errorf("agent socket %s refused the connection, is the agent running? (%v)", path, err)
+	default:
+		return err
+	}
 }
 
+// traceAPIVersions lists the supported versions of the agent's trace API, from the
+// newest to the oldest. v0.4 and v0.3 accept the msgpack encoding of the payload as
+// is, while v0.5 payloads are re-encoded using its string table schema.
+var traceAPIVersions = []string{"v0.5", "v0.4", "v0.3"}
+
+// defaultTraceAPIVersion is the version of the agent's trace API used by default.
+const defaultTraceAPIVersion = "v0.4"
+
 // newDefaultTransport return a default transport for this tracing client
 func newDefaultTransport() transport {
 	return newHTTPTransport(defaultAddress, defaultClient)
 }
 
 type httpTransport struct {
-	traceURL string            // the delivery URL for traces
-	client   *http.Client      // the HTTP client used in the POST
-	headers  map[string]string // the Transport headers
+	addr    string            // the resolved address of the agent
+	path    string            // the path overriding the trace API's, if set
+	client  *http.Client      // the HTTP client used in the POST
+	headers map[string]string // the Transport headers
+
+	mu       sync.RWMutex // guards below fields
+	version  string       // the trace API version in use
+	traceURL string       // the delivery URL for traces
 }
 
 // newHTTPTransport returns an httpTransport for the given endpoint
@@ -92,33 +167,123 @@ func newHTTPTransport(addr string, client *http.Client) *httpTransport {
 		"Datadog-Meta-Lang-Version":     strings.TrimPrefix(runtime.Version(), "go"),
 		"Datadog-Meta-Lang-Interpreter": runtime.Compiler + "-" + runtime.GOARCH + "-" + runtime.GOOS,
 		"Datadog-Meta-Tracer-Version":   version.Tag,
-		"Content-Type":                  "application/msgpack",
 	}
 	if cid := internal.ContainerID(); cid != "" {
 		defaultHeaders["Datadog-Container-ID"] = cid
 	}
-	return &httpTransport{
-		traceURL: fmt.Sprintf("http://%s/v0.4/traces", resolveAddr(addr)),
-		client:   client,
-		headers:  defaultHeaders,
+	t := &httpTransport{
+		addr:    resolveAddr(addr),
+		client:  client,
+		headers: defaultHeaders,
 	}
+	t.useVersion(defaultTraceAPIVersion)
+	return t
 }
 
-func (t *httpTransport) send(p *payload) (body io.ReadCloser, err error) {
-	req, err := http.NewRequest("POST", t.traceURL, p)
+// useVersion makes t send traces to version v of the agent's trace API.
+func (t *httpTransport) useVersion(v string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.version = v
+	t.traceURL = t.urlFor(v)
+}
+
+// urlFor returns the URL to which traces are sent using version v of the trace
+// API, which is that of the overriding path if set.
+func (t *httpTransport) urlFor(v string) string {
+	if t.path != "" {
+		return "http://" + t.addr + t.path
+	}
+	return fmt.Sprintf("http://%s/%s/traces", t.addr, v)
+}
+
+// fallback switches t to the trace API version preceding version, after the agent
+// rejected it. It reports whether there is a version to retry the send with, which
+// is also the case when another send already switched away from version.
+func (t *httpTransport) fallback(version string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.path != "" {
+		// the version is not part of the URL
+		return false
+	}
+	if t.version != version {
+		return true
+	}
+	for i, v := range traceAPIVersions[:len(traceAPIVersions)-1] {
+		if v == version {
+			t.version = traceAPIVersions[i+1]
+			t.traceURL = t.urlFor(t.version)
+			log.Warn("Agent rejected trace API %s, falling back to %s.", version, t.version)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *httpTransport) send(ctx context.Context, p *payload) (body io.ReadCloser, err error) {
+	t.mu.RLock()
+	version, traceURL := t.version, t.traceURL
+	t.mu.RUnlock()
+	if p.target != "" {
+		traceURL = p.target
+	}
+	var reqBody io.Reader = p
+	size := p.size()
+	v05 := version == "v0.5" && p.msgpack()
+	if v05 {
+		b, err := p.encodeV05()
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode payload for trace API v0.5: %v", err)
+		}
+		reqBody, size = bytes.NewReader(b), len(b)
+	}
+	req, err := http.NewRequest("POST", traceURL, reqBody)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create http request: %v", err)
 	}
+	req = req.WithContext(ctx)
 	for header, value := range t.headers {
 		req.Header.Set(header, value)
 	}
+	req.Header.Set("Content-Type", p.contentType())
 	req.Header.Set(traceCountHeader, strconv.Itoa(p.itemCount()))
-	req.Header.Set("Content-Length", strconv.Itoa(p.size()))
+	req.Header.Set(requestIDHeader, p.id)
+	// the client ignores the Content-Length header, and can not tell the length
+	// of a payload body, which it would otherwise send chunked
+	req.ContentLength = int64(size)
+	if p.compressed() {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 	response, err := t.client.Do(req)
 	if err != nil {
+		// the client closes the body even on errors, but possibly only after
+		// Do returns; wait for it so that the payload can be safely reused. A
+		// RoundTripper may also fail without ever closing it, so the wait ends
+		// with the send's context.
+		if !v05 {
+			select {
+			case <-p.closed:
+			case <-ctx.Done():
+			}
+		}
 		return nil, err
 	}
-	p.waitClose()
+	if !v05 {
+		p.waitClose()
+	}
+	if code := response.StatusCode; code == http.StatusNotFound || code == http.StatusUnsupportedMediaType && !p.compressed() {
+		// the agent may not support this version of the trace API; compressed
+		// payloads rejected with 415 are handled by the caller, which resends
+		// them uncompressed first. Payloads sent to a selected endpoint are
+		// not retried, since the version is not part of its URL, and neither
+		// are those of other encoders, since the rejection is likely theirs.
+		if p.target == "" && p.msgpack() && t.fallback(version) {
+			response.Body.Close()
+			p.rewind()
+			return t.send(ctx, p)
+		}
+	}
 	if code := response.StatusCode; code >= 400 {
 		// error, check the body for context information and
 		// return a nice error.
@@ -127,17 +292,134 @@ func (t *httpTransport) send(p *payload) (body io.ReadCloser, err error) {
 		response.Body.Close()
 		txt := http.StatusText(code)
 		if n > 0 {
-			return nil, fmt.Errorf("%s (Status: %s)", msg[:n], txt)
+			return nil, &statusError{code: code, msg: fmt.Sprintf("%s (Status: %s)", msg[:n], txt)}
 		}
-		return nil, fmt.Errorf("%s", txt)
+		return nil, &statusError{code: code, msg: txt}
 	}
 	return response.Body, nil
 }
 
+// statusError is returned by the HTTP transport when the agent responds
+// with an error status code.
+type statusError struct {
+	code int    // HTTP status code
+	msg  string // error message
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// isRetriable reports whether a send which failed with err may succeed when
+// retried. This is the case for network errors and 5xx responses.
+func isRetriable(err error) bool {
+	if serr, ok := err.(*statusError); ok {
+		return serr.code >= 500
+	}
+	return true
+}
+
+// isStatus reports whether err is a *statusError having any of the given
+// status codes.
+func isStatus(err error, codes ...int) bool {
+	serr, ok := err.(*statusError)
+	if !ok {
+		return false
+	}
+	for _, c := range codes {
+		if serr.code == c {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *httpTransport) endpoint() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return t.traceURL
 }
 
+// warmer is implemented by transports which can establish their connection to
+// the agent ahead of the first send.
+type warmer interface {
+	// warmup connects to the agent, leaving the connection open for reuse. It
+	// returns the information the agent reports about itself, or nil if the agent
+	// does not report any.
+	warmup() (*agentInfo, error)
+}
+
+var _ warmer = (*httpTransport)(nil)
+
+// agentInfo holds the parts of the response of the agent's /info endpoint used by
+// the tracer.
+type agentInfo struct {
+	Version string `json:"version"` // version of the agent, e.g. "7.21.1"
+}
+
+// minCompressionAgentVersion is the oldest agent version accepting gzip-compressed
+// trace payloads, as major, minor and patch numbers.
+var minCompressionAgentVersion = []int{7, 0, 0}
+
+// supportsCompression reports whether the agent accepts compressed payloads.
+func (i *agentInfo) supportsCompression() bool {
+	return versionAtLeast(i.Version, minCompressionAgentVersion)
+}
+
+// versionAtLeast reports whether v, a version of the form "major.minor.patch"
+// possibly followed by a pre-release or build suffix, is at least min. Versions
+// which can not be parsed are not.
+func versionAtLeast(v string, min []int) bool {
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	for i, m := range min {
+		var n int
+		if i < len(parts) {
+			var err error
+			if n, err = strconv.Atoi(parts[i]); err != nil {
+				return false
+			}
+		}
+		if n != m {
+			return n > m
+		}
+	}
+	return true
+}
+
+// warmup requests the agent's /info endpoint, so that the connection is kept in
+// the client's pool for the first send. Older agents do not serve /info, in which
+// case a nil *agentInfo is returned without error.
+func (t *httpTransport) warmup() (*agentInfo, error) {
+	resp, err := t.client.Get(fmt.Sprintf("http://%s/info", t.addr))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var info *agentInfo
+	if resp.StatusCode == http.StatusOK {
+		info = new(agentInfo)
+		if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+			log.Warn("Unable to decode the agent's /info response: %v", err)
+			info = nil
+		}
+	}
+	// the body must be read in full for the connection to be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	return info, nil
+}
+
+// discardTransport is a transport which discards all payloads, used in dry runs.
+type discardTransport struct{}
+
+var _ transport = discardTransport{}
+
+func (discardTransport) send(_ context.Context, p *payload) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("{}")), nil
+}
+
+func (discardTransport) endpoint() string { return "" }
+
 // resolveAddr resolves the given agent address and fills in any missing host
 // and port using the defaults. Some environment variable settings will
 // take precedence over configuration.
@@ -6,20 +6,28 @@
 package tracer
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/tinylib/msgp/msgp"
 )
 
 // integration indicates if the test suite should run integration tests.
@@ -101,7 +109,7 @@ func TestTracesAgentIntegration(t *testing.T) {
 		transport := newHTTPTransport(defaultAddress, defaultClient)
 		p, err := encode(tc.payload)
 		assert.NoError(err)
-		_, err = transport.send(p)
+		_, err = transport.send(context.Background(), p)
 		assert.NoError(err)
 	}
 }
@@ -168,7 +176,7 @@ func TestTransportResponse(t *testing.T) {
 			defer ln.Close()
 			addr := ln.Addr().String()
 			transport := newHTTPTransport(addr, defaultClient)
-			rc, err := transport.send(newPayload())
+			rc, err := transport.send(context.Background(), newPayload())
 			if tt.err != "" {
 				assert.Equal(tt.err, err.Error())
 				return
@@ -204,13 +212,289 @@ func TestTraceCountHeader(t *testing.T) {
 		transport := newHTTPTransport(host, defaultClient)
 		p, err := encode(tc.payload)
 		assert.NoError(err)
-		_, err = transport.send(p)
+		_, err = transport.send(context.Background(), p)
 		assert.NoError(err)
 	}
 
 	receiver.Close()
 }
 
+// decodeV05 decodes a payload encoded using the v0.5 schema of the trace API.
+func decodeV05(r io.Reader) (spanLists, error) {
+	dc := msgp.NewReader(r)
+	if _, err := dc.ReadArrayHeader(); err != nil {
+		return nil, err
+	}
+	n, err := dc.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, n)
+	for i := range strs {
+		if strs[i], err = dc.ReadString(); err != nil {
+			return nil, err
+		}
+	}
+	str := func() string {
+		i, e := dc.ReadUint32()
+		if e != nil || int(i) >= len(strs) {
+			err = fmt.Errorf("bad string index %d: %v", i, e)
+			return ""
+		}
+		return strs[i]
+	}
+	ntraces, err := dc.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	traces := make(spanLists, ntraces)
+	for i := range traces {
+		nspans, err := dc.ReadArrayHeader()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint32(0); j < nspans; j++ {
+			if n, err := dc.ReadArrayHeader(); err != nil || n != 12 {
+				return nil, fmt.Errorf("bad span of %d fields: %v", n, err)
+			}
+			s := &span{Service: str(), Name: str(), Resource: str()}
+			s.TraceID, _ = dc.ReadUint64()
+			s.SpanID, _ = dc.ReadUint64()
+			s.ParentID, _ = dc.ReadUint64()
+			s.Start, _ = dc.ReadInt64()
+			s.Duration, _ = dc.ReadInt64()
+			s.Error, _ = dc.ReadInt32()
+			if n, _ := dc.ReadMapHeader(); n > 0 {
+				s.Meta = make(map[string]string, n)
+				for ; n > 0; n-- {
+					k := str()
+					s.Meta[k] = str()
+				}
+			}
+			if n, _ := dc.ReadMapHeader(); n > 0 {
+				s.Metrics = make(map[string]float64, n)
+				for ; n > 0; n-- {
+					k := str()
+					s.Metrics[k], _ = dc.ReadFloat64()
+				}
+			}
+			s.Type = str()
+			if err != nil {
+				return nil, err
+			}
+			traces[i] = append(traces[i], s)
+		}
+	}
+	return traces, nil
+}
+
+func TestTransportContentLength(t *testing.T) {
+	for _, v := range []string{"v0.4", "v0.5"} {
+		t.Run(v, func(t *testing.T) {
+			var (
+				length   int64
+				size     int
+				encoding []string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				length, size, encoding = r.ContentLength, len(body), r.TransferEncoding
+				w.Write([]byte("{}"))
+			}))
+			defer srv.Close()
+			trans := newTransport(strings.TrimPrefix(srv.URL, "http://"), nil, v, "")
+			p, err := encode(getTestTrace(2, 2))
+			assert.NoError(t, err)
+			_, err = trans.send(context.Background(), p)
+			assert.NoError(t, err)
+			assert.EqualValues(t, size, length)
+			assert.Nil(t, encoding)
+		})
+	}
+}
+
+func TestTransportAPIVersion(t *testing.T) {
+	// newServer returns a server rejecting the trace API versions in rejected with
+	// the given status code, and a function returning the paths of the requests made.
+	// The Content-Type and the decoded traces of the requests are returned by
+	// requests.
+	var (
+		mu       sync.Mutex
+		types    []string
+		received []spanLists
+	)
+	requests := func() ([]string, []spanLists) {
+		mu.Lock()
+		defer mu.Unlock()
+		return types, received
+	}
+	newServer := func(code int, rejected ...string) (*httptest.Server, func() []string) {
+		var paths []string
+		mu.Lock()
+		types, received = nil, nil
+		mu.Unlock()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body = gz
+			}
+			var (
+				traces spanLists
+				err    error
+			)
+			switch {
+			case r.Header.Get("Content-Type") != "application/msgpack":
+				ioutil.ReadAll(body)
+			case r.URL.Path == "/v0.5/traces":
+				traces, err = decodeV05(body)
+			default:
+				err = msgp.Decode(body, &traces)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			paths = append(paths, r.URL.Path)
+			types = append(types, r.Header.Get("Content-Type"))
+			received = append(received, traces)
+			mu.Unlock()
+			for _, v := range rejected {
+				if r.URL.Path == "/"+v+"/traces" {
+					w.WriteHeader(code)
+					return
+				}
+			}
+			w.Write([]byte("{}"))
+		}))
+		return srv, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return paths
+		}
+	}
+	send := func(trans transport) error {
+		p, err := encode(getTestTrace(2, 2))
+		if err != nil {
+			return err
+		}
+		_, err = trans.send(context.Background(), p)
+		return err
+	}
+
+	// want holds the traces sent by send, as the agent decodes them.
+	var want spanLists
+	p, err := encode(getTestTrace(2, 2))
+	assert.NoError(t, err)
+	assert.NoError(t, msgp.Decode(p, &want))
+
+	for _, v := range []string{"v0.3", "v0.4", "v0.5"} {
+		t.Run(v, func(t *testing.T) {
+			srv, paths := newServer(http.StatusOK)
+			defer srv.Close()
+			trans := newTransport(strings.TrimPrefix(srv.URL, "http://"), nil, v, "")
+			assert.NoError(t, send(trans))
+			assert.Equal(t, []string{"/" + v + "/traces"}, paths())
+			types, received := requests()
+			assert.Equal(t, []string{"application/msgpack"}, types)
+			assert.Equal(t, []spanLists{want}, received)
+			assert.Equal(t, srv.URL+"/"+v+"/traces", trans.endpoint())
+		})
+	}
+
+	t.Run("v0.5-compressed", func(t *testing.T) {
+		srv, paths := newServer(http.StatusOK)
+		defer srv.Close()
+		trans := newTransport(strings.TrimPrefix(srv.URL, "http://"), nil, "v0.5", "")
+		p, err := encode(getTestTrace(2, 2))
+		assert.NoError(t, err)
+		assert.NoError(t, p.compress())
+		_, err = trans.send(context.Background(), p)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/v0.5/traces"}, paths())
+		_, received := requests()
+		assert.Equal(t, []spanLists{want}, received)
+	})
+
+	t.Run("fallback-v0.5", func(t *testing.T) {
+		srv, paths := newServer(http.StatusNotFound, "v0.5")
+		defer srv.Close()
+		trans := newTransport(strings.TrimPrefix(srv.URL, "http://"), nil, "v0.5", "")
+		assert.NoError(t, send(trans))
+		assert.Equal(t, []string{"/v0.5/traces", "/v0.4/traces"}, paths())
+		_, received := requests()
+		assert.Equal(t, []spanLists{want, want}, received)
+		assert.Equal(t, srv.URL+"/v0.4/traces", trans.endpoint())
+	})
+
+	t.Run("encoder", func(t *testing.T) {
+		// the rejection of a payload using another encoder is not blamed on
+		// the version
+		srv, paths := newServer(http.StatusUnsupportedMediaType, "v0.4")
+		defer srv.Close()
+		trans := newTransport(strings.TrimPrefix(srv.URL, "http://"), nil, "", "")
+		p := newEncoderPayload(jsonEncoder{})
+		assert.NoError(t, p.push(getTestTrace(1, 1)[0]))
+		_, err := trans.send(context.Background(), p)
+		assert.True(t, isStatus(err, http.StatusUnsupportedMediaType))
+		assert.Equal(t, []string{"/v0.4/traces"}, paths())
+		types, _ := requests()
+		assert.Equal(t, []string{"application/x-ndjson"}, types)
+		assert.Equal(t, srv.URL+"/v0.4/traces", trans.endpoint())
+	})
+
+	for _, code := range []int{http.StatusNotFound, http.StatusUnsupportedMediaType} {
+		t.Run("fallback-"+strconv.Itoa(code), func(t *testing.T) {
+			srv, paths := newServer(code, "v0.4")
+			defer srv.Close()
+			trans := newTransport(strings.TrimPrefix(srv.URL, "http://"), nil, "", "")
+			assert.NoError(t, send(trans))
+			assert.NoError(t, send(trans))
+			assert.Equal(t, []string{"/v0.4/traces", "/v0.3/traces", "/v0.3/traces"}, paths())
+			assert.Equal(t, srv.URL+"/v0.3/traces", trans.endpoint())
+		})
+	}
+
+	t.Run("exhausted", func(t *testing.T) {
+		srv, paths := newServer(http.StatusNotFound, "v0.4", "v0.3")
+		defer srv.Close()
+		trans := newTransport(strings.TrimPrefix(srv.URL, "http://"), nil, "", "")
+		err := send(trans)
+		assert.True(t, isStatus(err, http.StatusNotFound))
+		assert.Equal(t, []string{"/v0.4/traces", "/v0.3/traces"}, paths())
+	})
+}
+
+// failingRoundTripper fails every request without closing its body.
+type failingRoundTripper struct{}
+
+func (failingRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestTransportSendError(t *testing.T) {
+	trans := newHTTPTransport("localhost:8126", &http.Client{Transport: failingRoundTripper{}})
+	p, err := encode(getTestTrace(1, 1))
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := trans.send(ctx, p)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("send blocked waiting for the payload to be closed")
+	}
+}
+
 type recordingRoundTripper struct {
 	reqs []*http.Request
 }
@@ -237,7 +521,7 @@ func TestCustomTransport(t *testing.T) {
 	transport := newHTTPTransport(host, &http.Client{Transport: customRoundTripper})
 	p, err := encode(getTestTrace(1, 1))
 	assert.NoError(err)
-	_, err = transport.send(p)
+	_, err = transport.send(context.Background(), p)
 	assert.NoError(err)
 
 	// make sure our custom round tripper was used
@@ -259,7 +543,7 @@ func TestWithHTTPClient(t *testing.T) {
 
 	p, err := encode(getTestTrace(1, 1))
 	assert.NoError(err)
-	_, err = trc.config.transport.send(p)
+	_, err = trc.config.transport.send(context.Background(), p)
 	assert.NoError(err)
 	assert.Len(rt.reqs, 1)
 }
@@ -289,7 +573,7 @@ func TestTransportHTTPRace(t *testing.T) {
 		for j := 0; j < 100; j++ {
 			p.push(spanList)
 		}
-		trans.send(p)
+		trans.send(context.Background(), p)
 		p.reset()
 	}
 	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Millisecond)
@@ -297,3 +581,173 @@ func TestTransportHTTPRace(t *testing.T) {
 	srv.Shutdown(ctx)
 	<-done
 }
+
+func TestTransportWarmup(t *testing.T) {
+	// newServer returns a server counting the requests made to /info.
+	newServer := func() (*httptest.Server, *int32) {
+		var n int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/info" {
+				atomic.AddInt32(&n, 1)
+			}
+			w.Write([]byte("{}"))
+		}))
+		return srv, &n
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		srv, n := newServer()
+		defer srv.Close()
+		tracer := newTracer(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")), WithConnectionWarmup())
+		tracer.Stop()
+		assert.EqualValues(t, 1, atomic.LoadInt32(n))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		srv, n := newServer()
+		defer srv.Close()
+		tracer := newTracer(WithAgentAddr(strings.TrimPrefix(srv.URL, "http://")))
+		tracer.Stop()
+		assert.EqualValues(t, 0, atomic.LoadInt32(n))
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		trans := newHTTPTransport("localhost:9", &http.Client{Timeout: time.Second})
+		_, err := trans.warmup()
+		assert.Error(t, err)
+	})
+
+	t.Run("info", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"version":"7.21.1","endpoints":["/v0.4/traces"]}`))
+		}))
+		defer srv.Close()
+		info, err := newHTTPTransport(strings.TrimPrefix(srv.URL, "http://"), defaultClient).warmup()
+		assert.NoError(t, err)
+		assert.Equal(t, &agentInfo{Version: "7.21.1"}, info)
+	})
+
+	t.Run("no-info", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+		info, err := newHTTPTransport(strings.TrimPrefix(srv.URL, "http://"), defaultClient).warmup()
+		assert.NoError(t, err)
+		assert.Nil(t, info)
+	})
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	min := []int{7, 0, 0}
+	for v, want := range map[string]bool{
+		"7.0.0":       true,
+		"7.21.1":      true,
+		"10.0":        true,
+		"7.22.0-rc.1": true,
+		"6.22.0":      false,
+		"6.99.99+git": false,
+		"":            false,
+		"latest":      false,
+	} {
+		assert.Equal(t, want, versionAtLeast(v, min), v)
+	}
+}
+
+func TestTransportUDS(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not supported on Windows")
+	}
+	dir, err := ioutil.TempDir("", "dd-trace-go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	send := func(trans transport) error {
+		p, err := encode(getTestTrace(2, 2))
+		if err != nil {
+			return err
+		}
+		_, err = trans.send(context.Background(), p)
+		return err
+	}
+
+	t.Run("received", func(t *testing.T) {
+		assert := assert.New(t)
+		sock := filepath.Join(dir, "apm.socket")
+		ln, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			mu     sync.Mutex
+			paths  []string
+			traces spanLists
+		)
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var got spanLists
+			if err := msgp.Decode(r.Body, &got); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			paths = append(paths, r.URL.Path)
+			traces = append(traces, got...)
+			mu.Unlock()
+			w.Write([]byte("{}"))
+		})}
+		go srv.Serve(ln)
+		defer srv.Close()
+
+		c := newConfig(WithUDS(sock), WithAgentPath("custom/traces"))
+		assert.NoError(send(c.transport))
+		assert.Equal([]string{"/custom/traces"}, paths)
+		assert.Len(traces, 2)
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		c := newConfig(WithUDS(filepath.Join(dir, "missing.socket")))
+		err := send(c.transport)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "not found")
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		sock := filepath.Join(dir, "closed.socket")
+		ln, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+		c := newConfig(WithUDS(sock))
+		err = send(c.transport)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "refused the connection")
+	})
+}
+
+func TestTransportAgentPath(t *testing.T) {
+	assert := assert.New(t)
+	trans := newTransport("localhost:8126", nil, "v0.3", "/proxy/traces").(*httpTransport)
+	assert.Equal("http://localhost:8126/proxy/traces", trans.endpoint())
+	assert.False(trans.fallback("v0.3"))
+	assert.Equal("http://localhost:8126/proxy/traces", trans.endpoint())
+}
+
+func TestTransportSendContext(t *testing.T) {
+	assert := assert.New(t)
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	trans := newTransport(strings.TrimPrefix(srv.URL, "http://"), &http.Client{}, "", "")
+	p, err := encode(getTestTrace(1, 1))
+	assert.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = trans.send(ctx, p)
+	assert.Error(err)
+	assert.True(time.Since(start) < time.Second)
+}